@@ -34,6 +34,8 @@ type Request struct {
 	Type   int64 `protobuf:"varint,2,opt,name=type,proto3" json:"type,omitempty"`
 	Offset int64 `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`
 	Length int64 `protobuf:"varint,4,opt,name=length,proto3" json:"length,omitempty"`
+	Epoch  int64 `protobuf:"varint,5,opt,name=epoch,proto3" json:"epoch,omitempty"`
+	Source int64 `protobuf:"varint,6,opt,name=source,proto3" json:"source,omitempty"`
 }
 
 func (m *Request) Reset()                    { *m = Request{} }
@@ -92,6 +94,16 @@ func (m *Request) MarshalTo(data []byte) (int, error) {
 		i++
 		i = encodeVarintBlock(data, i, uint64(m.Length))
 	}
+	if m.Epoch != 0 {
+		data[i] = 0x28
+		i++
+		i = encodeVarintBlock(data, i, uint64(m.Epoch))
+	}
+	if m.Source != 0 {
+		data[i] = 0x30
+		i++
+		i = encodeVarintBlock(data, i, uint64(m.Source))
+	}
 	return i, nil
 }
 
@@ -176,6 +188,12 @@ func (m *Request) Size() (n int) {
 	if m.Length != 0 {
 		n += 1 + sovBlock(uint64(m.Length))
 	}
+	if m.Epoch != 0 {
+		n += 1 + sovBlock(uint64(m.Epoch))
+	}
+	if m.Source != 0 {
+		n += 1 + sovBlock(uint64(m.Source))
+	}
 	return n
 }
 
@@ -316,6 +334,44 @@ func (m *Request) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Epoch", wireType)
+			}
+			m.Epoch = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBlock
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Epoch |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Source", wireType)
+			}
+			m.Source = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBlock
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Source |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBlock(data[iNdEx:])
@@ -577,16 +633,17 @@ var (
 )
 
 var fileDescriptorBlock = []byte{
-	// 161 bytes of a gzipped FileDescriptorProto
+	// 192 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0xe2, 0x4e, 0xca, 0xc9, 0x4f,
-	0xce, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x05, 0x73, 0x94, 0x62, 0xb9, 0xd8, 0x83,
-	0x52, 0x0b, 0x4b, 0x53, 0x8b, 0x4b, 0x84, 0xf8, 0xb8, 0x98, 0x32, 0x53, 0x24, 0x18, 0x15, 0x18,
-	0x35, 0x98, 0x83, 0x80, 0x2c, 0x21, 0x21, 0x2e, 0x96, 0x92, 0xca, 0x82, 0x54, 0x09, 0x26, 0xb0,
-	0x08, 0x98, 0x2d, 0x24, 0xc6, 0xc5, 0x96, 0x9f, 0x96, 0x56, 0x9c, 0x5a, 0x22, 0xc1, 0x0c, 0x16,
-	0x85, 0xf2, 0x40, 0xe2, 0x39, 0xa9, 0x79, 0xe9, 0x25, 0x19, 0x12, 0x2c, 0x10, 0x71, 0x08, 0x4f,
-	0x29, 0x8e, 0x8b, 0x23, 0x28, 0xb5, 0xb8, 0x20, 0x3f, 0xaf, 0x38, 0x15, 0xaf, 0xf9, 0x6c, 0x08,
-	0xf3, 0x8b, 0x52, 0x8b, 0x4b, 0x73, 0x20, 0xe6, 0x73, 0x06, 0x41, 0x79, 0xb8, 0xcc, 0x77, 0x12,
-	0x38, 0xf1, 0x48, 0x8e, 0xf1, 0x02, 0x10, 0x3f, 0x00, 0xe2, 0x19, 0x8f, 0xe5, 0x18, 0x92, 0xd8,
-	0xc0, 0xde, 0x33, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0xd8, 0xe1, 0x3f, 0x71, 0xed, 0x00, 0x00,
-	0x00,
+	0xce, 0xd6, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x05, 0x73, 0x94, 0xba, 0x19, 0xb9, 0xd8,
+	0x83, 0x52, 0x0b, 0x4b, 0x53, 0x8b, 0x4b, 0x84, 0xf8, 0xb8, 0x98, 0x32, 0x53, 0x24, 0x18, 0x15,
+	0x18, 0x35, 0x98, 0x83, 0x98, 0x32, 0x53, 0x84, 0x84, 0xb8, 0x58, 0x4a, 0x2a, 0x0b, 0x52, 0x25,
+	0x98, 0xc0, 0x22, 0x60, 0xb6, 0x90, 0x18, 0x17, 0x5b, 0x7e, 0x5a, 0x5a, 0x71, 0x6a, 0x89, 0x04,
+	0x33, 0x58, 0x14, 0xca, 0x03, 0x89, 0xe7, 0xa4, 0xe6, 0xa5, 0x97, 0x64, 0x48, 0xb0, 0x40, 0xc4,
+	0x21, 0x3c, 0x21, 0x11, 0x2e, 0xd6, 0xd4, 0x82, 0xfc, 0xe4, 0x0c, 0x09, 0x56, 0xb0, 0x30, 0x84,
+	0x03, 0x52, 0x5d, 0x9c, 0x5f, 0x5a, 0x94, 0x9c, 0x2a, 0xc1, 0x06, 0x51, 0x0d, 0xe1, 0x29, 0xc5,
+	0x71, 0x71, 0x04, 0xa5, 0x16, 0x17, 0xe4, 0xe7, 0x15, 0xa7, 0xe2, 0x75, 0x0d, 0x1b, 0xc2, 0x35,
+	0x45, 0xa9, 0xc5, 0xa5, 0x39, 0x10, 0xd7, 0x70, 0x06, 0x41, 0x79, 0xb8, 0x5c, 0xe3, 0x24, 0x70,
+	0xe2, 0x91, 0x1c, 0xe3, 0x85, 0x47, 0x72, 0x8c, 0x0f, 0x1e, 0xc9, 0x31, 0xce, 0x78, 0x2c, 0xc7,
+	0x90, 0xc4, 0x06, 0x0e, 0x0d, 0x63, 0xc0, 0x00, 0x8b, 0x16, 0x7f, 0xe6, 0x1c, 0x01, 0x00, 0x00,
 }
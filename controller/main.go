@@ -1,247 +1,171 @@
 package main
 
-/*
-#cgo LDFLAGS: -L ./libs -ltcmu
-#cgo CFLAGS: -I ./includes
-
-#include <errno.h>
-#include <stdlib.h>
-#include <scsi/scsi.h>
-#include "libtcmu.h"
-
-extern struct tcmulib_context *tcmu_init();
-extern bool tcmu_poll_master_fd(struct tcmulib_context *cxt);
-extern int tcmu_wait_for_next_command(struct tcmu_device *dev);
-extern void *allocate_buffer(int length);
-
-*/
-import "C"
-import "unsafe"
-
 import (
-	"net"
+	"flag"
+	"fmt"
+	"os"
 	"os/signal"
-	"sync"
+	"runtime/pprof"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 
-	"github.com/yasker/longhorn/block"
-	"github.com/yasker/longhorn/rpc"
-
-	"flag"
-	"os"
-	"runtime/pprof"
+	"github.com/yasker/longhorn/engine"
+	"github.com/yasker/longhorn/failover"
+	"github.com/yasker/longhorn/frontend/iscsi"
+	"github.com/yasker/longhorn/frontend/nbd"
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/types"
 )
 
 var (
-	ready bool = false
-
 	log = logrus.WithFields(logrus.Fields{"pkg": "main"})
 
-	address = "localhost:5000"
+	cpuprofile      = flag.String("cpuprofile", "", "write cpu profile to file")
+	shutdownTimeout = flag.Int("shutdown-timeout", 30, "seconds to wait for in-flight commands when shutting down")
+	frontendName    = flag.String("frontend", "tcmu", "frontend serving the volumes, tcmu, nbd or iscsi")
+
+	// a TCMU device specifies its own volume, these are for other frontends
+	listen     = flag.String("listen", "", "address the nbd or iscsi frontend listens on, :10809 or :3260 by default")
+	volumeName = flag.String("volume", "", "name of the volume")
+	volumeSize = flag.Int64("size", 0, "size of the volume, in bytes")
+	replicas   = flag.String("replicas", "localhost:5000", "comma separated addresses of the replicas of the volume")
+	timeout    = flag.Int("timeout", 5, "timeout in seconds for each replica operation")
+	blockSize  = flag.Int("block-size", 512, "logical block size of the iscsi LUN")
+	targetName = flag.String("target-name", "", "name of the iscsi target, iqn.2016-06.io.longhorn:<volume> by default")
+
+	// ALUA, when two controllers front the same replicas through iscsi
+	portGroup     = flag.Int("port-group", 0, "ALUA target port group of this controller, 0 disables ALUA")
+	peerPortGroup = flag.Int("peer-port-group", 0, "ALUA target port group of the other controller")
+	standby       = flag.Bool("standby", false, "start as the standby controller, SIGUSR1 activates it")
+
+	// merging the adjacent I/Os to each replica, fewer and larger requests
+	// for the latency of the window
+	coalesceWindow    = flag.Duration("coalesce-window", 0, "how long to wait for adjacent I/Os to merge with, e.g. 100us, 0 disables coalescing")
+	coalesceMaxLength = flag.Int64("coalesce-max-length", 1024*1024, "the most bytes of a merged I/O")
+
+	frontends = map[string]func() (types.Frontend, error){
+		"nbd":   newNbdFrontend,
+		"iscsi": newIscsiFrontend,
+	}
 
-	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
-	workers    = 128
+	// the role of this controller with ALUA, nil if disabled
+	role *failover.Failover
 
 	sigs chan os.Signal
 	done chan bool
 )
 
-type TcmuState struct {
-	volume    string
-	client    *rpc.Client
-	conn      *net.TCPConn
-	lbas      int64
-	blockSize int
-	mutex     *sync.Mutex
-	dev       TcmuDevice
-}
-
-//export shOpen
-func shOpen(dev TcmuDevice) int {
-	var (
-		err error
-	)
-
-	state := &TcmuState{
-		mutex: &sync.Mutex{},
-	}
-	blockSizeStr := C.CString("hw_block_size")
-	defer C.free(unsafe.Pointer(blockSizeStr))
-	blockSize := int(C.tcmu_get_attribute(dev, blockSizeStr))
-	if blockSize == -1 {
-		log.Errorln("Cannot find valid hw_block_size")
-		return -C.EINVAL
-	}
-	state.blockSize = blockSize
+const (
+	// how often the active controller checks if it has been fenced
+	failoverInterval = time.Second
+)
 
-	size := int64(C.tcmu_get_device_size(dev))
-	if size == -1 {
-		log.Errorln("Cannot find valid disk size")
-		return -C.EINVAL
+func openVolume() (types.Volume, error) {
+	if *volumeName == "" {
+		return nil, fmt.Errorf("Volume name is required")
 	}
-	state.lbas = size / int64(state.blockSize)
-
-	cfgString := C.GoString(C.tcmu_get_dev_cfgstring(dev))
-	if cfgString == "" {
-		log.Errorln("Cannot find configuration string")
-		return -C.EINVAL
+	if *volumeSize <= 0 {
+		return nil, fmt.Errorf("Invalid volume size %v", *volumeSize)
 	}
-	//id := strings.TrimPrefix(cfgString, "file/")
-	//TODO check volume name here
+	return openEngine(*volumeName, *volumeSize, strings.Split(*replicas, ","), *timeout)
+}
 
-	addr, err := net.ResolveTCPAddr("tcp4", address)
+// openEngine is the types.VolumeOpener of the controller, the controller
+// shuts down if the replicas fence the volume
+func openEngine(name string, size int64, replicas []string, timeout int) (types.Volume, error) {
+	e, err := engine.New(name, size, replicas, timeout)
 	if err != nil {
-		log.Fatalf("failed to resolve ", address, err)
+		return nil, err
 	}
-	state.conn, err = net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		log.Fatalf("Cannot connect to replica, %v", err)
+	if *coalesceWindow > 0 {
+		e.SetCoalescing(*coalesceWindow, *coalesceMaxLength)
 	}
-
-	state.client = rpc.NewClient(state.conn, 5, workers)
-	state.dev = dev
-
-	go state.HandleRequest()
-
-	log.Debugln("Device added")
-
-	ready = true
-	return 0
+	go watchFence(e)
+	return e, nil
 }
 
-func (s *TcmuState) HandleRequest() {
-	defer s.conn.Close()
-
-	cmds := make(chan TcmuCommand, workers)
-	wg := sync.WaitGroup{}
-	wg.Add(workers)
-	for i := 0; i < workers; i++ {
-		go func() {
-			defer wg.Done()
-			s.processCommands(cmds)
-		}()
+// watchFence stops the controller once another controller has taken over the
+// volume, it's not supposed to write any more
+func watchFence(e *engine.Engine) {
+	if !e.WaitFenced() {
+		return
 	}
-
-	for true {
-		C.tcmulib_processing_start(s.dev)
-		cmd := C.tcmulib_get_next_command(s.dev)
-		for cmd != nil {
-			cmds <- cmd
-			cmd = C.tcmulib_get_next_command(s.dev)
-		}
-		ret := C.tcmu_wait_for_next_command(s.dev)
-		if ret != 0 {
-			log.Errorln("Fail to wait for next command", ret)
-			break
-		}
+	log.Errorf("Shutting down process, volume %v has been taken over by a newer controller", e.Name())
+	select {
+	case done <- true:
+	default:
 	}
 }
 
-func (s *TcmuState) handleReadCommand(dev TcmuDevice, cmd TcmuCommand) int {
-	offset := CmdGetLba(cmd) * int64(s.blockSize)
-	length := CmdGetXferLength(cmd) * s.blockSize
-
-	resp, err := s.client.Call(&rpc.Request{
-		Header: &block.Request{
-			Type:   rpc.MSG_TYPE_READ_REQUEST,
-			Offset: offset,
-			Length: int64(length),
-		}})
+func newNbdFrontend() (types.Frontend, error) {
+	volume, err := openVolume()
 	if err != nil {
-		log.Errorln("read failed: ", err.Error())
-		return CmdSetMediumError(cmd)
+		return nil, err
 	}
-
-	copied := CmdMemcpyIntoIovec(cmd, resp.Data, length)
-	if copied != length {
-		log.Errorln("read failed: unable to complete buffer copy ")
-		return CmdSetMediumError(cmd)
-	}
-	return C.SAM_STAT_GOOD
+	return nbd.New(listenAddress(":10809"), *volumeName, volume), nil
 }
 
-func (s *TcmuState) handleWriteCommand(dev TcmuDevice, cmd TcmuCommand) int {
-	offset := CmdGetLba(cmd) * int64(s.blockSize)
-	length := CmdGetXferLength(cmd) * s.blockSize
-
-	buf := make([]byte, length)
-	if buf == nil {
-		log.Errorln("read failed: fail to allocate buffer")
-		return CmdSetMediumError(cmd)
+func newIscsiFrontend() (types.Frontend, error) {
+	if *blockSize <= 0 || *volumeSize%int64(*blockSize) != 0 {
+		return nil, fmt.Errorf("Volume size %v is not a multiple of block size %v", *volumeSize, *blockSize)
 	}
-	copied := CmdMemcpyFromIovec(cmd, buf, length)
-	if copied != length {
-		log.Errorln("write failed: unable to complete buffer copy ")
-		return CmdSetMediumError(cmd)
+	volume, err := openVolume()
+	if err != nil {
+		return nil, err
 	}
-
-	if _, err := s.client.Call(&rpc.Request{
-		Header: &block.Request{
-			Type:   rpc.MSG_TYPE_WRITE_REQUEST,
-			Offset: offset,
-			Length: int64(length),
-		},
-		Data: buf}); err != nil {
-		log.Errorln("write failed: ", err.Error())
-		return CmdSetMediumError(cmd)
+	name := *targetName
+	if name == "" {
+		name = "iqn.2016-06.io.longhorn:" + *volumeName
 	}
-
-	return C.SAM_STAT_GOOD
-}
-
-func (s *TcmuState) processCommands(cmds chan TcmuCommand) {
-	for cmd := range cmds {
-		s.processCommand(cmd)
+	device, err := scsi.NewDevice(*volumeName, volume, *blockSize)
+	if err != nil {
+		volume.Close()
+		return nil, err
 	}
-}
-
-func (s *TcmuState) processCommand(cmd TcmuCommand) {
-	ret := s.handleCommand(cmd)
-
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	C.tcmulib_command_complete(s.dev, cmd, C.int(ret))
-	C.tcmulib_processing_complete(s.dev)
-}
-
-func (s *TcmuState) handleCommand(cmd TcmuCommand) int {
-	scsiCmd := CmdGetScsiCmd(cmd)
-	switch scsiCmd {
-	case C.INQUIRY:
-		return CmdEmulateInquiry(cmd, s.dev)
-	case C.TEST_UNIT_READY:
-		return CmdEmulateTestUnitReady(cmd)
-	case C.SERVICE_ACTION_IN_16:
-		return CmdEmulateServiceActionIn(cmd, s.lbas, s.blockSize)
-	case C.MODE_SENSE, C.MODE_SENSE_10:
-		return CmdEmulateModeSense(cmd)
-	case C.MODE_SELECT, C.MODE_SELECT_10:
-		return CmdEmulateModeSelect(cmd)
-	case C.READ_6, C.READ_10, C.READ_12, C.READ_16:
-		return s.handleReadCommand(s.dev, cmd)
-	case C.WRITE_6, C.WRITE_10, C.WRITE_12, C.WRITE_16:
-		return s.handleWriteCommand(s.dev, cmd)
-	default:
-		log.Errorf("unknown command 0x%x\n", scsiCmd)
+	if *portGroup != 0 {
+		if *portGroup < 0 || *portGroup > 0xffff || *peerPortGroup <= 0 || *peerPortGroup > 0xffff {
+			volume.Close()
+			return nil, fmt.Errorf("Invalid port groups %v and %v", *portGroup, *peerPortGroup)
+		}
+		role, err = failover.New(volume.(types.MetadataStore), uint16(*portGroup), uint16(*peerPortGroup),
+			!*standby, failoverInterval)
+		if err != nil {
+			volume.Close()
+			return nil, err
+		}
+		device.EnableALUA(role)
 	}
-	return C.TCMU_NOT_HANDLED
+	return iscsi.New(listenAddress(":3260"), name, device, volume), nil
 }
 
-//export shClose
-func shClose(dev TcmuDevice) {
-	log.Debugln("Device removed")
+func listenAddress(defaultAddress string) string {
+	if *listen == "" {
+		return defaultAddress
+	}
+	return *listen
 }
 
 func handleSignal() {
 	sig := <-sigs
 	log.Infoln("Shutting down process, due to received signal ", sig)
-	pprof.StopCPUProfile()
 	done <- true
 }
 
+// handleActivate takes over the volume on SIGUSR1, e.g. from a cluster
+// manager which found the active controller dead
+func handleActivate() {
+	activate := make(chan os.Signal, 1)
+	signal.Notify(activate, syscall.SIGUSR1)
+	for range activate {
+		if err := role.Activate(); err != nil {
+			log.Errorln("Fail to activate: ", err)
+		}
+	}
+}
+
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 
@@ -261,17 +185,30 @@ func main() {
 
 	go handleSignal()
 
-	cxt := C.tcmu_init()
-	if cxt == nil {
-		panic("cxt is nil")
+	newFrontend, ok := frontends[*frontendName]
+	if !ok {
+		log.Fatal("Unsupported frontend ", *frontendName)
+	}
+	frontend, err := newFrontend()
+	if err != nil {
+		log.Fatal("Fail to create frontend: ", err)
+	}
+	if err := frontend.Startup(); err != nil {
+		log.Fatal("Fail to start frontend: ", err)
 	}
 
-	for !ready {
-		result := C.tcmu_poll_master_fd(cxt)
-		log.Debugln("Poll master fd one more time, last result ", result)
+	if role != nil {
+		go handleActivate()
 	}
 
 	log.Infoln("Waiting for process")
 	<-done
+	if role != nil {
+		role.Close()
+	}
+	if err := frontend.Shutdown(time.Duration(*shutdownTimeout) * time.Second); err != nil {
+		log.Errorln("Fail to shutdown frontend: ", err)
+	}
+	pprof.StopCPUProfile()
 	log.Infoln("Shutdown complete")
 }
@@ -0,0 +1,16 @@
+//go:build !notcmu
+// +build !notcmu
+
+package main
+
+import (
+	"github.com/yasker/longhorn/frontend/tcmu"
+	"github.com/yasker/longhorn/types"
+)
+
+// The TCMU frontend needs libtcmu, build with "-tags notcmu" to leave it out.
+func init() {
+	frontends["tcmu"] = func() (types.Frontend, error) {
+		return tcmu.New(openEngine), nil
+	}
+}
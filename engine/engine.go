@@ -0,0 +1,364 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/types"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// the number of requests can be queued for each replica
+	queueDepth = 128
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "engine"})
+)
+
+// Engine is a volume replicated to a set of replicas. Writes go to all the
+// replicas, reads are served by the first replica which answers.
+type Engine struct {
+	name     string
+	size     int64
+	replicas []string
+	clients  []*rpc.Client
+	conns    []*net.TCPConn
+
+	// the changes overlapping are sent to the replicas one after another,
+	// so all of them have the same last writer
+	changes *util.RangeLock
+
+	// the epoch of the controller, accessed atomically
+	epoch     int64
+	fenced    chan struct{}
+	fenceOnce *sync.Once
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// New connects to all the replicas of the volume
+func New(name string, size int64, replicas []string, timeout int) (*Engine, error) {
+	e := &Engine{
+		name:      name,
+		size:      size,
+		replicas:  replicas,
+		fenced:    make(chan struct{}),
+		fenceOnce: &sync.Once{},
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
+		changes:   util.NewRangeLock(),
+	}
+	for _, address := range replicas {
+		addr, err := net.ResolveTCPAddr("tcp4", address)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("Failed to resolve %v: %v", address, err)
+		}
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("Cannot connect to replica %v: %v", address, err)
+		}
+		e.conns = append(e.conns, conn)
+		e.clients = append(e.clients, rpc.NewClient(conn, timeout, queueDepth))
+	}
+	return e, nil
+}
+
+// Open is a types.VolumeOpener
+func Open(name string, size int64, replicas []string, timeout int) (types.Volume, error) {
+	return New(name, size, replicas, timeout)
+}
+
+func (e *Engine) Name() string {
+	return e.name
+}
+
+func (e *Engine) Size() int64 {
+	return e.size
+}
+
+// SetEpoch is a types.Fenceable
+func (e *Engine) SetEpoch(epoch int64) {
+	atomic.StoreInt64(&e.epoch, epoch)
+}
+
+// SetCoalescing merges the adjacent reads, and writes, sent to each replica
+// within the window, see rpc.Client.SetCoalescing. It should be called before
+// the volume is used.
+func (e *Engine) SetCoalescing(window time.Duration, maxLength int64) {
+	for _, client := range e.clients {
+		client.SetCoalescing(window, maxLength)
+	}
+}
+
+// checkFenced fails the operations once a replica has fenced the engine
+func (e *Engine) checkFenced() error {
+	select {
+	case <-e.fenced:
+		return rpc.ErrFenced
+	default:
+	}
+	return nil
+}
+
+// call sends the request with the epoch, and fences the engine for good if the
+// replica tells another controller has taken over
+func (e *Engine) call(i int, header *block.Request, data []byte) (*rpc.Response, error) {
+	header.Epoch = atomic.LoadInt64(&e.epoch)
+	resp, err := e.clients[i].Call(&rpc.Request{
+		Header: header,
+		Data:   data,
+	})
+	if err == rpc.ErrFenced {
+		e.fenceOnce.Do(func() {
+			log.Errorf("Volume %v is fenced by replica %v, epoch %v is too old", e.name, e.replicas[i], header.Epoch)
+			close(e.fenced)
+		})
+	}
+	return resp, err
+}
+
+// WaitFenced blocks until the engine is fenced, or returns false if it's
+// closed first
+func (e *Engine) WaitFenced() bool {
+	select {
+	case <-e.fenced:
+		return true
+	case <-e.closed:
+		return false
+	}
+}
+
+func (e *Engine) checkRange(offset, length int64) error {
+	if offset < 0 || length < 0 || offset+length > e.size {
+		return fmt.Errorf("Range [%v, %v) is out of volume %v", offset, offset+length, e.name)
+	}
+	return nil
+}
+
+// ReadAt is served by the first replica which answers successfully
+func (e *Engine) ReadAt(buf []byte, offset int64) (int, error) {
+	if err := e.checkFenced(); err != nil {
+		return 0, err
+	}
+	if err := e.checkRange(offset, int64(len(buf))); err != nil {
+		return 0, err
+	}
+
+	var err error
+	for i := range e.clients {
+		var resp *rpc.Response
+		resp, err = e.call(i, &block.Request{
+			Type:   rpc.MSG_TYPE_READ_REQUEST,
+			Offset: offset,
+			Length: int64(len(buf)),
+		}, nil)
+		// a short answer is a failure of the replica, try the next one
+		if err == nil && len(resp.Data) != len(buf) {
+			log.Errorf("read from replica %v returned %v bytes, expected %v", e.replicas[i], len(resp.Data), len(buf))
+			util.PutBuffer(resp.Data)
+			err = io.ErrUnexpectedEOF
+			continue
+		}
+		if err == nil {
+			copy(buf, resp.Data)
+			util.PutBuffer(resp.Data)
+			return len(buf), nil
+		}
+		log.Errorf("read from replica %v failed: %v", e.replicas[i], err)
+	}
+	return 0, err
+}
+
+// WriteAt only succeeds if it succeeded on every replica. The writes, discards
+// and copies overlapping each other are sent one after another in the order
+// they're called, the others in parallel.
+func (e *Engine) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := e.checkFenced(); err != nil {
+		return 0, err
+	}
+	if err := e.checkRange(offset, int64(len(buf))); err != nil {
+		return 0, err
+	}
+	hold := e.changes.Hold(util.Range{Start: offset, End: offset + int64(len(buf))})
+	hold.Wait()
+	defer hold.Release()
+
+	errs := make([]error, len(e.clients))
+	wg := sync.WaitGroup{}
+	wg.Add(len(e.clients))
+	for i := range e.clients {
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = e.call(i, &block.Request{
+				Type:   rpc.MSG_TYPE_WRITE_REQUEST,
+				Offset: offset,
+				Length: int64(len(buf)),
+			}, buf)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return 0, fmt.Errorf("write to replica %v failed: %v", e.replicas[i], err)
+		}
+	}
+	return len(buf), nil
+}
+
+// Flush only succeeds if it succeeded on every replica
+func (e *Engine) Flush() error {
+	if err := e.checkFenced(); err != nil {
+		return err
+	}
+	for i := range e.clients {
+		if _, err := e.call(i, &block.Request{
+			Type: rpc.MSG_TYPE_FLUSH_REQUEST,
+		}, nil); err != nil {
+			return fmt.Errorf("flush replica %v failed: %v", e.replicas[i], err)
+		}
+	}
+	return nil
+}
+
+// Discard only succeeds if it succeeded on every replica. It's sent in
+// requests of up to rpc.MAX_DISCARD_LENGTH, which the replicas may have to
+// zero within the timeout.
+func (e *Engine) Discard(offset, length int64) error {
+	if err := e.checkFenced(); err != nil {
+		return err
+	}
+	if err := e.checkRange(offset, length); err != nil {
+		return err
+	}
+	hold := e.changes.Hold(util.Range{Start: offset, End: offset + length})
+	hold.Wait()
+	defer hold.Release()
+
+	for done := int64(0); done < length; done += rpc.MAX_DISCARD_LENGTH {
+		n := length - done
+		if n > rpc.MAX_DISCARD_LENGTH {
+			n = rpc.MAX_DISCARD_LENGTH
+		}
+		for i := range e.clients {
+			if _, err := e.call(i, &block.Request{
+				Type:   rpc.MSG_TYPE_DISCARD_REQUEST,
+				Offset: offset + done,
+				Length: n,
+			}, nil); err != nil {
+				return fmt.Errorf("discard on replica %v failed: %v", e.replicas[i], err)
+			}
+		}
+	}
+	return nil
+}
+
+// Copy is a types.Copier, it only succeeds if it succeeded on every replica
+func (e *Engine) Copy(offset, source, length int64) error {
+	if err := e.checkFenced(); err != nil {
+		return err
+	}
+	if err := e.checkRange(offset, length); err != nil {
+		return err
+	}
+	if err := e.checkRange(source, length); err != nil {
+		return err
+	}
+	hold := e.changes.Hold(
+		util.Range{Start: offset, End: offset + length},
+		util.Range{Start: source, End: source + length})
+	hold.Wait()
+	defer hold.Release()
+
+	errs := make([]error, len(e.clients))
+	wg := sync.WaitGroup{}
+	wg.Add(len(e.clients))
+	for i := range e.clients {
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = e.call(i, &block.Request{
+				Type:   rpc.MSG_TYPE_COPY_REQUEST,
+				Offset: offset,
+				Length: length,
+				Source: source,
+			}, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("copy on replica %v failed: %v", e.replicas[i], err)
+		}
+	}
+	return nil
+}
+
+// GetMetadata is served by the first replica which answers successfully. It
+// works even if the engine is fenced.
+func (e *Engine) GetMetadata(name string) ([]byte, error) {
+	data := rpc.EncodeMetadata(name, nil)
+
+	var err error
+	for i := range e.clients {
+		var resp *rpc.Response
+		resp, err = e.call(i, &block.Request{
+			Type:   rpc.MSG_TYPE_READ_METADATA_REQUEST,
+			Length: int64(len(data)),
+		}, data)
+		if err == nil {
+			return resp.Data, nil
+		}
+		log.Errorf("read metadata %v from replica %v failed: %v", name, e.replicas[i], err)
+	}
+	return nil, err
+}
+
+// SetMetadata only succeeds if it succeeded on every replica
+func (e *Engine) SetMetadata(name string, value []byte) error {
+	if err := e.checkFenced(); err != nil {
+		return err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	data := rpc.EncodeMetadata(name, value)
+
+	for i := range e.clients {
+		if _, err := e.call(i, &block.Request{
+			Type:   rpc.MSG_TYPE_WRITE_METADATA_REQUEST,
+			Length: int64(len(data)),
+		}, data); err != nil {
+			return fmt.Errorf("write metadata %v to replica %v failed: %v", name, e.replicas[i], err)
+		}
+	}
+	return nil
+}
+
+// Close aborts all the outstanding operations and disconnects from the
+// replicas. It may be called more than once.
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		// close connections first, so no one would block on sending
+		for _, conn := range e.conns {
+			conn.Close()
+		}
+		for _, client := range e.clients {
+			client.Close()
+		}
+		close(e.closed)
+	})
+	return nil
+}
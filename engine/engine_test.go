@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/rpc"
+)
+
+const (
+	testTimeout    = 5 // in seconds
+	testRegionSize = int64(64 * 1024)
+	testSectorSize = int64(512)
+	testReplicas   = 3
+	testWorkers    = 16
+	testIterations = 1000
+	testJitter     = 200 * time.Microsecond
+)
+
+// jitterReplica serves the region from memory, and delays each request
+// randomly so the requests in parallel complete in any order
+type jitterReplica struct {
+	data     []byte
+	discards []int64
+	mutex    *sync.Mutex
+	listener *net.TCPListener
+}
+
+func (r *jitterReplica) RequestHandler(req *rpc.Request) (*rpc.Response, error) {
+	time.Sleep(time.Duration(rand.Int63n(int64(testJitter))))
+	header := req.Header
+	resp := &rpc.Response{
+		Header: &block.Response{
+			Id:     header.Id,
+			Type:   uint64(header.Type + 1),
+			Result: "Success",
+		},
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch header.Type {
+	case rpc.MSG_TYPE_READ_REQUEST:
+		resp.Header.Length = header.Length
+		resp.Data = make([]byte, header.Length)
+		copy(resp.Data, r.data[header.Offset:])
+	case rpc.MSG_TYPE_WRITE_REQUEST:
+		copy(r.data[header.Offset:], req.Data)
+	case rpc.MSG_TYPE_DISCARD_REQUEST:
+		r.discards = append(r.discards, header.Length)
+	}
+	return resp, nil
+}
+
+func startJitterReplica(t *testing.T) *jitterReplica {
+	r := &jitterReplica{
+		data:  make([]byte, testRegionSize),
+		mutex: &sync.Mutex{},
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to resolve: ", err)
+	}
+	r.listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen to: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := r.listener.AcceptTCP()
+			if err != nil {
+				// the listener is closed by the test
+				return
+			}
+			rpc.NewServer(conn, 128, r.RequestHandler).Start()
+		}
+	}()
+	return r
+}
+
+// randomWrite returns a sector aligned range of the region, filled with tag
+func randomWrite(r *rand.Rand, tag uint64) (int64, []byte) {
+	sectors := testRegionSize / testSectorSize
+	start := r.Int63n(sectors)
+	length := 1 + r.Int63n(sectors-start)
+	if length > 16 {
+		length = 16
+	}
+	data := make([]byte, length*testSectorSize)
+	for i := 0; i < len(data); i += 8 {
+		binary.BigEndian.PutUint64(data[i:], tag)
+	}
+	return start * testSectorSize, data
+}
+
+// TestStress writes from the workers in parallel through the engine to a
+// small region, then the replicas should have the same last writer
+// everywhere
+func TestStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skip stress test in short mode")
+	}
+
+	replicas := []*jitterReplica{}
+	addresses := []string{}
+	for i := 0; i < testReplicas; i++ {
+		r := startJitterReplica(t)
+		defer r.listener.Close()
+		replicas = append(replicas, r)
+		addresses = append(addresses, r.listener.Addr().String())
+	}
+	volume, err := New("stress", testRegionSize, addresses, testTimeout)
+	if err != nil {
+		t.Fatal("Fail to open volume: ", err)
+	}
+	defer volume.Close()
+
+	errs := make(chan error, testWorkers)
+	for w := 0; w < testWorkers; w++ {
+		go func(w int) {
+			random := rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+			for i := 0; i < testIterations; i++ {
+				offset, data := randomWrite(random, uint64(w)<<32|uint64(i+1))
+				if _, err := volume.WriteAt(data, offset); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for w := 0; w < testWorkers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal("Fail to write: ", err)
+		}
+	}
+
+	buf := make([]byte, testRegionSize)
+	if _, err := volume.ReadAt(buf, 0); err != nil {
+		t.Fatal("Fail to read: ", err)
+	}
+	for i, r := range replicas {
+		r.mutex.Lock()
+		same := bytes.Equal(r.data, buf)
+		r.mutex.Unlock()
+		if !same {
+			t.Fatalf("Replica %v has a different last writer", i)
+		}
+	}
+}
+
+// TestDiscardSplit checks a large discard is sent in requests of up to
+// rpc.MAX_DISCARD_LENGTH
+func TestDiscardSplit(t *testing.T) {
+	r := startJitterReplica(t)
+	defer r.listener.Close()
+	size := 2*int64(rpc.MAX_DISCARD_LENGTH) + testSectorSize
+	volume, err := New("discard", size, []string{r.listener.Addr().String()}, testTimeout)
+	if err != nil {
+		t.Fatal("Fail to open volume: ", err)
+	}
+	defer volume.Close()
+
+	if err := volume.Discard(0, size); err != nil {
+		t.Fatal("Fail to discard: ", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expected := []int64{rpc.MAX_DISCARD_LENGTH, rpc.MAX_DISCARD_LENGTH, testSectorSize}
+	if fmt.Sprint(r.discards) != fmt.Sprint(expected) {
+		t.Fatalf("Discards of %v bytes, expected %v", r.discards, expected)
+	}
+}
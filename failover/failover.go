@@ -0,0 +1,207 @@
+package failover
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/types"
+)
+
+const (
+	// name of the metadata the epoch is kept in by the replicas
+	epochMetadata = "controller-epoch"
+	// the low bits of an epoch are the port group which took it, so two
+	// controllers taking over at the same time never get the same epoch
+	epochGroupBits = 16
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "failover"})
+)
+
+// Failover is the role of this controller among the two fronting the same
+// replicas, one active and one standby. Every activation bumps the epoch kept
+// by the replicas, the active controller watches it and steps down once
+// another one has taken over. It's a scsi.ALUA, each controller is a target
+// port group.
+type Failover struct {
+	store     types.MetadataStore
+	group     uint16
+	peerGroup uint16
+	interval  time.Duration
+
+	mutex *sync.Mutex
+	state byte
+	epoch uint64
+
+	stop chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// New starts the role of port group in store, the other controller is
+// peerGroup. If active, it takes over the volume right away. The epoch is
+// checked every interval.
+func New(store types.MetadataStore, group, peerGroup uint16, active bool, interval time.Duration) (*Failover, error) {
+	if group == peerGroup {
+		return nil, fmt.Errorf("Port group %v is the same as the peer", group)
+	}
+	f := &Failover{
+		store:     store,
+		group:     group,
+		peerGroup: peerGroup,
+		interval:  interval,
+		mutex:     &sync.Mutex{},
+		state:     scsi.ALUA_STANDBY,
+		stop:      make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+	}
+	if active {
+		if err := f.Activate(); err != nil {
+			return nil, err
+		}
+	}
+	f.wg.Add(1)
+	go f.watch()
+	return f, nil
+}
+
+func (f *Failover) readEpoch() (uint64, error) {
+	value, err := f.store.GetMetadata(epochMetadata)
+	if err != nil {
+		return 0, err
+	}
+	if len(value) == 0 {
+		return 0, nil
+	}
+	epoch, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid controller epoch %q: %v", value, err)
+	}
+	return epoch, nil
+}
+
+// Activate takes over the volume with a new epoch, the other controller would
+// step down when it sees the epoch.
+func (f *Failover) Activate() error {
+	f.mutex.Lock()
+	switch f.state {
+	case scsi.ALUA_ACTIVE_OPTIMIZED:
+		f.mutex.Unlock()
+		return nil
+	case scsi.ALUA_TRANSITIONING:
+		f.mutex.Unlock()
+		return fmt.Errorf("Port group %v is being activated", f.group)
+	}
+	// the commands are refused meanwhile, rather than waiting for the
+	// replicas
+	f.state = scsi.ALUA_TRANSITIONING
+	previous := f.epoch
+	f.mutex.Unlock()
+
+	fenceable, _ := f.store.(types.Fenceable)
+	epoch, err := f.readEpoch()
+	if err == nil {
+		epoch = nextEpoch(epoch, f.group)
+		// the replicas fence the other controller as soon as they see
+		// the new epoch, so the write carries it already
+		if fenceable != nil {
+			fenceable.SetEpoch(int64(epoch))
+		}
+		err = f.store.SetMetadata(epochMetadata, []byte(strconv.FormatUint(epoch, 10)))
+		// the requests keep the epoch held before, if the takeover failed
+		if err != nil && fenceable != nil {
+			fenceable.SetEpoch(int64(previous))
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err != nil {
+		f.state = scsi.ALUA_STANDBY
+		return fmt.Errorf("Fail to take over with a new epoch: %v", err)
+	}
+	f.state = scsi.ALUA_ACTIVE_OPTIMIZED
+	f.epoch = epoch
+	log.Infof("Port group %v is active with epoch %v", f.group, epoch)
+	return nil
+}
+
+// nextEpoch returns the epoch of group newer than epoch. If the other
+// controller takes over from the same epoch at the same time, the replicas
+// keep the one of the higher port group, and fence the other.
+func nextEpoch(epoch uint64, group uint16) uint64 {
+	return (epoch>>epochGroupBits+1)<<epochGroupBits | uint64(group)
+}
+
+// check steps down if another controller has taken over
+func (f *Failover) check() {
+	f.mutex.Lock()
+	active := f.state == scsi.ALUA_ACTIVE_OPTIMIZED
+	f.mutex.Unlock()
+	if !active {
+		return
+	}
+
+	epoch, err := f.readEpoch()
+	if err != nil {
+		log.Errorln("read controller epoch failed: ", err)
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.state == scsi.ALUA_ACTIVE_OPTIMIZED && epoch > f.epoch {
+		log.Errorf("Port group %v is fenced, epoch %v has taken over from %v", f.group, epoch, f.epoch)
+		f.state = scsi.ALUA_STANDBY
+	}
+}
+
+func (f *Failover) watch() {
+	defer f.wg.Done()
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.check()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Epoch returns the epoch this controller was activated with, 0 if never
+func (f *Failover) Epoch() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.epoch
+}
+
+// PortGroups is a scsi.ALUA. The peer is assumed to be active if this one
+// isn't.
+func (f *Failover) PortGroups() []scsi.PortGroup {
+	f.mutex.Lock()
+	state := f.state
+	f.mutex.Unlock()
+
+	peerState := byte(scsi.ALUA_ACTIVE_OPTIMIZED)
+	if state == scsi.ALUA_ACTIVE_OPTIMIZED {
+		peerState = scsi.ALUA_STANDBY
+	}
+	return []scsi.PortGroup{
+		{ID: f.group, State: state},
+		{ID: f.peerGroup, State: peerState},
+	}
+}
+
+// Close stops watching the epoch
+func (f *Failover) Close() {
+	close(f.stop)
+	f.wg.Wait()
+}
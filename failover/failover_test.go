@@ -0,0 +1,251 @@
+package failover
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/scsi"
+)
+
+// testStore is the metadata of the replicas, and the epoch of the requests
+type testStore struct {
+	mutex    *sync.Mutex
+	metadata map[string][]byte
+	epoch    int64
+	// SetMetadata fails with it if set
+	err error
+	// SetMetadata waits for it to be closed if set
+	blocked chan struct{}
+}
+
+func newTestStore(epoch uint64) *testStore {
+	s := &testStore{
+		mutex:    &sync.Mutex{},
+		metadata: make(map[string][]byte),
+	}
+	if epoch != 0 {
+		s.metadata[epochMetadata] = []byte(strconv.FormatUint(epoch, 10))
+	}
+	return s
+}
+
+func (s *testStore) GetMetadata(name string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.metadata[name], nil
+}
+
+func (s *testStore) SetMetadata(name string, value []byte) error {
+	s.mutex.Lock()
+	blocked := s.blocked
+	s.mutex.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.metadata[name] = value
+	return nil
+}
+
+func (s *testStore) SetEpoch(epoch int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.epoch = epoch
+}
+
+func (s *testStore) get() (uint64, int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, _ := strconv.ParseUint(string(s.metadata[epochMetadata]), 10, 64)
+	return stored, s.epoch
+}
+
+func checkStates(t *testing.T, f *Failover, state, peerState byte) {
+	groups := f.PortGroups()
+	if groups[0].ID != f.group || groups[0].State != state ||
+		groups[1].ID != f.peerGroup || groups[1].State != peerState {
+		t.Fatalf("Port groups %+v, expected %v in state %v and %v in state %v",
+			groups, f.group, state, f.peerGroup, peerState)
+	}
+}
+
+func TestNextEpoch(t *testing.T) {
+	cases := []struct {
+		epoch    uint64
+		group    uint16
+		expected uint64
+	}{
+		{0, 1, 1<<epochGroupBits | 1},
+		{1<<epochGroupBits | 1, 2, 2<<epochGroupBits | 2},
+		// the group of the previous epoch doesn't matter
+		{1<<epochGroupBits | 2, 1, 2<<epochGroupBits | 1},
+		{1<<epochGroupBits | 1, 1, 2<<epochGroupBits | 1},
+		// the highest group doesn't carry over into the count
+		{7<<epochGroupBits | 0xffff, 0xffff, 8<<epochGroupBits | 0xffff},
+		{7<<epochGroupBits | 0xffff, 0, 8 << epochGroupBits},
+		// an epoch taken by no group
+		{5, 3, 1<<epochGroupBits | 3},
+	}
+	for _, c := range cases {
+		if epoch := nextEpoch(c.epoch, c.group); epoch != c.expected {
+			t.Fatalf("Next epoch of group %v after 0x%x is 0x%x, expected 0x%x", c.group, c.epoch, epoch, c.expected)
+		}
+	}
+
+	// both groups taking over from the same epoch get different ones, the
+	// higher group winning
+	a, b := nextEpoch(9<<epochGroupBits|1, 1), nextEpoch(9<<epochGroupBits|1, 2)
+	if a == b || a > b {
+		t.Fatalf("Epochs of a concurrent takeover are 0x%x and 0x%x", a, b)
+	}
+}
+
+func TestActivate(t *testing.T) {
+	store := newTestStore(5<<epochGroupBits | 2)
+	f, err := New(store, 1, 2, false, time.Hour)
+	if err != nil {
+		t.Fatal("Fail to start failover: ", err)
+	}
+	defer f.Close()
+	checkStates(t, f, scsi.ALUA_STANDBY, scsi.ALUA_ACTIVE_OPTIMIZED)
+	if f.Epoch() != 0 {
+		t.Fatalf("Standby has epoch 0x%x", f.Epoch())
+	}
+
+	if err := f.Activate(); err != nil {
+		t.Fatal("Fail to activate: ", err)
+	}
+	expected := uint64(6<<epochGroupBits | 1)
+	checkStates(t, f, scsi.ALUA_ACTIVE_OPTIMIZED, scsi.ALUA_STANDBY)
+	if stored, epoch := store.get(); f.Epoch() != expected || stored != expected || epoch != int64(expected) {
+		t.Fatalf("Epoch 0x%x, stored 0x%x and of the requests 0x%x, expected 0x%x", f.Epoch(), stored, epoch, expected)
+	}
+
+	// activating again keeps the epoch
+	if err := f.Activate(); err != nil {
+		t.Fatal("Fail to activate again: ", err)
+	}
+	if stored, _ := store.get(); f.Epoch() != expected || stored != expected {
+		t.Fatalf("Epoch 0x%x and stored 0x%x once activated again, expected 0x%x", f.Epoch(), stored, expected)
+	}
+}
+
+func TestActivateFailure(t *testing.T) {
+	store := newTestStore(5<<epochGroupBits | 2)
+	f, err := New(store, 1, 2, true, time.Hour)
+	if err != nil {
+		t.Fatal("Fail to start failover: ", err)
+	}
+	defer f.Close()
+	previous := uint64(6<<epochGroupBits | 1)
+
+	// taken over by the peer, then activated again while the replicas fail
+	store.SetMetadata(epochMetadata, []byte(strconv.FormatUint(7<<epochGroupBits|2, 10)))
+	f.check()
+	checkStates(t, f, scsi.ALUA_STANDBY, scsi.ALUA_ACTIVE_OPTIMIZED)
+	store.mutex.Lock()
+	store.err = fmt.Errorf("replica failed")
+	store.mutex.Unlock()
+	if err := f.Activate(); err == nil {
+		t.Fatal("Activate succeeded while the replicas fail")
+	}
+	checkStates(t, f, scsi.ALUA_STANDBY, scsi.ALUA_ACTIVE_OPTIMIZED)
+	if _, epoch := store.get(); f.Epoch() != previous || epoch != int64(previous) {
+		t.Fatalf("Epoch 0x%x and of the requests 0x%x after a failed activation, expected 0x%x kept", f.Epoch(), epoch, previous)
+	}
+
+	// an epoch which can't be read fails the activation too
+	store.mutex.Lock()
+	store.err = nil
+	store.metadata[epochMetadata] = []byte("invalid")
+	store.mutex.Unlock()
+	if err := f.Activate(); err == nil {
+		t.Fatal("Activate succeeded with an invalid epoch")
+	}
+	checkStates(t, f, scsi.ALUA_STANDBY, scsi.ALUA_ACTIVE_OPTIMIZED)
+
+	store.SetMetadata(epochMetadata, []byte(strconv.FormatUint(7<<epochGroupBits|2, 10)))
+	if err := f.Activate(); err != nil {
+		t.Fatal("Fail to activate once the replicas are back: ", err)
+	}
+	expected := uint64(8<<epochGroupBits | 1)
+	if stored, epoch := store.get(); f.Epoch() != expected || stored != expected || epoch != int64(expected) {
+		t.Fatalf("Epoch 0x%x, stored 0x%x and of the requests 0x%x, expected 0x%x", f.Epoch(), stored, epoch, expected)
+	}
+}
+
+func TestActivateTransitioning(t *testing.T) {
+	store := newTestStore(0)
+	f, err := New(store, 1, 2, false, time.Hour)
+	if err != nil {
+		t.Fatal("Fail to start failover: ", err)
+	}
+	defer f.Close()
+
+	store.mutex.Lock()
+	store.blocked = make(chan struct{})
+	store.mutex.Unlock()
+	done := make(chan error)
+	go func() {
+		done <- f.Activate()
+	}()
+	for f.PortGroups()[0].State != scsi.ALUA_TRANSITIONING {
+		time.Sleep(time.Millisecond)
+	}
+	checkStates(t, f, scsi.ALUA_TRANSITIONING, scsi.ALUA_ACTIVE_OPTIMIZED)
+	if err := f.Activate(); err == nil {
+		t.Fatal("Activate succeeded while being activated")
+	}
+
+	close(store.blocked)
+	if err := <-done; err != nil {
+		t.Fatal("Fail to activate: ", err)
+	}
+	checkStates(t, f, scsi.ALUA_ACTIVE_OPTIMIZED, scsi.ALUA_STANDBY)
+}
+
+func TestCheck(t *testing.T) {
+	store := newTestStore(0)
+	f, err := New(store, 2, 1, true, time.Millisecond)
+	if err != nil {
+		t.Fatal("Fail to start failover: ", err)
+	}
+	defer f.Close()
+	expected := uint64(1<<epochGroupBits | 2)
+	if f.Epoch() != expected {
+		t.Fatalf("Epoch 0x%x, expected 0x%x", f.Epoch(), expected)
+	}
+
+	// an older epoch, e.g. written by the peer before it was fenced, doesn't
+	// take over
+	store.SetMetadata(epochMetadata, []byte(strconv.FormatUint(1<<epochGroupBits|1, 10)))
+	f.check()
+	checkStates(t, f, scsi.ALUA_ACTIVE_OPTIMIZED, scsi.ALUA_STANDBY)
+
+	// the watch steps down once the peer has taken over
+	store.SetMetadata(epochMetadata, []byte(strconv.FormatUint(nextEpoch(expected, 1), 10)))
+	for i := 0; f.PortGroups()[0].State != scsi.ALUA_STANDBY; i++ {
+		if i == 1000 {
+			t.Fatal("Active controller doesn't step down once taken over")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	checkStates(t, f, scsi.ALUA_STANDBY, scsi.ALUA_ACTIVE_OPTIMIZED)
+	if f.Epoch() != expected {
+		t.Fatalf("Epoch 0x%x once stepped down, expected 0x%x kept", f.Epoch(), expected)
+	}
+}
+
+func TestNewSameGroup(t *testing.T) {
+	if _, err := New(newTestStore(0), 1, 1, false, time.Hour); err == nil {
+		t.Fatal("Failover started with the peer in the same port group")
+	}
+}
@@ -0,0 +1,644 @@
+package iscsi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/types"
+)
+
+const (
+	// commands the initiator may have outstanding, see MaxCmdSN
+	queueDepth = 128
+	// write commands larger than this would be rejected
+	maxTransferLength = scsi.MAX_TRANSFER_LENGTH
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "iscsi"})
+
+	workers = 128
+)
+
+// Device executes the SCSI commands for LUN 0 of the target
+type Device interface {
+	// HandleCommand returns the SCSI status, the data for the initiator and
+	// the sense data for CHECK CONDITION. nexus identifies the initiator
+	// port the command comes from.
+	HandleCommand(nexus string, cdb []byte, dataOut []byte) (byte, []byte, []byte)
+}
+
+// Frontend serves one volume as LUN 0 of an iSCSI target. Only one connection
+// per session and error recovery level 0 are supported, there is no
+// authentication.
+type Frontend struct {
+	address    string
+	targetName string
+	device     Device
+	volume     types.Volume
+
+	listener   net.Listener
+	conns      map[*connection]struct{}
+	connsMutex *sync.Mutex
+	connsGroup *sync.WaitGroup
+	shutdown   bool
+	lastTSIH   uint32
+}
+
+type connection struct {
+	frontend *Frontend
+	conn     net.Conn
+	reader   *bufio.Reader
+	params   *sessionParams
+	// the iSCSI initiator port name, <initiator>,i,0x<ISID>
+	nexus string
+
+	// sequence numbers and writes to conn are protected by mutex
+	statSN   uint32
+	expCmdSN uint32
+	mutex    *sync.Mutex
+
+	tasks chan *task
+	// write commands waiting for Data-Out, keyed by target transfer tag.
+	// Only used by the goroutine reading the PDUs.
+	pending map[uint32]*task
+	lastTTT uint32
+	// commands being executed, keyed by initiator task tag
+	running      map[uint32]*task
+	runningMutex *sync.Mutex
+	runningGroup *sync.WaitGroup
+}
+
+type task struct {
+	itt      uint32
+	ttt      uint32
+	lun      [8]byte
+	cdb      []byte
+	read     bool
+	length   uint32 // expected data transfer length
+	data     []byte
+	received uint32
+	burstEnd uint32 // where the Data-Out for the current R2T ends
+	r2tSN    uint32
+	done     chan struct{}
+}
+
+// New creates the target named targetName, it would own the volume
+// afterwards. device executes the SCSI commands on top of the volume.
+func New(address, targetName string, device Device, volume types.Volume) *Frontend {
+	return &Frontend{
+		address:    address,
+		targetName: targetName,
+		device:     device,
+		volume:     volume,
+		conns:      make(map[*connection]struct{}),
+		connsMutex: &sync.Mutex{},
+		connsGroup: &sync.WaitGroup{},
+	}
+}
+
+func (f *Frontend) Startup() error {
+	l, err := net.Listen("tcp", f.address)
+	if err != nil {
+		return fmt.Errorf("Fail to listen on %v: %v", f.address, err)
+	}
+	f.listener = l
+	go f.accept()
+	log.Infof("Serving iSCSI target %v on %v", f.targetName, l.Addr())
+	return nil
+}
+
+// Addr is the address the target listens on
+func (f *Frontend) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *Frontend) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			f.connsMutex.Lock()
+			shutdown := f.shutdown
+			f.connsMutex.Unlock()
+			if shutdown {
+				break
+			}
+			log.Errorf("failed to accept connection %v", err)
+			continue
+		}
+
+		c := &connection{
+			frontend:     f,
+			conn:         conn,
+			reader:       bufio.NewReader(conn),
+			params:       newSessionParams(),
+			mutex:        &sync.Mutex{},
+			tasks:        make(chan *task, workers),
+			pending:      make(map[uint32]*task),
+			running:      make(map[uint32]*task),
+			runningMutex: &sync.Mutex{},
+			runningGroup: &sync.WaitGroup{},
+		}
+		f.connsMutex.Lock()
+		if f.shutdown {
+			f.connsMutex.Unlock()
+			conn.Close()
+			break
+		}
+		f.conns[c] = struct{}{}
+		f.connsGroup.Add(1)
+		f.connsMutex.Unlock()
+
+		go func() {
+			defer f.connsGroup.Done()
+			c.serve()
+
+			f.connsMutex.Lock()
+			delete(f.conns, c)
+			f.connsMutex.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops taking new connections and commands, and waits for the
+// in-flight commands up to timeout. The volume is flushed and closed at last,
+// outstanding commands would be aborted if timed out.
+func (f *Frontend) Shutdown(timeout time.Duration) error {
+	f.connsMutex.Lock()
+	f.shutdown = true
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	for c := range f.conns {
+		// stop reading new commands, responses can still be sent
+		c.conn.SetReadDeadline(time.Now())
+	}
+	f.connsMutex.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		f.connsGroup.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+		err = f.volume.Flush()
+		f.volume.Close()
+	case <-time.After(timeout):
+		log.Errorf("Timeout waiting for in-flight commands of target %v, abort them", f.targetName)
+		// closing the volume aborts the outstanding operations
+		f.volume.Close()
+		f.connsMutex.Lock()
+		for c := range f.conns {
+			c.conn.Close()
+		}
+		f.connsMutex.Unlock()
+		<-stopped
+		err = fmt.Errorf("Aborted in-flight commands of target %v", f.targetName)
+	}
+	return err
+}
+
+func (f *Frontend) newTSIH() uint16 {
+	for {
+		// TSIH 0 is reserved
+		if tsih := uint16(atomic.AddUint32(&f.lastTSIH, 1)); tsih != 0 {
+			return tsih
+		}
+	}
+}
+
+func (c *connection) serve() {
+	defer c.conn.Close()
+
+	if err := c.login(); err != nil {
+		if err != io.EOF {
+			log.Errorf("Login from %v failed: %v", c.conn.RemoteAddr(), err)
+		}
+		return
+	}
+	log.Debugf("Initiator %v logged in from %v", c.params.initiator, c.conn.RemoteAddr())
+
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range c.tasks {
+				c.execute(t)
+			}
+		}()
+	}
+
+	for {
+		p, err := c.readPDU()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Fail to read PDU from %v: %v", c.conn.RemoteAddr(), err)
+			}
+			break
+		}
+		logout, err := c.handlePDU(p)
+		if err != nil {
+			log.Errorf("Fail to handle PDU from %v: %v", c.conn.RemoteAddr(), err)
+			break
+		}
+		if logout {
+			break
+		}
+	}
+	close(c.tasks)
+	wg.Wait()
+
+	log.Debugf("Initiator %v disconnected", c.params.initiator)
+}
+
+func (c *connection) readPDU() (*PDU, error) {
+	p, err := ReadPDU(c.reader, maxRecvDataSegmentLength)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// shutting down
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// send fills in the sequence numbers and writes p. StatSN is advanced only
+// for the PDUs carrying status.
+func (c *connection) send(p *PDU, status bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if status {
+		p.SetUint32(24, c.statSN)
+		c.statSN++
+	} else if p.Opcode() != ISCSI_OP_SCSI_DATA_IN {
+		p.SetUint32(24, c.statSN)
+	}
+	p.SetUint32(28, c.expCmdSN)
+	p.SetUint32(32, c.expCmdSN+queueDepth-1)
+	return WritePDU(c.conn, p)
+}
+
+// updateCmdSN records the command numbered by the initiator
+func (c *connection) updateCmdSN(p *PDU) {
+	if p.Immediate() {
+		return
+	}
+	c.mutex.Lock()
+	if cmdSN := p.Uint32(24); cmdSN == c.expCmdSN {
+		c.expCmdSN++
+	}
+	c.mutex.Unlock()
+}
+
+// handlePDU returns true when the initiator has logged out
+func (c *connection) handlePDU(p *PDU) (bool, error) {
+	switch p.Opcode() {
+	case ISCSI_OP_NOP_OUT:
+		c.updateCmdSN(p)
+		if p.ITT() == ISCSI_RESERVED_TAG {
+			// answer to a NOP-In of ours, which we never send
+			return false, nil
+		}
+		resp := NewPDU(ISCSI_OP_NOP_IN)
+		resp.BHS[1] = ISCSI_FLAG_FINAL
+		copy(resp.LUN(), p.LUN())
+		resp.SetITT(p.ITT())
+		resp.SetUint32(20, ISCSI_RESERVED_TAG)
+		resp.Data = p.Data
+		return false, c.send(resp, true)
+	case ISCSI_OP_SCSI_CMD:
+		if c.params.discovery {
+			return false, c.reject(p, ISCSI_REJECT_PROTOCOL_ERROR)
+		}
+		c.updateCmdSN(p)
+		return false, c.handleCommand(p)
+	case ISCSI_OP_SCSI_DATA_OUT:
+		return false, c.handleDataOut(p)
+	case ISCSI_OP_TEXT_REQ:
+		c.updateCmdSN(p)
+		return false, c.handleText(p)
+	case ISCSI_OP_SCSI_TASK_REQ:
+		c.updateCmdSN(p)
+		return false, c.handleTaskManagement(p)
+	case ISCSI_OP_LOGOUT_REQ:
+		c.updateCmdSN(p)
+		// let the commands in-flight complete before the response
+		c.runningGroup.Wait()
+		resp := NewPDU(ISCSI_OP_LOGOUT_RESP)
+		resp.BHS[1] = ISCSI_FLAG_FINAL
+		resp.SetITT(p.ITT())
+		return true, c.send(resp, true)
+	default:
+		// SNACK is not supported at error recovery level 0
+		return false, c.reject(p, ISCSI_REJECT_CMD_NOT_SUPPORTED)
+	}
+}
+
+func (c *connection) reject(p *PDU, reason byte) error {
+	resp := NewPDU(ISCSI_OP_REJECT)
+	resp.BHS[1] = ISCSI_FLAG_FINAL
+	resp.BHS[2] = reason
+	resp.SetITT(ISCSI_RESERVED_TAG)
+	resp.Data = p.BHS[:]
+	return c.send(resp, true)
+}
+
+func (c *connection) handleCommand(p *PDU) error {
+	flags := p.Flags()
+	t := &task{
+		itt:    p.ITT(),
+		read:   flags&ISCSI_FLAG_CMD_READ != 0,
+		length: p.Uint32(20),
+		done:   make(chan struct{}),
+	}
+	copy(t.lun[:], p.LUN())
+	t.cdb = append([]byte{}, p.BHS[32:48]...)
+	t.cdb = append(t.cdb, p.ExtendedCDB()...)
+
+	if flags&ISCSI_FLAG_CMD_WRITE == 0 {
+		if len(p.Data) != 0 {
+			return c.reject(p, ISCSI_REJECT_PROTOCOL_ERROR)
+		}
+		c.dispatch(t)
+		return nil
+	}
+
+	if t.read {
+		// bidirectional commands are not supported
+		return c.sendStatus(t, scsi.SAM_STAT_CHECK_CONDITION, nil, scsi.BuildSense(scsi.ILLEGAL_REQUEST, scsi.ASC_INVALID_FIELD_IN_CDB))
+	}
+	if t.length > maxTransferLength {
+		log.Errorf("Write command of %v bytes is too large", t.length)
+		return c.sendStatus(t, scsi.SAM_STAT_CHECK_CONDITION, nil, scsi.BuildSense(scsi.ILLEGAL_REQUEST, scsi.ASC_INVALID_FIELD_IN_CDB))
+	}
+	if len(p.Data) != 0 && (!c.params.immediateData ||
+		uint32(len(p.Data)) > c.params.firstBurstLength || uint32(len(p.Data)) > t.length) {
+		return c.reject(p, ISCSI_REJECT_PROTOCOL_ERROR)
+	}
+	t.data = make([]byte, t.length)
+	t.received = uint32(copy(t.data, p.Data))
+	if t.received == t.length {
+		c.dispatch(t)
+		return nil
+	}
+
+	// InitialR2T is Yes, so there is no unsolicited Data-Out
+	c.lastTTT++
+	if c.lastTTT == ISCSI_RESERVED_TAG {
+		c.lastTTT = 0
+	}
+	t.ttt = c.lastTTT
+	c.pending[t.ttt] = t
+	return c.sendR2T(t)
+}
+
+func (c *connection) sendR2T(t *task) error {
+	length := t.length - t.received
+	if length > c.params.maxBurstLength {
+		length = c.params.maxBurstLength
+	}
+	t.burstEnd = t.received + length
+
+	r2t := NewPDU(ISCSI_OP_R2T)
+	r2t.BHS[1] = ISCSI_FLAG_FINAL
+	copy(r2t.LUN(), t.lun[:])
+	r2t.SetITT(t.itt)
+	r2t.SetUint32(20, t.ttt)
+	r2t.SetUint32(36, t.r2tSN)
+	r2t.SetUint32(40, t.received)
+	r2t.SetUint32(44, length)
+	t.r2tSN++
+	return c.send(r2t, false)
+}
+
+func (c *connection) handleDataOut(p *PDU) error {
+	t, ok := c.pending[p.Uint32(20)]
+	if !ok || t.itt != p.ITT() {
+		// the task may have been aborted
+		log.Debugf("Drop Data-Out for unknown task 0x%x", p.ITT())
+		return nil
+	}
+	// DataPDUInOrder is Yes
+	offset := p.Uint32(40)
+	if offset != t.received || offset+uint32(len(p.Data)) > t.burstEnd {
+		return fmt.Errorf("Unexpected Data-Out at offset %v for task 0x%x", offset, t.itt)
+	}
+	t.received += uint32(copy(t.data[offset:], p.Data))
+	if p.Flags()&ISCSI_FLAG_FINAL == 0 {
+		return nil
+	}
+	if t.received != t.burstEnd {
+		return fmt.Errorf("Data-Out sequence of task 0x%x ended early", t.itt)
+	}
+	if t.received < t.length {
+		return c.sendR2T(t)
+	}
+	delete(c.pending, t.ttt)
+	c.dispatch(t)
+	return nil
+}
+
+func (c *connection) dispatch(t *task) {
+	c.runningMutex.Lock()
+	c.running[t.itt] = t
+	c.runningMutex.Unlock()
+	c.runningGroup.Add(1)
+
+	c.tasks <- t
+}
+
+func (c *connection) execute(t *task) {
+	defer func() {
+		c.runningMutex.Lock()
+		delete(c.running, t.itt)
+		c.runningMutex.Unlock()
+		close(t.done)
+		c.runningGroup.Done()
+	}()
+
+	var (
+		status byte
+		data   []byte
+		sense  []byte
+	)
+	// REPORT LUNS can be sent to any LUN
+	if t.lun != [8]byte{} && t.cdb[0] != scsi.REPORT_LUNS {
+		status, data, sense = handleNoLun(t.cdb)
+	} else {
+		status, data, sense = c.frontend.device.HandleCommand(c.nexus, t.cdb, t.data)
+	}
+
+	if err := c.sendStatus(t, status, data, sense); err != nil {
+		log.Errorf("Fail to send status of task 0x%x to %v: %v", t.itt, c.conn.RemoteAddr(), err)
+	}
+}
+
+// sendStatus sends data in Data-In PDUs, and the status within the last of
+// them if possible, otherwise in a SCSI Response
+func (c *connection) sendStatus(t *task, status byte, data []byte, sense []byte) error {
+	var residualFlag byte
+	residual := uint32(0)
+	if t.read {
+		if uint32(len(data)) > t.length {
+			residualFlag = ISCSI_FLAG_CMD_OVERFLOW
+			residual = uint32(len(data)) - t.length
+			data = data[:t.length]
+		} else if uint32(len(data)) < t.length {
+			residualFlag = ISCSI_FLAG_CMD_UNDERFLOW
+			residual = t.length - uint32(len(data))
+		}
+	} else {
+		data = nil
+	}
+
+	segment := c.params.maxXmitDataSegmentLength
+	if segment > c.params.maxBurstLength {
+		segment = c.params.maxBurstLength
+	}
+	collapse := status == scsi.SAM_STAT_GOOD && len(data) != 0
+	dataSN := uint32(0)
+	for offset := uint32(0); offset < uint32(len(data)); {
+		length := uint32(len(data)) - offset
+		if length > segment {
+			length = segment
+		}
+		last := offset+length == uint32(len(data))
+
+		p := NewPDU(ISCSI_OP_SCSI_DATA_IN)
+		copy(p.LUN(), t.lun[:])
+		p.SetITT(t.itt)
+		p.SetUint32(20, ISCSI_RESERVED_TAG)
+		p.SetUint32(36, dataSN)
+		p.SetUint32(40, offset)
+		p.Data = data[offset : offset+length]
+		// a sequence ends at MaxBurstLength
+		if last || (offset+length)%c.params.maxBurstLength == 0 {
+			p.BHS[1] |= ISCSI_FLAG_FINAL
+		}
+		if last && collapse {
+			p.BHS[1] |= ISCSI_FLAG_DATA_STATUS | residualFlag
+			p.BHS[3] = status
+			p.SetUint32(44, residual)
+		}
+		if err := c.send(p, last && collapse); err != nil {
+			return err
+		}
+		offset += length
+		dataSN++
+	}
+	if collapse {
+		return nil
+	}
+
+	resp := NewPDU(ISCSI_OP_SCSI_RESP)
+	resp.BHS[1] = ISCSI_FLAG_FINAL | residualFlag
+	resp.BHS[3] = status
+	resp.SetITT(t.itt)
+	resp.SetUint32(36, dataSN)
+	resp.SetUint32(44, residual)
+	if len(sense) != 0 {
+		resp.Data = make([]byte, 2+len(sense))
+		binary.BigEndian.PutUint16(resp.Data, uint16(len(sense)))
+		copy(resp.Data[2:], sense)
+	}
+	return c.send(resp, true)
+}
+
+func (c *connection) handleText(p *PDU) error {
+	if p.Flags()&ISCSI_FLAG_LOGIN_CONTINUE != 0 {
+		// nobody sends that long text in full feature phase
+		return c.reject(p, ISCSI_REJECT_CMD_NOT_SUPPORTED)
+	}
+	kvs, err := parseText(p.Data)
+	if err != nil {
+		log.Errorf("Invalid text request from %v: %v", c.conn.RemoteAddr(), err)
+		return c.reject(p, ISCSI_REJECT_INVALID_PDU_FIELD)
+	}
+
+	reply := []keyValue{}
+	for _, kv := range kvs {
+		if kv.key != "SendTargets" {
+			reply = append(reply, keyValue{kv.key, "NotUnderstood"})
+			continue
+		}
+		if kv.value == "All" || kv.value == c.frontend.targetName || kv.value == "" {
+			reply = append(reply,
+				keyValue{"TargetName", c.frontend.targetName},
+				keyValue{"TargetAddress", c.conn.LocalAddr().String() + ",1"})
+		}
+	}
+
+	resp := NewPDU(ISCSI_OP_TEXT_RESP)
+	resp.BHS[1] = ISCSI_FLAG_FINAL
+	resp.SetITT(p.ITT())
+	resp.SetUint32(20, ISCSI_RESERVED_TAG)
+	resp.Data = formatText(reply)
+	return c.send(resp, true)
+}
+
+// handleTaskManagement waits for the tasks to complete instead of aborting
+// them, since the volume operations cannot be cancelled. The tasks still
+// waiting for Data-Out are dropped.
+func (c *connection) handleTaskManagement(p *PDU) error {
+	response := byte(ISCSI_TMF_RSP_COMPLETE)
+	switch p.Flags() & 0x7f {
+	case ISCSI_TM_FUNC_ABORT_TASK:
+		itt := p.Uint32(20)
+		for ttt, t := range c.pending {
+			if t.itt == itt {
+				delete(c.pending, ttt)
+			}
+		}
+		c.runningMutex.Lock()
+		t := c.running[itt]
+		c.runningMutex.Unlock()
+		if t != nil {
+			<-t.done
+		}
+	case ISCSI_TM_FUNC_ABORT_TASK_SET, ISCSI_TM_FUNC_CLEAR_TASK_SET,
+		ISCSI_TM_FUNC_LOGICAL_UNIT_RESET, ISCSI_TM_FUNC_TARGET_WARM_RESET,
+		ISCSI_TM_FUNC_TARGET_COLD_RESET:
+		c.pending = make(map[uint32]*task)
+		c.runningGroup.Wait()
+	default:
+		response = ISCSI_TMF_RSP_NOT_SUPPORTED
+	}
+
+	resp := NewPDU(ISCSI_OP_SCSI_TASK_RESP)
+	resp.BHS[1] = ISCSI_FLAG_FINAL
+	resp.BHS[2] = response
+	resp.SetITT(p.ITT())
+	return c.send(resp, true)
+}
+
+// handleNoLun answers the commands to the LUNs which don't exist
+func handleNoLun(cdb []byte) (byte, []byte, []byte) {
+	switch cdb[0] {
+	case scsi.INQUIRY:
+		// peripheral qualifier 3: not capable of supporting a device
+		data := make([]byte, 36)
+		data[0] = 0x7f
+		data[2] = 0x05 // SPC-3
+		data[3] = 0x02
+		data[4] = 36 - 5
+		return scsi.SAM_STAT_GOOD, data, nil
+	case scsi.REQUEST_SENSE:
+		return scsi.SAM_STAT_GOOD, scsi.BuildSense(scsi.ILLEGAL_REQUEST, scsi.ASC_LUN_NOT_SUPPORTED), nil
+	}
+	return scsi.CheckCondition(scsi.ILLEGAL_REQUEST, scsi.ASC_LUN_NOT_SUPPORTED)
+}
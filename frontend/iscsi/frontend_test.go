@@ -0,0 +1,353 @@
+package iscsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/test/testvolume"
+)
+
+const (
+	testTarget    = "iqn.2016-04.com.rancher:test"
+	testInitiator = "iqn.2016-04.com.rancher:initiator"
+	testSize      = int64(16 * 1024 * 1024)
+	testBlockSize = 512
+
+	// offered by the initiator, small enough for a write to take several
+	// R2Ts and a read several Data-Ins
+	testMaxRecvDataSegmentLength = 8192
+	testMaxBurstLength           = 16384
+)
+
+// initiator logs in and sends the commands one at a time, checking the
+// sequence numbers of every PDU from the target
+type initiator struct {
+	t       *testing.T
+	conn    net.Conn
+	itt     uint32
+	cmdSN   uint32
+	expStat uint32
+}
+
+func startTarget(t *testing.T) *Frontend {
+	volume := testvolume.New(testSize)
+	device, err := scsi.NewDevice("test", volume, testBlockSize)
+	if err != nil {
+		t.Fatal("Fail to create device: ", err)
+	}
+	f := New("127.0.0.1:0", testTarget, device, volume)
+	if err := f.Startup(); err != nil {
+		t.Fatal("Fail to start target: ", err)
+	}
+	return f
+}
+
+func dial(t *testing.T, f *Frontend) *initiator {
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal("Fail to connect: ", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &initiator{t: t, conn: conn, cmdSN: 1, expStat: 100}
+}
+
+func (i *initiator) send(p *PDU) {
+	if err := WritePDU(i.conn, p); err != nil {
+		i.t.Fatal("Fail to send PDU: ", err)
+	}
+}
+
+// receive reads the next PDU, which should have opcode, and checks its
+// sequence numbers
+func (i *initiator) receive(opcode byte) *PDU {
+	p, err := ReadPDU(i.conn, 1<<24)
+	if err != nil {
+		i.t.Fatal("Fail to receive PDU: ", err)
+	}
+	if p.Opcode() != opcode {
+		i.t.Fatalf("Received opcode 0x%x, expected 0x%x", p.Opcode(), opcode)
+	}
+
+	status := true
+	switch opcode {
+	case ISCSI_OP_R2T:
+		status = false
+	case ISCSI_OP_SCSI_DATA_IN:
+		status = p.Flags()&ISCSI_FLAG_DATA_STATUS != 0
+	}
+	if status {
+		if statSN := p.Uint32(24); statSN != i.expStat {
+			i.t.Fatalf("StatSN is %v, expected %v", statSN, i.expStat)
+		}
+		i.expStat++
+	} else if opcode == ISCSI_OP_R2T && p.Uint32(24) != i.expStat {
+		// R2T carries the next StatSN without advancing it
+		i.t.Fatalf("StatSN of R2T is %v, expected %v", p.Uint32(24), i.expStat)
+	}
+	if expCmdSN := p.Uint32(28); expCmdSN != i.cmdSN {
+		i.t.Fatalf("ExpCmdSN is %v, expected %v", expCmdSN, i.cmdSN)
+	}
+	if maxCmdSN := p.Uint32(32); maxCmdSN != i.cmdSN+queueDepth-1 {
+		i.t.Fatalf("MaxCmdSN is %v, expected %v", maxCmdSN, i.cmdSN+queueDepth-1)
+	}
+	return p
+}
+
+// request numbers a non-immediate request
+func (i *initiator) request(opcode byte) *PDU {
+	p := NewPDU(opcode)
+	i.itt++
+	p.SetITT(i.itt)
+	p.SetUint32(24, i.cmdSN)
+	p.SetUint32(28, i.expStat)
+	i.cmdSN++
+	return p
+}
+
+func (i *initiator) loginStage(csg, nsg byte, kvs []keyValue) []keyValue {
+	p := NewPDU(ISCSI_OP_LOGIN_REQ | ISCSI_OP_IMMEDIATE)
+	p.BHS[1] = ISCSI_FLAG_LOGIN_TRANSIT | csg<<2 | nsg
+	copy(p.BHS[8:14], []byte{0x80, 0, 0, 0, 0, 1}) // ISID
+	p.SetITT(i.itt)
+	p.SetUint32(24, i.cmdSN)
+	p.SetUint32(28, i.expStat)
+	p.Data = formatText(kvs)
+	i.send(p)
+
+	resp := i.receive(ISCSI_OP_LOGIN_RESP)
+	if status := resp.Uint16(36); status != ISCSI_LOGIN_STATUS_SUCCESS {
+		i.t.Fatalf("Login failed with status 0x%x", status)
+	}
+	if resp.Flags() != ISCSI_FLAG_LOGIN_TRANSIT|csg<<2|nsg {
+		i.t.Fatalf("Login response flags 0x%x, expected transit to stage %v", resp.Flags(), nsg)
+	}
+	reply, err := parseText(resp.Data)
+	if err != nil {
+		i.t.Fatal("Invalid login response text: ", err)
+	}
+	return reply
+}
+
+func lookup(kvs []keyValue, key string) string {
+	for _, kv := range kvs {
+		if kv.key == key {
+			return kv.value
+		}
+	}
+	return ""
+}
+
+// login goes through the security and the operational negotiation to the
+// full feature phase
+func (i *initiator) login() {
+	reply := i.loginStage(ISCSI_SECURITY_NEGOTIATION_STAGE, ISCSI_OP_PARMS_NEGOTIATION_STAGE, []keyValue{
+		{"InitiatorName", testInitiator},
+		{"TargetName", testTarget},
+		{"SessionType", "Normal"},
+		{"AuthMethod", "CHAP,None"},
+	})
+	if lookup(reply, "AuthMethod") != "None" || lookup(reply, "TargetPortalGroupTag") != "1" {
+		i.t.Fatalf("Invalid security negotiation %v", reply)
+	}
+
+	reply = i.loginStage(ISCSI_OP_PARMS_NEGOTIATION_STAGE, ISCSI_FULL_FEATURE_PHASE, []keyValue{
+		{"HeaderDigest", "None"},
+		{"DataDigest", "None"},
+		{"MaxRecvDataSegmentLength", "8192"},
+		{"MaxBurstLength", "16384"},
+		{"FirstBurstLength", "8192"},
+		{"ImmediateData", "No"},
+		{"InitialR2T", "Yes"},
+		{"MaxOutstandingR2T", "1"},
+		{"X-Unknown", "1"},
+	})
+	expected := map[string]string{
+		"HeaderDigest":             "None",
+		"DataDigest":               "None",
+		"MaxBurstLength":           "16384",
+		"FirstBurstLength":         "8192",
+		"ImmediateData":            "No",
+		"InitialR2T":               "Yes",
+		"MaxOutstandingR2T":        "1",
+		"X-Unknown":                "NotUnderstood",
+		"MaxRecvDataSegmentLength": "262144",
+	}
+	for key, value := range expected {
+		if lookup(reply, key) != value {
+			i.t.Fatalf("Negotiated %v=%q, expected %q", key, lookup(reply, key), value)
+		}
+	}
+}
+
+func (i *initiator) command(cdb []byte, flags byte, length uint32) *PDU {
+	p := i.request(ISCSI_OP_SCSI_CMD)
+	p.BHS[1] = ISCSI_FLAG_FINAL | flags | 1 // simple task attribute
+	p.SetUint32(20, length)
+	copy(p.BHS[32:48], cdb)
+	i.send(p)
+	return p
+}
+
+func (i *initiator) checkResponse(cmd *PDU) {
+	resp := i.receive(ISCSI_OP_SCSI_RESP)
+	if resp.ITT() != cmd.ITT() || resp.BHS[3] != scsi.SAM_STAT_GOOD {
+		i.t.Fatalf("Command 0x%x failed with status 0x%x", cmd.BHS[32], resp.BHS[3])
+	}
+}
+
+func (i *initiator) write(lba uint32, data []byte) {
+	cdb := make([]byte, 10)
+	cdb[0] = scsi.WRITE_10
+	binary.BigEndian.PutUint32(cdb[2:], lba)
+	binary.BigEndian.PutUint16(cdb[7:], uint16(len(data)/testBlockSize))
+	cmd := i.command(cdb, ISCSI_FLAG_CMD_WRITE, uint32(len(data)))
+
+	// ImmediateData is No, every byte is solicited by an R2T of at most
+	// MaxBurstLength
+	r2tSN := uint32(0)
+	for offset := uint32(0); offset < uint32(len(data)); {
+		r2t := i.receive(ISCSI_OP_R2T)
+		if r2t.ITT() != cmd.ITT() || r2t.Uint32(36) != r2tSN || r2t.Uint32(40) != offset {
+			i.t.Fatalf("Unexpected R2T %v for offset %v", r2t.BHS, offset)
+		}
+		length := r2t.Uint32(44)
+		if length > testMaxBurstLength || offset+length > uint32(len(data)) {
+			i.t.Fatalf("R2T of %v bytes at %v", length, offset)
+		}
+		r2tSN++
+
+		dataSN := uint32(0)
+		for end := offset + length; offset < end; {
+			n := end - offset
+			if n > testMaxRecvDataSegmentLength {
+				n = testMaxRecvDataSegmentLength
+			}
+			p := NewPDU(ISCSI_OP_SCSI_DATA_OUT)
+			if offset+n == end {
+				p.BHS[1] = ISCSI_FLAG_FINAL
+			}
+			p.SetITT(cmd.ITT())
+			p.SetUint32(20, r2t.Uint32(20))
+			p.SetUint32(28, i.expStat)
+			p.SetUint32(36, dataSN)
+			p.SetUint32(40, offset)
+			p.Data = data[offset : offset+n]
+			i.send(p)
+			offset += n
+			dataSN++
+		}
+	}
+	i.checkResponse(cmd)
+}
+
+func (i *initiator) read(lba uint32, length int) []byte {
+	cdb := make([]byte, 10)
+	cdb[0] = scsi.READ_10
+	binary.BigEndian.PutUint32(cdb[2:], lba)
+	binary.BigEndian.PutUint16(cdb[7:], uint16(length/testBlockSize))
+	cmd := i.command(cdb, ISCSI_FLAG_CMD_READ, uint32(length))
+
+	data := []byte{}
+	for dataSN := uint32(0); ; dataSN++ {
+		p := i.receive(ISCSI_OP_SCSI_DATA_IN)
+		if p.ITT() != cmd.ITT() || p.Uint32(36) != dataSN || p.Uint32(40) != uint32(len(data)) {
+			i.t.Fatalf("Unexpected Data-In %v at %v", p.BHS, len(data))
+		}
+		if len(p.Data) > testMaxRecvDataSegmentLength {
+			i.t.Fatalf("Data-In of %v bytes exceeds MaxRecvDataSegmentLength", len(p.Data))
+		}
+		data = append(data, p.Data...)
+		if p.Flags()&ISCSI_FLAG_DATA_STATUS != 0 {
+			if p.Flags()&ISCSI_FLAG_FINAL == 0 || p.BHS[3] != scsi.SAM_STAT_GOOD {
+				i.t.Fatalf("Read failed with flags 0x%x, status 0x%x", p.Flags(), p.BHS[3])
+			}
+			break
+		}
+	}
+	if len(data) != length {
+		i.t.Fatalf("Read %v bytes, expected %v", len(data), length)
+	}
+	return data
+}
+
+func (i *initiator) logout() {
+	p := i.request(ISCSI_OP_LOGOUT_REQ)
+	p.BHS[1] = ISCSI_FLAG_FINAL
+	i.send(p)
+	if resp := i.receive(ISCSI_OP_LOGOUT_RESP); resp.ITT() != p.ITT() || resp.BHS[2] != 0 {
+		i.t.Fatalf("Logout failed with response %v", resp.BHS[2])
+	}
+}
+
+func TestSession(t *testing.T) {
+	f := startTarget(t)
+	i := dial(t, f)
+	defer i.conn.Close()
+	i.login()
+
+	text := i.request(ISCSI_OP_TEXT_REQ)
+	text.BHS[1] = ISCSI_FLAG_FINAL
+	text.SetUint32(20, ISCSI_RESERVED_TAG)
+	text.Data = formatText([]keyValue{{"SendTargets", "All"}})
+	i.send(text)
+	resp := i.receive(ISCSI_OP_TEXT_RESP)
+	reply, err := parseText(resp.Data)
+	if err != nil || lookup(reply, "TargetName") != testTarget ||
+		lookup(reply, "TargetAddress") != i.conn.RemoteAddr().String()+",1" {
+		t.Fatalf("Invalid SendTargets response %v: %v", reply, err)
+	}
+
+	data := make([]byte, 64*1024)
+	for j := range data {
+		data[j] = byte(j % 251)
+	}
+	i.write(8, data)
+	if read := i.read(8, len(data)); !bytes.Equal(read, data) {
+		t.Fatal("Read returned different data from what was written")
+	}
+	if read := i.read(0, 4096); !bytes.Equal(read, append(make([]byte, 8*testBlockSize), data[:4096-8*testBlockSize]...)) {
+		t.Fatal("Read across the written range returned wrong data")
+	}
+
+	i.logout()
+	if err := f.Shutdown(10 * time.Second); err != nil {
+		t.Fatal("Fail to shutdown target: ", err)
+	}
+}
+
+func TestLoginUnknownTarget(t *testing.T) {
+	f := startTarget(t)
+	defer f.Shutdown(10 * time.Second)
+	i := dial(t, f)
+	defer i.conn.Close()
+
+	p := NewPDU(ISCSI_OP_LOGIN_REQ | ISCSI_OP_IMMEDIATE)
+	p.BHS[1] = ISCSI_FLAG_LOGIN_TRANSIT | ISCSI_OP_PARMS_NEGOTIATION_STAGE
+	p.SetUint32(24, i.cmdSN)
+	p.SetUint32(28, i.expStat)
+	p.Data = formatText([]keyValue{
+		{"InitiatorName", testInitiator},
+		{"TargetName", "iqn.2016-04.com.rancher:unknown"},
+	})
+	i.send(p)
+	resp := i.receive(ISCSI_OP_LOGIN_RESP)
+	if status := resp.Uint16(36); status != ISCSI_LOGIN_STATUS_TGT_NOT_FOUND {
+		t.Fatalf("Login to unknown target returned status 0x%x", status)
+	}
+}
+
+func TestShutdownNotStarted(t *testing.T) {
+	volume := testvolume.New(testSize)
+	device, err := scsi.NewDevice("test", volume, testBlockSize)
+	if err != nil {
+		t.Fatal("Fail to create device: ", err)
+	}
+	f := New("127.0.0.1:0", testTarget, device, volume)
+	if err := f.Shutdown(10 * time.Second); err != nil {
+		t.Fatal("Fail to shutdown target never started: ", err)
+	}
+}
@@ -0,0 +1,298 @@
+package iscsi
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// what we accept in one data segment, and for a burst of Data-Out
+	maxRecvDataSegmentLength = 262144
+	maxBurstLength           = 262144
+	firstBurstLength         = 65536
+)
+
+// key=value pair in text of Login and Text PDUs, the order matters
+type keyValue struct {
+	key   string
+	value string
+}
+
+// sessionParams are the negotiated operational parameters we care about
+type sessionParams struct {
+	discovery bool
+	initiator string
+
+	// initiator's, it limits the data segment of the PDUs we send
+	maxXmitDataSegmentLength uint32
+	maxBurstLength           uint32
+	firstBurstLength         uint32
+	immediateData            bool
+
+	// MaxRecvDataSegmentLength of ours has been sent
+	declared bool
+}
+
+func newSessionParams() *sessionParams {
+	// defaults from RFC 7143
+	return &sessionParams{
+		maxXmitDataSegmentLength: ISCSI_MAX_RECV_DATA_SEGMENT_DEFAULT,
+		maxBurstLength:           262144,
+		firstBurstLength:         65536,
+		immediateData:            true,
+	}
+}
+
+func parseText(data []byte) ([]keyValue, error) {
+	kvs := []keyValue{}
+	for _, pair := range bytes.Split(data, []byte{0}) {
+		if len(pair) == 0 {
+			continue
+		}
+		i := bytes.IndexByte(pair, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("Invalid key value pair %q", pair)
+		}
+		kvs = append(kvs, keyValue{
+			key:   string(pair[:i]),
+			value: string(pair[i+1:]),
+		})
+	}
+	return kvs, nil
+}
+
+func formatText(kvs []keyValue) []byte {
+	buf := &bytes.Buffer{}
+	for _, kv := range kvs {
+		buf.WriteString(kv.key)
+		buf.WriteByte('=')
+		buf.WriteString(kv.value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func parseNumber(key, value string) (uint32, error) {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value %v for %v", value, key)
+	}
+	return uint32(n), nil
+}
+
+func minNumber(value uint32, ours uint32) uint32 {
+	if value < ours {
+		return value
+	}
+	return ours
+}
+
+func hasValue(values string, value string) bool {
+	for _, v := range strings.Split(values, ",") {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate handles the keys offered by the initiator, and returns the keys
+// we reply with. Returns the login status on failure.
+func (f *Frontend) negotiate(params *sessionParams, kvs []keyValue, stage byte) ([]keyValue, uint16, error) {
+	reply := []keyValue{}
+	for _, kv := range kvs {
+		var value string
+		switch kv.key {
+		case "InitiatorName":
+			params.initiator = kv.value
+			continue
+		case "InitiatorAlias":
+			continue
+		case "SessionType":
+			switch kv.value {
+			case "Normal":
+				params.discovery = false
+			case "Discovery":
+				params.discovery = true
+			default:
+				return nil, ISCSI_LOGIN_STATUS_INIT_ERR, fmt.Errorf("Invalid session type %v", kv.value)
+			}
+			continue
+		case "TargetName":
+			if kv.value != f.targetName {
+				return nil, ISCSI_LOGIN_STATUS_TGT_NOT_FOUND, fmt.Errorf("Unknown target %v", kv.value)
+			}
+			continue
+		case "AuthMethod":
+			if !hasValue(kv.value, "None") {
+				return nil, ISCSI_LOGIN_STATUS_AUTH_FAILED, fmt.Errorf("Authentication %v is not supported", kv.value)
+			}
+			value = "None"
+		case "HeaderDigest", "DataDigest":
+			if !hasValue(kv.value, "None") {
+				return nil, ISCSI_LOGIN_STATUS_INIT_ERR, fmt.Errorf("%v %v is not supported", kv.key, kv.value)
+			}
+			value = "None"
+		case "MaxRecvDataSegmentLength":
+			// declarative, it's the initiator's
+			n, err := parseNumber(kv.key, kv.value)
+			if err != nil || n < 512 {
+				return nil, ISCSI_LOGIN_STATUS_INIT_ERR, fmt.Errorf("Invalid %v %v", kv.key, kv.value)
+			}
+			params.maxXmitDataSegmentLength = n
+			continue
+		case "MaxBurstLength", "FirstBurstLength":
+			n, err := parseNumber(kv.key, kv.value)
+			if err != nil || n < 512 {
+				return nil, ISCSI_LOGIN_STATUS_INIT_ERR, fmt.Errorf("Invalid %v %v", kv.key, kv.value)
+			}
+			if kv.key == "MaxBurstLength" {
+				params.maxBurstLength = minNumber(n, maxBurstLength)
+				value = strconv.Itoa(int(params.maxBurstLength))
+			} else {
+				params.firstBurstLength = minNumber(n, firstBurstLength)
+				value = strconv.Itoa(int(params.firstBurstLength))
+			}
+		case "ImmediateData":
+			params.immediateData = kv.value == "Yes"
+			value = kv.value
+		case "InitialR2T", "DataPDUInOrder", "DataSequenceInOrder":
+			value = "Yes"
+		case "MaxConnections", "MaxOutstandingR2T":
+			value = "1"
+		case "ErrorRecoveryLevel", "DefaultTime2Retain":
+			value = "0"
+		case "DefaultTime2Wait":
+			value = "2"
+		case "IFMarker", "OFMarker":
+			value = "No"
+		default:
+			value = "NotUnderstood"
+		}
+		reply = append(reply, keyValue{kv.key, value})
+	}
+
+	if stage == ISCSI_OP_PARMS_NEGOTIATION_STAGE && !params.declared {
+		params.declared = true
+		reply = append(reply, keyValue{"MaxRecvDataSegmentLength", strconv.Itoa(maxRecvDataSegmentLength)})
+	}
+	return reply, ISCSI_LOGIN_STATUS_SUCCESS, nil
+}
+
+// login negotiates until the initiator enters the full feature phase.
+func (c *connection) login() error {
+	var (
+		text        []byte
+		targetGiven bool
+		stage       byte = ISCSI_SECURITY_NEGOTIATION_STAGE
+		first            = true
+	)
+
+	for {
+		req, err := ReadPDU(c.reader, maxRecvDataSegmentLength)
+		if err != nil {
+			return err
+		}
+		if req.Opcode() != ISCSI_OP_LOGIN_REQ {
+			return fmt.Errorf("Expect login request, got opcode 0x%x", req.Opcode())
+		}
+		flags := req.Flags()
+		csg := (flags >> 2) & 0x3
+		nsg := flags & 0x3
+		transit := flags&ISCSI_FLAG_LOGIN_TRANSIT != 0
+
+		resp := NewPDU(ISCSI_OP_LOGIN_RESP)
+		copy(resp.BHS[8:16], req.BHS[8:16]) // ISID and TSIH
+		resp.SetITT(req.ITT())
+		if first {
+			c.statSN = req.Uint32(28)
+			c.expCmdSN = req.Uint32(24)
+			// versions offered are in byte 2 and 3
+			if req.BHS[3] != 0 {
+				return c.loginReject(resp, ISCSI_LOGIN_STATUS_NO_VERSION, "unsupported version")
+			}
+			if req.Uint16(14) != 0 {
+				return c.loginReject(resp, ISCSI_LOGIN_STATUS_NO_SESSION, "session reinstatement is not supported")
+			}
+			first = false
+		}
+		if csg != stage && !(stage == ISCSI_SECURITY_NEGOTIATION_STAGE && csg == ISCSI_OP_PARMS_NEGOTIATION_STAGE) {
+			return c.loginReject(resp, ISCSI_LOGIN_STATUS_INVALID_REQUEST, "invalid stage")
+		}
+		stage = csg
+
+		text = append(text, req.Data...)
+		if flags&ISCSI_FLAG_LOGIN_CONTINUE != 0 {
+			// wait for the rest of the text
+			resp.BHS[1] = csg << 2
+			if err := c.sendLoginResponse(resp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		kvs, err := parseText(text)
+		text = nil
+		if err != nil {
+			return c.loginReject(resp, ISCSI_LOGIN_STATUS_INIT_ERR, err.Error())
+		}
+		for _, kv := range kvs {
+			if kv.key == "TargetName" {
+				targetGiven = true
+			}
+		}
+		reply, status, err := c.frontend.negotiate(c.params, kvs, stage)
+		if err != nil {
+			return c.loginReject(resp, status, err.Error())
+		}
+		if c.params.initiator == "" {
+			return c.loginReject(resp, ISCSI_LOGIN_STATUS_INIT_ERR, "missing InitiatorName")
+		}
+		if !c.params.discovery && !targetGiven {
+			return c.loginReject(resp, ISCSI_LOGIN_STATUS_INIT_ERR, "missing TargetName")
+		}
+		if stage == ISCSI_SECURITY_NEGOTIATION_STAGE && !c.params.discovery {
+			reply = append(reply, keyValue{"TargetPortalGroupTag", "1"})
+		}
+		resp.Data = formatText(reply)
+
+		resp.BHS[1] = csg << 2
+		if transit {
+			if nsg <= csg || nsg == 2 {
+				return c.loginReject(resp, ISCSI_LOGIN_STATUS_INVALID_REQUEST, "invalid next stage")
+			}
+			resp.BHS[1] |= ISCSI_FLAG_LOGIN_TRANSIT | nsg
+			stage = nsg
+			if nsg == ISCSI_FULL_FEATURE_PHASE {
+				resp.SetUint16(14, c.frontend.newTSIH())
+			}
+		}
+		if err := c.sendLoginResponse(resp); err != nil {
+			return err
+		}
+		if stage == ISCSI_FULL_FEATURE_PHASE {
+			c.nexus = fmt.Sprintf("%v,i,0x%x", c.params.initiator, req.BHS[8:14])
+			return nil
+		}
+	}
+}
+
+func (c *connection) sendLoginResponse(resp *PDU) error {
+	resp.SetUint32(24, c.statSN)
+	resp.SetUint32(28, c.expCmdSN)
+	resp.SetUint32(32, c.expCmdSN+queueDepth-1)
+	c.statSN++
+	return WritePDU(c.conn, resp)
+}
+
+func (c *connection) loginReject(resp *PDU, status uint16, reason string) error {
+	resp.BHS[1] = 0
+	resp.Data = nil
+	resp.SetUint16(36, status)
+	if err := c.sendLoginResponse(resp); err != nil {
+		return err
+	}
+	return fmt.Errorf("Login rejected: %v", reason)
+}
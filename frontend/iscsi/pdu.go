@@ -0,0 +1,198 @@
+package iscsi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// See RFC 7143. Header and data digests are not supported.
+const (
+	BHS_LENGTH = 48
+
+	ISCSI_OP_NOP_OUT       = 0x00
+	ISCSI_OP_SCSI_CMD      = 0x01
+	ISCSI_OP_SCSI_TASK_REQ = 0x02
+	ISCSI_OP_LOGIN_REQ     = 0x03
+	ISCSI_OP_TEXT_REQ      = 0x04
+	ISCSI_OP_SCSI_DATA_OUT = 0x05
+	ISCSI_OP_LOGOUT_REQ    = 0x06
+	ISCSI_OP_SNACK_REQ     = 0x10
+
+	ISCSI_OP_NOP_IN         = 0x20
+	ISCSI_OP_SCSI_RESP      = 0x21
+	ISCSI_OP_SCSI_TASK_RESP = 0x22
+	ISCSI_OP_LOGIN_RESP     = 0x23
+	ISCSI_OP_TEXT_RESP      = 0x24
+	ISCSI_OP_SCSI_DATA_IN   = 0x25
+	ISCSI_OP_LOGOUT_RESP    = 0x26
+	ISCSI_OP_R2T            = 0x31
+	ISCSI_OP_REJECT         = 0x3f
+
+	ISCSI_OP_IMMEDIATE = 0x40
+
+	ISCSI_FLAG_FINAL = 0x80
+
+	// SCSI Command
+	ISCSI_FLAG_CMD_READ  = 0x40
+	ISCSI_FLAG_CMD_WRITE = 0x20
+
+	// Data-In and SCSI Response
+	ISCSI_FLAG_DATA_STATUS    = 0x01
+	ISCSI_FLAG_CMD_UNDERFLOW  = 0x02
+	ISCSI_FLAG_CMD_OVERFLOW   = 0x04
+	ISCSI_FLAG_DATA_UNDERFLOW = ISCSI_FLAG_CMD_UNDERFLOW
+	ISCSI_FLAG_DATA_OVERFLOW  = ISCSI_FLAG_CMD_OVERFLOW
+
+	// Login
+	ISCSI_FLAG_LOGIN_TRANSIT  = 0x80
+	ISCSI_FLAG_LOGIN_CONTINUE = 0x40
+
+	ISCSI_SECURITY_NEGOTIATION_STAGE    = 0
+	ISCSI_OP_PARMS_NEGOTIATION_STAGE    = 1
+	ISCSI_FULL_FEATURE_PHASE            = 3
+	ISCSI_LOGIN_STATUS_SUCCESS          = 0x0000
+	ISCSI_LOGIN_STATUS_INIT_ERR         = 0x0200
+	ISCSI_LOGIN_STATUS_AUTH_FAILED      = 0x0201
+	ISCSI_LOGIN_STATUS_TGT_NOT_FOUND    = 0x0203
+	ISCSI_LOGIN_STATUS_NO_VERSION       = 0x0205
+	ISCSI_LOGIN_STATUS_NO_SESSION       = 0x020a
+	ISCSI_LOGIN_STATUS_INVALID_REQUEST  = 0x020b
+	ISCSI_LOGIN_STATUS_TARGET_ERROR     = 0x0300
+	ISCSI_AHS_TYPE_EXTENDED_CDB         = 1
+	ISCSI_RESERVED_TAG                  = 0xffffffff
+	ISCSI_REJECT_CMD_NOT_SUPPORTED      = 0x05
+	ISCSI_REJECT_PROTOCOL_ERROR         = 0x04
+	ISCSI_REJECT_INVALID_PDU_FIELD      = 0x09
+	ISCSI_TMF_RSP_COMPLETE              = 0
+	ISCSI_TMF_RSP_NO_TASK               = 1
+	ISCSI_TMF_RSP_NOT_SUPPORTED         = 5
+	ISCSI_TM_FUNC_ABORT_TASK            = 1
+	ISCSI_TM_FUNC_ABORT_TASK_SET        = 2
+	ISCSI_TM_FUNC_CLEAR_ACA             = 3
+	ISCSI_TM_FUNC_CLEAR_TASK_SET        = 4
+	ISCSI_TM_FUNC_LOGICAL_UNIT_RESET    = 5
+	ISCSI_TM_FUNC_TARGET_WARM_RESET     = 6
+	ISCSI_TM_FUNC_TARGET_COLD_RESET     = 7
+	ISCSI_TM_FUNC_TASK_REASSIGN         = 8
+	ISCSI_MAX_RECV_DATA_SEGMENT_DEFAULT = 8192
+)
+
+// PDU is an iSCSI protocol data unit. Fields in BHS are accessed by offset,
+// their layout depends on the opcode.
+type PDU struct {
+	BHS  [BHS_LENGTH]byte
+	AHS  []byte
+	Data []byte
+}
+
+func NewPDU(opcode byte) *PDU {
+	p := &PDU{}
+	p.BHS[0] = opcode
+	return p
+}
+
+func (p *PDU) Opcode() byte {
+	return p.BHS[0] & 0x3f
+}
+
+func (p *PDU) Immediate() bool {
+	return p.BHS[0]&ISCSI_OP_IMMEDIATE != 0
+}
+
+func (p *PDU) Flags() byte {
+	return p.BHS[1]
+}
+
+func (p *PDU) Uint16(offset int) uint16 {
+	return binary.BigEndian.Uint16(p.BHS[offset:])
+}
+
+func (p *PDU) SetUint16(offset int, value uint16) {
+	binary.BigEndian.PutUint16(p.BHS[offset:], value)
+}
+
+func (p *PDU) Uint32(offset int) uint32 {
+	return binary.BigEndian.Uint32(p.BHS[offset:])
+}
+
+func (p *PDU) SetUint32(offset int, value uint32) {
+	binary.BigEndian.PutUint32(p.BHS[offset:], value)
+}
+
+// LUN field is at the same place for all the PDUs which have it
+func (p *PDU) LUN() []byte {
+	return p.BHS[8:16]
+}
+
+func (p *PDU) ITT() uint32 {
+	return p.Uint32(16)
+}
+
+func (p *PDU) SetITT(itt uint32) {
+	p.SetUint32(16, itt)
+}
+
+func ReadPDU(r io.Reader, maxDataLength uint32) (*PDU, error) {
+	p := &PDU{}
+	if _, err := io.ReadFull(r, p.BHS[:]); err != nil {
+		return nil, err
+	}
+
+	ahsLength := int(p.BHS[4]) * 4
+	if ahsLength != 0 {
+		p.AHS = make([]byte, ahsLength)
+		if _, err := io.ReadFull(r, p.AHS); err != nil {
+			return nil, err
+		}
+	}
+
+	dataLength := uint32(p.BHS[5])<<16 | uint32(p.BHS[6])<<8 | uint32(p.BHS[7])
+	if dataLength > maxDataLength {
+		return nil, fmt.Errorf("Data segment length %v exceeds %v", dataLength, maxDataLength)
+	}
+	if dataLength != 0 {
+		// data segment is padded to 4 bytes
+		data := make([]byte, (dataLength+3)&^3)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		p.Data = data[:dataLength]
+	}
+	return p, nil
+}
+
+func WritePDU(w io.Writer, p *PDU) error {
+	dataLength := len(p.Data)
+	if dataLength >= 1<<24 {
+		return fmt.Errorf("Data segment length %v is too large", dataLength)
+	}
+	p.BHS[4] = 0
+	p.BHS[5] = byte(dataLength >> 16)
+	p.BHS[6] = byte(dataLength >> 8)
+	p.BHS[7] = byte(dataLength)
+
+	buf := make([]byte, BHS_LENGTH+(dataLength+3)&^3)
+	copy(buf, p.BHS[:])
+	copy(buf[BHS_LENGTH:], p.Data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ExtendedCDB returns the CDB beyond 16 bytes carried in AHS
+func (p *PDU) ExtendedCDB() []byte {
+	ahs := p.AHS
+	for len(ahs) >= 4 {
+		length := int(binary.BigEndian.Uint16(ahs))
+		// AHS is padded to 4 bytes, the length counts from the reserved byte
+		total := (3 + length + 3) &^ 3
+		if total > len(ahs) || length == 0 {
+			return nil
+		}
+		if ahs[2] == ISCSI_AHS_TYPE_EXTENDED_CDB {
+			return ahs[4 : 3+length]
+		}
+		ahs = ahs[total:]
+	}
+	return nil
+}
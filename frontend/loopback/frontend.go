@@ -0,0 +1,122 @@
+package loopback
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yasker/longhorn/types"
+)
+
+// Frontend exposes a volume to the same process through Go API, mostly for
+// testing the engine and replicas with no kernel, cgo or root involved.
+type Frontend struct {
+	volume types.Volume
+
+	started  bool
+	mutex    *sync.RWMutex
+	inflight *sync.WaitGroup
+}
+
+// New creates the frontend for volume, it would own the volume afterwards.
+func New(volume types.Volume) *Frontend {
+	return &Frontend{
+		volume:   volume,
+		mutex:    &sync.RWMutex{},
+		inflight: &sync.WaitGroup{},
+	}
+}
+
+func (f *Frontend) Startup() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.started {
+		return fmt.Errorf("Frontend has already been started")
+	}
+	f.started = true
+	return nil
+}
+
+// Shutdown fails all the new operations, and waits for the in-flight ones up
+// to timeout. The volume is flushed and closed at last, outstanding operations
+// would be aborted if timed out.
+func (f *Frontend) Shutdown(timeout time.Duration) error {
+	f.mutex.Lock()
+	if !f.started {
+		f.mutex.Unlock()
+		return fmt.Errorf("Frontend is not running")
+	}
+	f.started = false
+	f.mutex.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		f.inflight.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+		err = f.volume.Flush()
+		f.volume.Close()
+	case <-time.After(timeout):
+		// closing the volume aborts the outstanding operations
+		f.volume.Close()
+		<-stopped
+		err = fmt.Errorf("Aborted in-flight operations")
+	}
+	return err
+}
+
+func (f *Frontend) begin() error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	if !f.started {
+		return fmt.Errorf("Frontend is not running")
+	}
+	f.inflight.Add(1)
+	return nil
+}
+
+func (f *Frontend) end() {
+	f.inflight.Done()
+}
+
+func (f *Frontend) Size() int64 {
+	return f.volume.Size()
+}
+
+func (f *Frontend) ReadAt(buf []byte, offset int64) (int, error) {
+	if err := f.begin(); err != nil {
+		return 0, err
+	}
+	defer f.end()
+	return f.volume.ReadAt(buf, offset)
+}
+
+func (f *Frontend) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := f.begin(); err != nil {
+		return 0, err
+	}
+	defer f.end()
+	return f.volume.WriteAt(buf, offset)
+}
+
+func (f *Frontend) Flush() error {
+	if err := f.begin(); err != nil {
+		return err
+	}
+	defer f.end()
+	return f.volume.Flush()
+}
+
+func (f *Frontend) Discard(offset, length int64) error {
+	if err := f.begin(); err != nil {
+		return err
+	}
+	defer f.end()
+	return f.volume.Discard(offset, length)
+}
@@ -0,0 +1,357 @@
+package loopback
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/engine"
+	"github.com/yasker/longhorn/replica"
+	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/scsi"
+)
+
+const (
+	testSize        = int64(16 * 1024 * 1024)
+	testTimeout     = 5 // in seconds
+	testRequestSize = 4096
+	testWorkers     = 16
+	testIterations  = 500
+)
+
+// testReplica serves the volume from a memory backend behind a real
+// rpc.Server, and keeps the metadata in a map
+type testReplica struct {
+	backend  replica.Backend
+	handler  rpc.RequestHandler
+	metadata map[string][]byte
+	mutex    *sync.Mutex
+	listener *net.TCPListener
+}
+
+func startReplica(t *testing.T, size int64) *testReplica {
+	backend := replica.NewMemory(size, 0)
+	r := &testReplica{
+		backend:  backend,
+		handler:  replica.Handler(backend),
+		metadata: make(map[string][]byte),
+		mutex:    &sync.Mutex{},
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to resolve: ", err)
+	}
+	r.listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen to: %v", err)
+	}
+	fence := rpc.NewFence(0, func(epoch int64) error {
+		return nil
+	})
+	go func() {
+		for {
+			conn, err := r.listener.AcceptTCP()
+			if err != nil {
+				// the listener is closed by stop
+				return
+			}
+			server := rpc.NewServer(conn, 128, fence.Handler(r.RequestHandler))
+			server.Start()
+		}
+	}()
+	return r
+}
+
+func (r *testReplica) address() string {
+	return r.listener.Addr().String()
+}
+
+// stop stops taking connections, those accepted are closed by their clients
+func (r *testReplica) stop() {
+	r.listener.Close()
+}
+
+func (r *testReplica) RequestHandler(req *rpc.Request) (*rpc.Response, error) {
+	switch req.Header.Type {
+	case rpc.MSG_TYPE_READ_METADATA_REQUEST, rpc.MSG_TYPE_WRITE_METADATA_REQUEST:
+	default:
+		return r.handler(req)
+	}
+
+	resp := &rpc.Response{
+		Header: &block.Response{
+			Id:     req.Header.Id,
+			Type:   uint64(req.Header.Type + 1),
+			Result: "Success",
+		},
+	}
+	name, value := rpc.DecodeMetadata(req.Data)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if req.Header.Type == rpc.MSG_TYPE_READ_METADATA_REQUEST {
+		resp.Data = append([]byte{}, r.metadata[name]...)
+		resp.Header.Length = int64(len(resp.Data))
+	} else {
+		r.metadata[name] = append([]byte{}, value...)
+	}
+	return resp, nil
+}
+
+func startReplicas(t *testing.T, count int, size int64) ([]*testReplica, []string) {
+	replicas := []*testReplica{}
+	addresses := []string{}
+	for i := 0; i < count; i++ {
+		r := startReplica(t, size)
+		replicas = append(replicas, r)
+		addresses = append(addresses, r.address())
+	}
+	return replicas, addresses
+}
+
+func stopReplicas(replicas []*testReplica) {
+	for _, r := range replicas {
+		r.stop()
+	}
+}
+
+// waitGoroutines waits for the goroutines to be no more than expected, the
+// goroutines of the closed connections exit on their own
+func waitGoroutines(t *testing.T, expected int) {
+	deadline := time.Now().Add(time.Duration(testTimeout) * time.Second)
+	for runtime.NumGoroutine() > expected {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1024*1024)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%v goroutines running, expected at most %v:\n%s",
+				runtime.NumGoroutine(), expected, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAddRemoveDevices adds and removes devices the way a frontend does, the
+// volume, its replica connections and its SCSI device should leave nothing
+// running once removed
+func TestAddRemoveDevices(t *testing.T) {
+	replicas, addresses := startReplicas(t, 2, testSize)
+	defer stopReplicas(replicas)
+
+	addRemove := func() {
+		volume, err := engine.New("loopback", testSize, addresses, testTimeout)
+		if err != nil {
+			t.Fatal("Fail to open volume: ", err)
+		}
+		device, err := scsi.NewDevice("loopback", volume, 512)
+		if err != nil {
+			t.Fatal("Fail to create device: ", err)
+		}
+		frontend := New(volume)
+		if err := frontend.Startup(); err != nil {
+			t.Fatal("Fail to start frontend: ", err)
+		}
+
+		data := bytes.Repeat([]byte{0x5a}, 4096)
+		write := []byte{scsi.WRITE_10, 0, 0, 0, 0, 8, 0, 0, 8, 0}
+		if status, _, _ := device.HandleCommand("loopback", write, data); status != scsi.SAM_STAT_GOOD {
+			t.Fatalf("WRITE(10) failed with status 0x%x", status)
+		}
+		read := []byte{scsi.READ_10, 0, 0, 0, 0, 8, 0, 0, 8, 0}
+		status, dataIn, _ := device.HandleCommand("loopback", read, nil)
+		if status != scsi.SAM_STAT_GOOD || !bytes.Equal(dataIn, data) {
+			t.Fatalf("READ(10) failed with status 0x%x", status)
+		}
+
+		if err := frontend.Shutdown(time.Duration(testTimeout) * time.Second); err != nil {
+			t.Fatal("Fail to shutdown frontend: ", err)
+		}
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		addRemove()
+	}
+	waitGoroutines(t, before)
+}
+
+// checkReplicas compares the data of every replica with expected
+func checkReplicas(t *testing.T, replicas []*testReplica, expected []byte) {
+	buf := make([]byte, len(expected))
+	for i, r := range replicas {
+		if _, err := r.backend.ReadAt(buf, 0); err != nil {
+			t.Fatalf("Fail to read replica %v: %v", i, err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("Replica %v is different from the expected data", i)
+		}
+	}
+}
+
+// process writes random data to random blocks of region, then reads the
+// whole region back to verify it
+func process(frontend *Frontend, start int64, region []byte) error {
+	r := rand.New(rand.NewSource(start))
+	blocks := int64(len(region)) / testRequestSize
+	for i := 0; i < testIterations; i++ {
+		offset := r.Int63n(blocks) * testRequestSize
+		buf := region[offset : offset+testRequestSize]
+		r.Read(buf)
+		// the buffer may be changed by later writes only after this returns
+		if _, err := frontend.WriteAt(buf, start+offset); err != nil {
+			return fmt.Errorf("Fail to write at %v: %v", start+offset, err)
+		}
+	}
+
+	buf := make([]byte, len(region))
+	if _, err := frontend.ReadAt(buf, start); err != nil {
+		return fmt.Errorf("Fail to read region at %v: %v", start, err)
+	}
+	if !bytes.Equal(buf, region) {
+		return fmt.Errorf("Data mismatch in region at %v", start)
+	}
+	return nil
+}
+
+// TestVolume writes to the volume from many workers, then discards, copies
+// and sets the metadata, checking every replica has the same data each time
+func TestVolume(t *testing.T) {
+	for _, window := range []time.Duration{0, 100 * time.Microsecond} {
+		window := window
+		t.Run(fmt.Sprintf("coalesce-window=%v", window), func(t *testing.T) {
+			testVolume(t, window)
+		})
+	}
+}
+
+func testVolume(t *testing.T, window time.Duration) {
+	replicas, addresses := startReplicas(t, 3, testSize)
+	defer stopReplicas(replicas)
+
+	volume, err := engine.New("loopback", testSize, addresses, testTimeout)
+	if err != nil {
+		t.Fatal("Fail to open volume: ", err)
+	}
+	if window > 0 {
+		volume.SetCoalescing(window, 1024*1024)
+	}
+	frontend := New(volume)
+	if err := frontend.Startup(); err != nil {
+		t.Fatal("Fail to start frontend: ", err)
+	}
+
+	regionSize := testSize / testWorkers / testRequestSize * testRequestSize
+	expected := make([]byte, testSize)
+	errs := make(chan error, testWorkers)
+	for i := 0; i < testWorkers; i++ {
+		go func(start int64) {
+			errs <- process(frontend, start, expected[start:start+regionSize])
+		}(int64(i) * regionSize)
+	}
+	for i := 0; i < testWorkers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := frontend.Flush(); err != nil {
+		t.Fatal("Fail to flush: ", err)
+	}
+	checkReplicas(t, replicas, expected)
+
+	discardOffset, discardLength := regionSize/2, regionSize
+	if err := frontend.Discard(discardOffset, discardLength); err != nil {
+		t.Fatal("Fail to discard: ", err)
+	}
+	copy(expected[discardOffset:discardOffset+discardLength], make([]byte, discardLength))
+	buf := make([]byte, discardLength)
+	if _, err := frontend.ReadAt(buf, discardOffset); err != nil {
+		t.Fatal("Fail to read discarded range: ", err)
+	}
+	if !bytes.Equal(buf, make([]byte, discardLength)) {
+		t.Fatal("Discarded range is not zeroed")
+	}
+	checkReplicas(t, replicas, expected)
+
+	// overlapping, the destination is after the source
+	copySource, copyOffset, copyLength := int64(0), int64(testRequestSize), int64(4*testRequestSize)
+	if err := volume.Copy(copyOffset, copySource, copyLength); err != nil {
+		t.Fatal("Fail to copy: ", err)
+	}
+	copy(expected[copyOffset:copyOffset+copyLength], expected[copySource:])
+	checkReplicas(t, replicas, expected)
+
+	if err := volume.SetMetadata("loopback", []byte("value")); err != nil {
+		t.Fatal("Fail to set metadata: ", err)
+	}
+	if value, err := volume.GetMetadata("loopback"); err != nil || string(value) != "value" {
+		t.Fatalf("Fail to get metadata: %q, %v", value, err)
+	}
+	for i, r := range replicas {
+		r.mutex.Lock()
+		value := string(r.metadata["loopback"])
+		r.mutex.Unlock()
+		if value != "value" {
+			t.Fatalf("Metadata is not set on replica %v", i)
+		}
+	}
+
+	if _, err := frontend.ReadAt(buf, testSize-testRequestSize/2); err == nil {
+		t.Fatal("Read beyond the end of the volume should fail")
+	}
+
+	if err := frontend.Shutdown(time.Duration(testTimeout) * time.Second); err != nil {
+		t.Fatal("Fail to shutdown frontend: ", err)
+	}
+	if _, err := frontend.ReadAt(buf, 0); err == nil {
+		t.Fatal("Read after shutdown should fail")
+	}
+	// closed already by the frontend
+	if err := volume.Close(); err != nil {
+		t.Fatal("Fail to close volume again: ", err)
+	}
+}
+
+// TestFence makes a newer controller take over, then the writes from the old
+// one should be rejected by the replicas
+func TestFence(t *testing.T) {
+	replicas, addresses := startReplicas(t, 2, testSize)
+	defer stopReplicas(replicas)
+
+	old, err := engine.New("loopback", testSize, addresses, testTimeout)
+	if err != nil {
+		t.Fatal("Fail to open volume: ", err)
+	}
+	defer old.Close()
+	newer, err := engine.New("loopback", testSize, addresses, testTimeout)
+	if err != nil {
+		t.Fatal("Fail to open volume: ", err)
+	}
+	defer newer.Close()
+
+	buf := make([]byte, testRequestSize)
+	old.SetEpoch(1)
+	if _, err := old.WriteAt(buf, 0); err != nil {
+		t.Fatal("Fail to write before fencing: ", err)
+	}
+	newer.SetEpoch(2)
+	if _, err := newer.WriteAt(buf, 0); err != nil {
+		t.Fatal("Fail to write from the newer controller: ", err)
+	}
+	if _, err := old.WriteAt(buf, 0); err == nil {
+		t.Fatal("Write from a fenced controller should fail")
+	}
+	if !old.WaitFenced() {
+		t.Fatal("Old controller should be fenced")
+	}
+	if _, err := old.ReadAt(buf, 0); err != rpc.ErrFenced {
+		t.Fatal("Read from a fenced controller should fail: ", err)
+	}
+	if _, err := newer.ReadAt(buf, 0); err != nil {
+		t.Fatal("Fail to read from the newer controller: ", err)
+	}
+}
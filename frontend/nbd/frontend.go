@@ -0,0 +1,459 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/types"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// requests larger than this would be rejected, as the kernel client does
+	maxRequestLength = 32 * 1024 * 1024
+	// the largest chunk of zeroes written at a time for NBD_CMD_WRITE_ZEROES
+	maxZeroesLength = 1024 * 1024
+	// the most requests of a connection handled at once
+	queueDepth = 128
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "nbd"})
+)
+
+// Frontend serves one volume as an export of an NBD server. The export can be
+// reached either by its name or as the default export.
+type Frontend struct {
+	address string
+	name    string
+	volume  types.Volume
+
+	listener   net.Listener
+	conns      map[*connection]struct{}
+	connsMutex *sync.Mutex
+	connsGroup *sync.WaitGroup
+	shutdown   bool
+	flags      uint16 // transmission flags
+}
+
+type connection struct {
+	frontend *Frontend
+	conn     net.Conn
+	reader   *bufio.Reader
+
+	slots      chan struct{}
+	handlers   *sync.WaitGroup
+	writeMutex *sync.Mutex
+}
+
+// nbdRequest is a request read from the client, data is from util.GetBuffer
+type nbdRequest struct {
+	request
+	data []byte
+}
+
+// New creates the frontend for volume name, it would own the volume
+// afterwards. address is where the NBD server listens on.
+func New(address, name string, volume types.Volume) *Frontend {
+	return &Frontend{
+		address:    address,
+		name:       name,
+		volume:     volume,
+		conns:      make(map[*connection]struct{}),
+		connsMutex: &sync.Mutex{},
+		connsGroup: &sync.WaitGroup{},
+		flags: NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA |
+			NBD_FLAG_SEND_TRIM | NBD_FLAG_SEND_WRITE_ZEROES,
+	}
+}
+
+func (f *Frontend) Startup() error {
+	l, err := net.Listen("tcp", f.address)
+	if err != nil {
+		return fmt.Errorf("Fail to listen on %v: %v", f.address, err)
+	}
+	f.listener = l
+	go f.accept()
+	log.Infof("Serving volume %v as NBD export on %v", f.name, l.Addr())
+	return nil
+}
+
+// Addr is the address the NBD server listens on
+func (f *Frontend) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *Frontend) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			f.connsMutex.Lock()
+			shutdown := f.shutdown
+			f.connsMutex.Unlock()
+			if shutdown {
+				break
+			}
+			log.Errorf("failed to accept connection %v", err)
+			continue
+		}
+
+		c := &connection{
+			frontend:   f,
+			conn:       conn,
+			reader:     bufio.NewReader(conn),
+			slots:      make(chan struct{}, queueDepth),
+			handlers:   &sync.WaitGroup{},
+			writeMutex: &sync.Mutex{},
+		}
+		f.connsMutex.Lock()
+		if f.shutdown {
+			f.connsMutex.Unlock()
+			conn.Close()
+			break
+		}
+		f.conns[c] = struct{}{}
+		f.connsGroup.Add(1)
+		f.connsMutex.Unlock()
+
+		go func() {
+			defer f.connsGroup.Done()
+			c.serve()
+
+			f.connsMutex.Lock()
+			delete(f.conns, c)
+			f.connsMutex.Unlock()
+		}()
+	}
+}
+
+// Shutdown stops taking new connections and requests, and waits for the
+// in-flight requests up to timeout. The volume is flushed and closed at last,
+// outstanding requests would be aborted if timed out.
+func (f *Frontend) Shutdown(timeout time.Duration) error {
+	f.connsMutex.Lock()
+	f.shutdown = true
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	for c := range f.conns {
+		// stop reading new requests, responses can still be sent
+		c.conn.SetReadDeadline(time.Now())
+	}
+	f.connsMutex.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		f.connsGroup.Wait()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+		err = f.volume.Flush()
+		f.volume.Close()
+	case <-time.After(timeout):
+		log.Errorf("Timeout waiting for in-flight requests of volume %v, abort them", f.name)
+		// closing the volume aborts the outstanding operations
+		f.volume.Close()
+		f.connsMutex.Lock()
+		for c := range f.conns {
+			c.conn.Close()
+		}
+		f.connsMutex.Unlock()
+		<-stopped
+		err = fmt.Errorf("Aborted in-flight requests of volume %v", f.name)
+	}
+	return err
+}
+
+func (c *connection) serve() {
+	defer c.conn.Close()
+
+	if err := c.handshake(); err != nil {
+		if err != io.EOF {
+			log.Errorf("Handshake with %v failed: %v", c.conn.RemoteAddr(), err)
+		}
+		return
+	}
+	log.Debugf("Client %v connected", c.conn.RemoteAddr())
+
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Fail to read request from %v: %v", c.conn.RemoteAddr(), err)
+			}
+			break
+		}
+		if req.Type == NBD_CMD_DISC {
+			break
+		}
+		// each request is handled in a goroutine of its own, up to
+		// queueDepth at once
+		c.slots <- struct{}{}
+		c.handlers.Add(1)
+		go c.handleRequest(req)
+	}
+	c.handlers.Wait()
+
+	log.Debugf("Client %v disconnected", c.conn.RemoteAddr())
+}
+
+// handshake returns nil when the client is ready for transmission
+func (c *connection) handshake() error {
+	f := c.frontend
+
+	if err := binary.Write(c.conn, binary.BigEndian, []uint64{NBD_MAGIC, NBD_OPTS_MAGIC}); err != nil {
+		return err
+	}
+	if err := binary.Write(c.conn, binary.BigEndian,
+		uint16(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)); err != nil {
+		return err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(c.reader, binary.BigEndian, &clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&NBD_FLAG_C_FIXED_NEWSTYLE == 0 {
+		return fmt.Errorf("Client doesn't support fixed newstyle handshake")
+	}
+	noZeroes := clientFlags&NBD_FLAG_C_NO_ZEROES != 0
+
+	for {
+		var opt option
+		if err := binary.Read(c.reader, binary.BigEndian, &opt); err != nil {
+			return err
+		}
+		if opt.Magic != NBD_OPTS_MAGIC {
+			return fmt.Errorf("Invalid option magic 0x%x", opt.Magic)
+		}
+		if opt.Length > NBD_MAX_OPT_LENGTH {
+			return fmt.Errorf("Option %v is too long: %v", opt.Option, opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return err
+		}
+
+		switch opt.Option {
+		case NBD_OPT_EXPORT_NAME:
+			if !f.isExport(string(data)) {
+				return fmt.Errorf("Unknown export %v", string(data))
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply, uint64(f.volume.Size()))
+			binary.BigEndian.PutUint16(reply[8:], f.flags)
+			if !noZeroes {
+				reply = reply[:10+124]
+			}
+			_, err := c.conn.Write(reply)
+			return err
+		case NBD_OPT_ABORT:
+			sendOptionReply(c.conn, opt.Option, NBD_REP_ACK, nil)
+			return io.EOF
+		case NBD_OPT_LIST:
+			if len(data) != 0 {
+				if err := sendOptionReply(c.conn, opt.Option, NBD_REP_ERR_INVALID, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			server := make([]byte, 4+len(f.name))
+			binary.BigEndian.PutUint32(server, uint32(len(f.name)))
+			copy(server[4:], f.name)
+			if err := sendOptionReply(c.conn, opt.Option, NBD_REP_SERVER, server); err != nil {
+				return err
+			}
+			if err := sendOptionReply(c.conn, opt.Option, NBD_REP_ACK, nil); err != nil {
+				return err
+			}
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			name, err := parseInfoRequest(data)
+			if err != nil {
+				log.Errorf("Invalid option %v from %v: %v", opt.Option, c.conn.RemoteAddr(), err)
+				if err := sendOptionReply(c.conn, opt.Option, NBD_REP_ERR_INVALID, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			if !f.isExport(name) {
+				if err := sendOptionReply(c.conn, opt.Option, NBD_REP_ERR_UNKNOWN, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			export := make([]byte, 12)
+			binary.BigEndian.PutUint16(export, NBD_INFO_EXPORT)
+			binary.BigEndian.PutUint64(export[2:], uint64(f.volume.Size()))
+			binary.BigEndian.PutUint16(export[10:], f.flags)
+			if err := sendOptionReply(c.conn, opt.Option, NBD_REP_INFO, export); err != nil {
+				return err
+			}
+			blockSize := make([]byte, 14)
+			binary.BigEndian.PutUint16(blockSize, NBD_INFO_BLOCK_SIZE)
+			binary.BigEndian.PutUint32(blockSize[2:], 1)
+			binary.BigEndian.PutUint32(blockSize[6:], 4096)
+			binary.BigEndian.PutUint32(blockSize[10:], maxRequestLength)
+			if err := sendOptionReply(c.conn, opt.Option, NBD_REP_INFO, blockSize); err != nil {
+				return err
+			}
+			if err := sendOptionReply(c.conn, opt.Option, NBD_REP_ACK, nil); err != nil {
+				return err
+			}
+			if opt.Option == NBD_OPT_GO {
+				return nil
+			}
+		default:
+			if err := sendOptionReply(c.conn, opt.Option, NBD_REP_ERR_UNSUP, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (f *Frontend) isExport(name string) bool {
+	return name == "" || name == f.name
+}
+
+func (c *connection) readRequest() (*nbdRequest, error) {
+	req := &nbdRequest{}
+	if err := binary.Read(c.reader, binary.BigEndian, &req.request); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			// shutting down
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if req.Magic != NBD_REQUEST_MAGIC {
+		return nil, fmt.Errorf("Invalid request magic 0x%x", req.Magic)
+	}
+	if req.Type == NBD_CMD_WRITE {
+		// the data has to be consumed to keep the stream in sync
+		if req.Length > maxRequestLength {
+			return nil, fmt.Errorf("Write request of %v bytes is too large", req.Length)
+		}
+		req.data = util.GetBuffer(int(req.Length))
+		if _, err := io.ReadFull(c.reader, req.data); err != nil {
+			util.PutBuffer(req.data)
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (c *connection) handleRequest(req *nbdRequest) {
+	defer func() {
+		util.PutBuffer(req.data)
+		<-c.slots
+		c.handlers.Done()
+	}()
+
+	var (
+		data  []byte
+		errno uint32
+	)
+
+	volume := c.frontend.volume
+	offset := int64(req.Offset)
+	length := int64(req.Length)
+	if req.Type != NBD_CMD_FLUSH && (offset < 0 || offset+length > volume.Size()) {
+		log.Errorf("Request %v is out of range: offset %v, length %v", req.Type, offset, length)
+		c.sendReply(req, NBD_EINVAL, nil)
+		return
+	}
+
+	switch req.Type {
+	case NBD_CMD_READ:
+		if length > maxRequestLength {
+			errno = NBD_EINVAL
+			break
+		}
+		data = util.GetBuffer(int(length))
+		defer util.PutBuffer(data)
+		if _, err := volume.ReadAt(data, offset); err != nil {
+			log.Errorln("read failed: ", err)
+			errno = NBD_EIO
+		}
+	case NBD_CMD_WRITE:
+		if _, err := volume.WriteAt(req.data, offset); err != nil {
+			log.Errorln("write failed: ", err)
+			errno = NBD_EIO
+		}
+	case NBD_CMD_FLUSH:
+		if err := volume.Flush(); err != nil {
+			log.Errorln("flush failed: ", err)
+			errno = NBD_EIO
+		}
+	case NBD_CMD_TRIM:
+		if err := volume.Discard(offset, length); err != nil {
+			log.Errorln("trim failed: ", err)
+			errno = NBD_EIO
+		}
+	case NBD_CMD_WRITE_ZEROES:
+		if err := writeZeroes(volume, offset, length); err != nil {
+			log.Errorln("write zeroes failed: ", err)
+			errno = NBD_EIO
+		}
+	default:
+		log.Errorf("unknown command %v", req.Type)
+		errno = NBD_EINVAL
+	}
+
+	if errno == 0 && req.Flags&NBD_CMD_FLAG_FUA != 0 &&
+		(req.Type == NBD_CMD_WRITE || req.Type == NBD_CMD_TRIM || req.Type == NBD_CMD_WRITE_ZEROES) {
+		if err := volume.Flush(); err != nil {
+			log.Errorln("flush failed: ", err)
+			errno = NBD_EIO
+		}
+	}
+	if errno != 0 {
+		data = nil
+	}
+	c.sendReply(req, errno, data)
+}
+
+func writeZeroes(volume types.Volume, offset, length int64) error {
+	zeroes := make([]byte, maxZeroesLength)
+	for length > 0 {
+		n := length
+		if n > maxZeroesLength {
+			n = maxZeroesLength
+		}
+		if _, err := volume.WriteAt(zeroes[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// sendReply writes the reply followed by data at once, with writev(2)
+func (c *connection) sendReply(req *nbdRequest, errno uint32, data []byte) {
+	reply := make([]byte, 16)
+	binary.BigEndian.PutUint32(reply, NBD_REPLY_MAGIC)
+	binary.BigEndian.PutUint32(reply[4:], errno)
+	binary.BigEndian.PutUint64(reply[8:], req.Handle)
+	buffers := net.Buffers{reply}
+	if len(data) != 0 {
+		buffers = append(buffers, data)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if _, err := buffers.WriteTo(c.conn); err != nil {
+		log.Errorf("Fail to send reply to %v: %v", c.conn.RemoteAddr(), err)
+	}
+}
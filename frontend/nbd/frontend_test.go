@@ -0,0 +1,304 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/test/testvolume"
+)
+
+const (
+	testName = "test"
+	testSize = int64(16 * 1024 * 1024)
+)
+
+// testClient talks to the frontend the way the kernel client does after
+// nbd-client has done the handshake
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	handle uint64
+}
+
+func startFrontend(t *testing.T) (*Frontend, *testvolume.Volume) {
+	volume := testvolume.New(testSize)
+	f := New("127.0.0.1:0", testName, volume)
+	if err := f.Startup(); err != nil {
+		t.Fatal("Fail to start frontend: ", err)
+	}
+	return f, volume
+}
+
+func dial(t *testing.T, f *Frontend) *testClient {
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal("Fail to connect: ", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) read(data interface{}) {
+	if err := binary.Read(c.conn, binary.BigEndian, data); err != nil {
+		c.t.Fatal("Fail to read: ", err)
+	}
+}
+
+func (c *testClient) write(data interface{}) {
+	if err := binary.Write(c.conn, binary.BigEndian, data); err != nil {
+		c.t.Fatal("Fail to write: ", err)
+	}
+}
+
+func (c *testClient) sendOption(opt uint32, data []byte) {
+	c.write(option{Magic: NBD_OPTS_MAGIC, Option: opt, Length: uint32(len(data))})
+	c.write(data)
+}
+
+func (c *testClient) readOptionReply(opt uint32) (uint32, []byte) {
+	var reply optionReply
+	c.read(&reply)
+	if reply.Magic != NBD_REP_MAGIC || reply.Option != opt {
+		c.t.Fatalf("Invalid option reply %+v to option %v", reply, opt)
+	}
+	data := make([]byte, reply.Length)
+	c.read(data)
+	return reply.Type, data
+}
+
+// handshake goes through the fixed newstyle handshake, listing the exports
+// then entering transmission with NBD_OPT_GO
+func (c *testClient) handshake(name string) {
+	var magics [2]uint64
+	var flags uint16
+	c.read(&magics)
+	c.read(&flags)
+	if magics[0] != NBD_MAGIC || magics[1] != NBD_OPTS_MAGIC {
+		c.t.Fatalf("Invalid handshake magics 0x%x", magics)
+	}
+	if flags != NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES {
+		c.t.Fatalf("Invalid handshake flags 0x%x", flags)
+	}
+	c.write(uint32(NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES))
+
+	c.sendOption(NBD_OPT_LIST, nil)
+	replyType, data := c.readOptionReply(NBD_OPT_LIST)
+	if replyType != NBD_REP_SERVER || string(data[4:]) != testName {
+		c.t.Fatalf("Invalid export list %v %q", replyType, data)
+	}
+	if replyType, _ := c.readOptionReply(NBD_OPT_LIST); replyType != NBD_REP_ACK {
+		c.t.Fatalf("Invalid end of export list %v", replyType)
+	}
+
+	// unknown options are refused, and the handshake goes on
+	c.sendOption(100, nil)
+	if replyType, _ := c.readOptionReply(100); replyType != NBD_REP_ERR_UNSUP {
+		c.t.Fatalf("Unknown option replied with %v", replyType)
+	}
+
+	data = make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(name)))
+	copy(data[4:], name)
+	c.sendOption(NBD_OPT_GO, data)
+	for {
+		replyType, data := c.readOptionReply(NBD_OPT_GO)
+		if replyType == NBD_REP_ACK {
+			break
+		}
+		if replyType != NBD_REP_INFO {
+			c.t.Fatalf("NBD_OPT_GO failed with %v", replyType)
+		}
+		if binary.BigEndian.Uint16(data) != NBD_INFO_EXPORT {
+			continue
+		}
+		if size := int64(binary.BigEndian.Uint64(data[2:])); size != testSize {
+			c.t.Fatalf("Export size is %v, expected %v", size, testSize)
+		}
+		flags := binary.BigEndian.Uint16(data[10:])
+		expected := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_TRIM | NBD_FLAG_SEND_WRITE_ZEROES)
+		if flags&expected != expected {
+			c.t.Fatalf("Export flags 0x%x miss 0x%x", flags, expected)
+		}
+	}
+}
+
+// do sends the request and returns the error of its reply, and the data read
+func (c *testClient) do(cmd uint16, flags uint16, offset int64, length int, data []byte) (uint32, []byte) {
+	c.handle++
+	c.write(request{
+		Magic:  NBD_REQUEST_MAGIC,
+		Flags:  flags,
+		Type:   cmd,
+		Handle: c.handle,
+		Offset: uint64(offset),
+		Length: uint32(length),
+	})
+	if cmd == NBD_CMD_WRITE {
+		c.write(data)
+	}
+
+	var reply simpleReply
+	c.read(&reply)
+	if reply.Magic != NBD_REPLY_MAGIC || reply.Handle != c.handle {
+		c.t.Fatalf("Invalid reply %+v to request %v", reply, c.handle)
+	}
+	if cmd != NBD_CMD_READ || reply.Error != 0 {
+		return reply.Error, nil
+	}
+	buf := make([]byte, length)
+	c.read(buf)
+	return 0, buf
+}
+
+func (c *testClient) check(offset int64, expected []byte) {
+	errno, data := c.do(NBD_CMD_READ, 0, offset, len(expected), nil)
+	if errno != 0 {
+		c.t.Fatalf("Read at %v failed with %v", offset, errno)
+	}
+	if !bytes.Equal(data, expected) {
+		c.t.Fatalf("Read at %v returned wrong data", offset)
+	}
+}
+
+func TestTransmission(t *testing.T) {
+	f, volume := startFrontend(t)
+	c := dial(t, f)
+	c.handshake(testName)
+
+	data := bytes.Repeat([]byte{0x5a}, 64*1024)
+	if errno, _ := c.do(NBD_CMD_WRITE, 0, 4096, len(data), data); errno != 0 {
+		t.Fatal("Write failed with ", errno)
+	}
+	c.check(4096, data)
+
+	if errno, _ := c.do(NBD_CMD_FLUSH, 0, 0, 0, nil); errno != 0 {
+		t.Fatal("Flush failed with ", errno)
+	}
+	if errno, _ := c.do(NBD_CMD_WRITE, NBD_CMD_FLAG_FUA, 0, 4096, data[:4096]); errno != 0 {
+		t.Fatal("FUA write failed with ", errno)
+	}
+	if volume.Flushes() != 2 {
+		t.Fatalf("Volume flushed %v times, expected 2", volume.Flushes())
+	}
+
+	zeroes := make([]byte, 8192)
+	if errno, _ := c.do(NBD_CMD_TRIM, 0, 4096, len(zeroes), nil); errno != 0 {
+		t.Fatal("Trim failed with ", errno)
+	}
+	c.check(4096, append(zeroes, data[len(zeroes):]...))
+
+	if errno, _ := c.do(NBD_CMD_WRITE_ZEROES, 0, 0, len(zeroes), nil); errno != 0 {
+		t.Fatal("Write zeroes failed with ", errno)
+	}
+	c.check(0, append(make([]byte, 4096+len(zeroes)), data[len(zeroes):]...))
+
+	// out of range
+	if errno, _ := c.do(NBD_CMD_READ, 0, testSize-4096, 8192, nil); errno != NBD_EINVAL {
+		t.Fatal("Read beyond the end returned ", errno)
+	}
+	c.check(testSize-4096, make([]byte, 4096))
+
+	c.write(request{Magic: NBD_REQUEST_MAGIC, Type: NBD_CMD_DISC})
+	if _, err := c.conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Connection is not closed after disconnect: ", err)
+	}
+	c.conn.Close()
+
+	if err := f.Shutdown(10 * time.Second); err != nil {
+		t.Fatal("Fail to shutdown frontend: ", err)
+	}
+}
+
+func TestUnknownExport(t *testing.T) {
+	f, _ := startFrontend(t)
+	defer f.Shutdown(10 * time.Second)
+	c := dial(t, f)
+	defer c.conn.Close()
+
+	var magics [2]uint64
+	var flags uint16
+	c.read(&magics)
+	c.read(&flags)
+	c.write(uint32(NBD_FLAG_C_FIXED_NEWSTYLE | NBD_FLAG_C_NO_ZEROES))
+
+	name := "unknown"
+	data := make([]byte, 4+len(name)+2)
+	binary.BigEndian.PutUint32(data, uint32(len(name)))
+	copy(data[4:], name)
+	c.sendOption(NBD_OPT_GO, data)
+	if replyType, _ := c.readOptionReply(NBD_OPT_GO); replyType != NBD_REP_ERR_UNKNOWN {
+		t.Fatalf("Unknown export replied with %v", replyType)
+	}
+
+	// the default export is served
+	c.sendOption(NBD_OPT_EXPORT_NAME, nil)
+	var size uint64
+	var transmission uint16
+	c.read(&size)
+	c.read(&transmission)
+	if int64(size) != testSize || transmission&NBD_FLAG_HAS_FLAGS == 0 {
+		t.Fatalf("Invalid export %v 0x%x", size, transmission)
+	}
+	c.check(0, make([]byte, 4096))
+}
+
+// TestPipelined sends more reads than are handled at once before reading any
+// reply, the replies may come in any order
+func TestPipelined(t *testing.T) {
+	f, _ := startFrontend(t)
+	defer f.Shutdown(10 * time.Second)
+	c := dial(t, f)
+	defer c.conn.Close()
+	c.handshake(testName)
+
+	count := 2 * queueDepth
+	for i := 0; i < count; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 4096)
+		if errno, _ := c.do(NBD_CMD_WRITE, 0, int64(i*4096), len(data), data); errno != 0 {
+			t.Fatal("Write failed with ", errno)
+		}
+	}
+
+	first := c.handle + 1
+	go func() {
+		for i := 0; i < count; i++ {
+			binary.Write(c.conn, binary.BigEndian, request{
+				Magic:  NBD_REQUEST_MAGIC,
+				Type:   NBD_CMD_READ,
+				Handle: first + uint64(i),
+				Offset: uint64(i * 4096),
+				Length: 4096,
+			})
+		}
+	}()
+	replied := make(map[uint64]bool)
+	for i := 0; i < count; i++ {
+		var reply simpleReply
+		c.read(&reply)
+		index := reply.Handle - first
+		if reply.Magic != NBD_REPLY_MAGIC || reply.Error != 0 || index >= uint64(count) || replied[index] {
+			t.Fatalf("Invalid reply %+v", reply)
+		}
+		replied[index] = true
+		data := make([]byte, 4096)
+		c.read(data)
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte(index)}, 4096)) {
+			t.Fatalf("Read %v returned wrong data", index)
+		}
+	}
+}
+
+func TestShutdownNotStarted(t *testing.T) {
+	volume := testvolume.New(testSize)
+	f := New("127.0.0.1:0", testName, volume)
+	if err := f.Shutdown(10 * time.Second); err != nil {
+		t.Fatal("Fail to shutdown frontend never started: ", err)
+	}
+	if volume.Flushes() != 1 {
+		t.Fatalf("Volume flushed %v times, expected 1", volume.Flushes())
+	}
+}
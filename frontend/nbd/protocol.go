@@ -0,0 +1,134 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// See https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md.
+// Only the fixed newstyle handshake is supported.
+const (
+	NBD_MAGIC          = 0x4e42444d41474943 // "NBDMAGIC"
+	NBD_OPTS_MAGIC     = 0x49484156454f5054 // "IHAVEOPT"
+	NBD_REP_MAGIC      = 0x0003e889045565a9
+	NBD_REQUEST_MAGIC  = 0x25609513
+	NBD_REPLY_MAGIC    = 0x67446698
+	NBD_MAX_OPT_LENGTH = 4096
+
+	// handshake flags
+	NBD_FLAG_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_NO_ZEROES      = 1 << 1
+
+	// client flags
+	NBD_FLAG_C_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_C_NO_ZEROES      = 1 << 1
+
+	// transmission flags
+	NBD_FLAG_HAS_FLAGS         = 1 << 0
+	NBD_FLAG_READ_ONLY         = 1 << 1
+	NBD_FLAG_SEND_FLUSH        = 1 << 2
+	NBD_FLAG_SEND_FUA          = 1 << 3
+	NBD_FLAG_ROTATIONAL        = 1 << 4
+	NBD_FLAG_SEND_TRIM         = 1 << 5
+	NBD_FLAG_SEND_WRITE_ZEROES = 1 << 6
+
+	NBD_OPT_EXPORT_NAME = 1
+	NBD_OPT_ABORT       = 2
+	NBD_OPT_LIST        = 3
+	NBD_OPT_INFO        = 6
+	NBD_OPT_GO          = 7
+
+	NBD_REP_ACK         = 1
+	NBD_REP_SERVER      = 2
+	NBD_REP_INFO        = 3
+	NBD_REP_FLAG_ERROR  = 1 << 31
+	NBD_REP_ERR_UNSUP   = NBD_REP_FLAG_ERROR | 1
+	NBD_REP_ERR_INVALID = NBD_REP_FLAG_ERROR | 3
+	NBD_REP_ERR_UNKNOWN = NBD_REP_FLAG_ERROR | 6
+
+	NBD_INFO_EXPORT     = 0
+	NBD_INFO_BLOCK_SIZE = 3
+
+	NBD_CMD_READ         = 0
+	NBD_CMD_WRITE        = 1
+	NBD_CMD_DISC         = 2
+	NBD_CMD_FLUSH        = 3
+	NBD_CMD_TRIM         = 4
+	NBD_CMD_WRITE_ZEROES = 6
+
+	NBD_CMD_FLAG_FUA     = 1 << 0
+	NBD_CMD_FLAG_NO_HOLE = 1 << 1
+
+	NBD_EPERM     = 1
+	NBD_EIO       = 5
+	NBD_ENOMEM    = 12
+	NBD_EINVAL    = 22
+	NBD_ENOSPC    = 28
+	NBD_ENOTSUP   = 95
+	NBD_ESHUTDOWN = 108
+)
+
+// option header sent by the client during the handshake
+type option struct {
+	Magic  uint64
+	Option uint32
+	Length uint32
+}
+
+type optionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+type simpleReply struct {
+	Magic  uint32
+	Error  uint32
+	Handle uint64
+}
+
+func sendOptionReply(w io.Writer, opt uint32, replyType uint32, data []byte) error {
+	reply := optionReply{
+		Magic:  NBD_REP_MAGIC,
+		Option: opt,
+		Type:   replyType,
+		Length: uint32(len(data)),
+	}
+	if err := binary.Write(w, binary.BigEndian, &reply); err != nil {
+		return fmt.Errorf("Fail to send option reply: %v", err)
+	}
+	if len(data) != 0 {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("Fail to send option reply data: %v", err)
+		}
+	}
+	return nil
+}
+
+// parseInfoRequest parses the data of NBD_OPT_INFO and NBD_OPT_GO
+func parseInfoRequest(data []byte) (string, error) {
+	if len(data) < 4 {
+		return "", fmt.Errorf("Option data is too short")
+	}
+	nameLength := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 4+uint64(nameLength)+2 {
+		return "", fmt.Errorf("Option data is too short for name length %v", nameLength)
+	}
+	name := string(data[4 : 4+nameLength])
+	infos := binary.BigEndian.Uint16(data[4+nameLength:])
+	if uint64(len(data)) != 4+uint64(nameLength)+2+2*uint64(infos) {
+		return "", fmt.Errorf("Option data has invalid length")
+	}
+	return name, nil
+}
@@ -0,0 +1,180 @@
+package tcmu
+
+/*
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdarg.h>
+#include <poll.h>
+#include <scsi/scsi.h>
+
+#include "libtcmu.h"
+
+extern bool shCheckConfig(char *cfgstring, char **reason);
+
+
+void errp(const char *fmt, ...)
+{
+	va_list va;
+
+	va_start(va, fmt);
+	vfprintf(stderr, fmt, va);
+	va_end(va);
+}
+
+bool sh_check_config_cgo(const char *cfgstring, char **reason) {
+	return shCheckConfig((char *)cfgstring, reason);
+}
+
+int sh_open_cgo(struct tcmu_device *dev) {
+	return shOpen(dev);
+}
+
+void sh_close_cgo(struct tcmu_device *dev) {
+	shClose(dev);
+}
+
+static struct tcmulib_handler sh_handler = {
+	.name = "Shorthorn TCMU handler",
+	.subtype = "longhorn",
+	.cfg_desc = "dev_config=longhorn/<volume>?replicas=<host:port>[,<host:port>...][&timeout=<seconds>][&queue_depth=<commands>]",
+	.check_config = sh_check_config_cgo,
+	.added = sh_open_cgo,
+	.removed = sh_close_cgo,
+};
+
+struct tcmulib_context *tcmu_init() {
+	return tcmulib_initialize(&sh_handler, 1, errp);
+}
+
+// Returns 0 if the master fd has been processed, 1 if stop_fd became
+// readable or was closed by the other end.
+int tcmu_poll_master_fd(struct tcmulib_context *cxt, int stop_fd) {
+	int ret;
+	struct pollfd pfds[2];
+
+	pfds[0].fd = tcmulib_get_master_fd(cxt);
+	pfds[0].events = POLLIN;
+	pfds[0].revents = 0;
+	pfds[1].fd = stop_fd;
+	pfds[1].events = POLLIN;
+	pfds[1].revents = 0;
+
+	ret = poll(pfds, 2, -1);
+	if (ret < 0) {
+		errp("poll error out with %d", ret);
+		exit(1);
+	}
+
+	if (pfds[1].revents) {
+		return 1;
+	}
+	if (pfds[0].revents) {
+		tcmulib_master_fd_ready(cxt);
+	}
+	return 0;
+}
+
+// Returns 0 if there are new commands, or wake_fd became readable as some
+// commands have been handled, 1 if stop_fd became readable or was closed by
+// the other end, -1 on error.
+int tcmu_wait_for_next_command(struct tcmu_device *dev, int stop_fd, int wake_fd) {
+	struct pollfd pfds[3];
+
+	pfds[0].fd = tcmu_get_dev_fd(dev);
+	pfds[0].events = POLLIN;
+	pfds[0].revents = 0;
+	pfds[1].fd = stop_fd;
+	pfds[1].events = POLLIN;
+	pfds[1].revents = 0;
+	pfds[2].fd = wake_fd;
+	pfds[2].events = POLLIN;
+	pfds[2].revents = 0;
+
+	poll(pfds, 3, -1);
+
+	if (pfds[1].revents != 0) {
+		return 1;
+	}
+	if (pfds[0].revents != 0 && pfds[0].revents != POLLIN ) {
+		errp("poll received unexpected revent: 0x%x\n", pfds[0].revents);
+		return -1;
+	}
+	return 0;
+}
+
+void tcmu_set_dev_handle(struct tcmu_device *dev, long handle) {
+	tcmu_set_dev_private(dev, (void *)handle);
+}
+
+long tcmu_get_dev_handle(struct tcmu_device *dev) {
+	return (long)tcmu_get_dev_private(dev);
+}
+
+uint8_t tcmucmd_get_cdb_at(struct tcmulib_cmd *cmd, int index) {
+	return cmd->cdb[index];
+}
+
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/yasker/longhorn/scsi"
+)
+
+type (
+	TcmuCommand *C.struct_tcmulib_cmd
+	TcmuDevice  *C.struct_tcmu_device
+
+	Cbuffer *C.void
+)
+
+// DevSetHandle stores handle as the private data of dev. Go pointers cannot
+// be kept by C, so the handle is used to look up the device state instead.
+func DevSetHandle(dev TcmuDevice, handle int64) {
+	C.tcmu_set_dev_handle(dev, C.long(handle))
+}
+
+func DevGetHandle(dev TcmuDevice) int64 {
+	return int64(C.tcmu_get_dev_handle(dev))
+}
+
+func CmdGetScsiCmd(cmd TcmuCommand) byte {
+	return byte(C.tcmucmd_get_cdb_at(cmd, 0))
+}
+
+func CmdGetCdb(cmd TcmuCommand, length int) []byte {
+	return C.GoBytes(unsafe.Pointer(cmd.cdb), C.int(length))
+}
+
+func CmdMemcpyIntoIovec(cmd TcmuCommand, buf []byte, length int) int {
+	if len(buf) != length {
+		log.Errorln("read buffer length %v is not %v: ", len(buf), length)
+		return 0
+	}
+	return int(C.tcmu_memcpy_into_iovec(cmd.iovec, cmd.iov_cnt, unsafe.Pointer(&buf[0]), C.size_t(length)))
+}
+
+func CmdMemcpyFromIovec(cmd TcmuCommand, buf []byte, length int) int {
+	if len(buf) != length {
+		log.Errorln("write buffer length %v is not %v: ", len(buf), length)
+		return 0
+	}
+	return int(C.tcmu_memcpy_from_iovec(unsafe.Pointer(&buf[0]), C.size_t(length), cmd.iovec, cmd.iov_cnt))
+}
+
+// CmdSetSense copies sense into cmd, and returns CHECK CONDITION
+func CmdSetSense(cmd TcmuCommand, sense []byte) int {
+	C.memcpy(unsafe.Pointer(&cmd.sense_buf[0]), unsafe.Pointer(&sense[0]), C.size_t(len(sense)))
+	return C.SAM_STAT_CHECK_CONDITION
+}
+
+func CmdSetInvalidOpcode(cmd TcmuCommand) int {
+	return CmdSetSense(cmd, scsi.BuildSense(scsi.ILLEGAL_REQUEST, scsi.ASC_INVALID_OPCODE))
+}
+
+func CmdGetIovecLength(cmd TcmuCommand) int {
+	return int(C.tcmu_iovec_length(cmd.iovec, cmd.iov_cnt))
+}
@@ -0,0 +1,108 @@
+// Package config parses the configuration strings of the Longhorn TCMU
+// devices, with no cgo involved so it can be tested on its own.
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	configSubtype = "longhorn"
+
+	defaultTimeout    = 5 // in seconds
+	defaultQueueDepth = 128
+)
+
+// Config is the parsed form of the TCMU cfgstring of a Longhorn device:
+//
+//	longhorn/<volume>?replicas=<host:port>[,<host:port>...][&timeout=<seconds>][&queue_depth=<commands>]
+//
+// e.g. "longhorn/vol1?replicas=host1:5000,host2:5000&timeout=5". Writes are
+// sent to every replica, reads are served by the first replica that answers.
+type Config struct {
+	Volume     string
+	Replicas   []string
+	Timeout    int
+	QueueDepth int
+}
+
+// Parse returns the configuration of cfgString, or an error telling why it's
+// invalid
+func Parse(cfgString string) (*Config, error) {
+	if !strings.HasPrefix(cfgString, configSubtype+"/") {
+		return nil, fmt.Errorf("Configuration %v doesn't start with %v/", cfgString, configSubtype)
+	}
+	s := strings.TrimPrefix(cfgString, configSubtype+"/")
+
+	volume, query := s, ""
+	if i := strings.Index(s, "?"); i >= 0 {
+		volume, query = s[:i], s[i+1:]
+	}
+	if volume == "" {
+		return nil, fmt.Errorf("Volume name is missing in configuration %v", cfgString)
+	}
+	if strings.Contains(volume, "/") {
+		return nil, fmt.Errorf("Invalid volume name %v", volume)
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse options %v: %v", query, err)
+	}
+
+	cfg := &Config{
+		Volume:     volume,
+		Timeout:    defaultTimeout,
+		QueueDepth: defaultQueueDepth,
+	}
+	for key, value := range values {
+		if len(value) != 1 {
+			return nil, fmt.Errorf("Option %v is specified more than once", key)
+		}
+		switch key {
+		case "replicas":
+			for _, address := range strings.Split(value[0], ",") {
+				if err := validateAddress(address); err != nil {
+					return nil, err
+				}
+				cfg.Replicas = append(cfg.Replicas, address)
+			}
+		case "timeout":
+			timeout, err := strconv.Atoi(value[0])
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("Invalid timeout %v", value[0])
+			}
+			cfg.Timeout = timeout
+		case "queue_depth":
+			queueDepth, err := strconv.Atoi(value[0])
+			if err != nil || queueDepth <= 0 {
+				return nil, fmt.Errorf("Invalid queue depth %v", value[0])
+			}
+			cfg.QueueDepth = queueDepth
+		default:
+			return nil, fmt.Errorf("Unknown option %v", key)
+		}
+	}
+	if len(cfg.Replicas) == 0 {
+		return nil, fmt.Errorf("No replica specified in configuration %v", cfgString)
+	}
+	return cfg, nil
+}
+
+func validateAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Invalid replica address %v: %v", address, err)
+	}
+	if host == "" {
+		return fmt.Errorf("Replica address %v is missing host", address)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("Replica address %v has invalid port", address)
+	}
+	return nil
+}
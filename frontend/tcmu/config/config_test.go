@@ -0,0 +1,65 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		cfgString string
+		// nil if the configuration string is invalid
+		expected *Config
+	}{
+		{"longhorn/vol1?replicas=localhost:5000",
+			&Config{"vol1", []string{"localhost:5000"}, defaultTimeout, defaultQueueDepth}},
+		{"longhorn/vol1?replicas=host1:5000,host2:5000&timeout=10&queue_depth=32",
+			&Config{"vol1", []string{"host1:5000", "host2:5000"}, 10, 32}},
+		{"longhorn/vol1?queue_depth=1&replicas=[::1]:5000",
+			&Config{"vol1", []string{"[::1]:5000"}, defaultTimeout, 1}},
+
+		// not a Longhorn device
+		{"file/vol1?replicas=localhost:5000", nil},
+		{"vol1?replicas=localhost:5000", nil},
+		// no volume
+		{"longhorn/?replicas=localhost:5000", nil},
+		{"longhorn/a/b?replicas=localhost:5000", nil},
+		// no replica
+		{"longhorn/vol1", nil},
+		{"longhorn/vol1?timeout=5", nil},
+		{"longhorn/vol1?replicas=", nil},
+		{"longhorn/vol1?replicas=localhost:5000,", nil},
+		{"longhorn/vol1?replicas=localhost", nil},
+		{"longhorn/vol1?replicas=:5000", nil},
+		{"longhorn/vol1?replicas=localhost:0", nil},
+		{"longhorn/vol1?replicas=localhost:65536", nil},
+		{"longhorn/vol1?replicas=localhost:5000&replicas=localhost:5001", nil},
+		// bad timeout
+		{"longhorn/vol1?replicas=localhost:5000&timeout=", nil},
+		{"longhorn/vol1?replicas=localhost:5000&timeout=0", nil},
+		{"longhorn/vol1?replicas=localhost:5000&timeout=-1", nil},
+		{"longhorn/vol1?replicas=localhost:5000&timeout=5s", nil},
+		// bad queue depth
+		{"longhorn/vol1?replicas=localhost:5000&queue_depth=0", nil},
+		{"longhorn/vol1?replicas=localhost:5000&queue_depth=many", nil},
+		// unknown option
+		{"longhorn/vol1?replicas=localhost:5000&size=1024", nil},
+		{"longhorn/vol1?replicas=localhost:5000;timeout=5", nil},
+		{"longhorn/vol1?replicas=localhost:5000&timeout=%zz", nil},
+	}
+	for _, c := range cases {
+		cfg, err := Parse(c.cfgString)
+		if c.expected == nil {
+			if err == nil {
+				t.Fatalf("Invalid configuration %v parsed as %+v", c.cfgString, cfg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Fail to parse configuration %v: %v", c.cfgString, err)
+		}
+		if !reflect.DeepEqual(cfg, c.expected) {
+			t.Fatalf("Configuration %v parsed as %+v, expected %+v", c.cfgString, cfg, c.expected)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package tcmu
+
+import (
+	"github.com/yasker/longhorn/frontend/tcmu/ring"
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/util"
+)
+
+// TCMU doesn't tell which initiator sent the command, so all of them are seen
+// as one I_T nexus, and the device refuses the persistent reservations which
+// couldn't keep any of them out
+const tcmuNexus = "tcmu"
+
+// handleCommand copies cmd in and out of the iovec of TCMU, the command
+// itself is executed by the SCSI emulation of the device.
+func (s *TcmuState) handleCommand(command ring.Command) int {
+	cmd := command.(TcmuCommand)
+	opcode := CmdGetScsiCmd(cmd)
+	cdbLength := scsi.CDBLength(opcode)
+	if cdbLength == 0 {
+		log.Errorf("unknown command 0x%x", opcode)
+		return CmdSetInvalidOpcode(cmd)
+	}
+	cdb := CmdGetCdb(cmd, cdbLength)
+
+	length := CmdGetIovecLength(cmd)
+	var dataOut []byte
+	if scsi.IsDataOut(cdb[0]) && length != 0 {
+		dataOut = util.GetBuffer(length)
+		defer util.PutBuffer(dataOut)
+		if copied := CmdMemcpyFromIovec(cmd, dataOut, length); copied != length {
+			log.Errorln("write failed: unable to complete buffer copy ")
+			return CmdSetSense(cmd, scsi.BuildSense(scsi.MEDIUM_ERROR, scsi.ASC_WRITE_ERROR))
+		}
+	}
+
+	status, dataIn, sense := s.device.HandleCommand(tcmuNexus, cdb, dataOut)
+	defer util.PutBuffer(dataIn)
+	if status == scsi.SAM_STAT_CHECK_CONDITION {
+		return CmdSetSense(cmd, sense)
+	}
+	if len(dataIn) > length {
+		dataIn = dataIn[:length]
+	}
+	if len(dataIn) != 0 {
+		if copied := CmdMemcpyIntoIovec(cmd, dataIn, len(dataIn)); copied != len(dataIn) {
+			log.Errorln("read failed: unable to complete buffer copy ")
+			return CmdSetSense(cmd, scsi.BuildSense(scsi.MEDIUM_ERROR, scsi.ASC_READ_ERROR))
+		}
+	}
+	return int(status)
+}
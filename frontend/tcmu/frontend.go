@@ -0,0 +1,289 @@
+package tcmu
+
+/*
+#cgo LDFLAGS: -L ./libs -ltcmu
+#cgo CFLAGS: -I ./includes
+
+#include <errno.h>
+#include <stdlib.h>
+#include <scsi/scsi.h>
+#include "libtcmu.h"
+
+extern struct tcmulib_context *tcmu_init();
+extern int tcmu_poll_master_fd(struct tcmulib_context *cxt, int stop_fd);
+extern int tcmu_wait_for_next_command(struct tcmu_device *dev, int stop_fd, int wake_fd);
+
+*/
+import "C"
+import "unsafe"
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/frontend/tcmu/config"
+	"github.com/yasker/longhorn/frontend/tcmu/ring"
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/types"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "tcmu"})
+
+	// libtcmu callbacks go to the frontend started in this process
+	frontend *Frontend
+)
+
+// Frontend serves all the Longhorn TCMU devices on the host, see config.Config for
+// how the volume of each device is specified.
+type Frontend struct {
+	openVolume types.VolumeOpener
+	cxt        *C.struct_tcmulib_context
+
+	// states of all the devices this process serves, keyed by the handle
+	// stored in the private data of each tcmu_device
+	states      map[int64]*TcmuState
+	statesMutex *sync.Mutex
+	lastHandle  int64
+
+	// closing masterStopFds[1] stops pollMasterFd, which closes
+	// masterStopped when returns
+	masterStopFds [2]int
+	masterStopped chan struct{}
+}
+
+type TcmuState struct {
+	volume types.Volume
+	device *scsi.Device
+	dev    TcmuDevice
+
+	handle    int64
+	name      string
+	timeout   int
+	processor *ring.Processor
+}
+
+// tcmuRing is the command ring of a TCMU device
+type tcmuRing struct {
+	dev TcmuDevice
+}
+
+func (r *tcmuRing) Start() {
+	C.tcmulib_processing_start(r.dev)
+}
+
+func (r *tcmuRing) Next() ring.Command {
+	cmd := C.tcmulib_get_next_command(r.dev)
+	if cmd == nil {
+		return nil
+	}
+	return TcmuCommand(cmd)
+}
+
+func (r *tcmuRing) Complete(cmd ring.Command, status int) {
+	C.tcmulib_command_complete(r.dev, cmd.(TcmuCommand), C.int(status))
+}
+
+func (r *tcmuRing) Done() {
+	C.tcmulib_processing_complete(r.dev)
+}
+
+func (r *tcmuRing) Wait(stopFd, wakeFd int) int {
+	return int(C.tcmu_wait_for_next_command(r.dev, C.int(stopFd), C.int(wakeFd)))
+}
+
+func New(openVolume types.VolumeOpener) *Frontend {
+	return &Frontend{
+		openVolume:  openVolume,
+		states:      make(map[int64]*TcmuState),
+		statesMutex: &sync.Mutex{},
+	}
+}
+
+func (f *Frontend) Startup() error {
+	if frontend != nil {
+		return fmt.Errorf("TCMU frontend has already been started")
+	}
+	frontend = f
+
+	f.cxt = C.tcmu_init()
+	if f.cxt == nil {
+		return fmt.Errorf("Fail to initialize libtcmu")
+	}
+
+	if err := syscall.Pipe(f.masterStopFds[:]); err != nil {
+		return fmt.Errorf("Cannot create pipe: %v", err)
+	}
+	f.masterStopped = make(chan struct{})
+	go f.pollMasterFd()
+	return nil
+}
+
+// pollMasterFd keeps servicing the master fd, so devices can be added and
+// removed at any time. The devices' added and removed callbacks are called
+// from here.
+func (f *Frontend) pollMasterFd() {
+	defer close(f.masterStopped)
+
+	// libtcmu expects to always be called from the same thread
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	for {
+		result := C.tcmu_poll_master_fd(f.cxt, C.int(f.masterStopFds[0]))
+		if result == 1 {
+			break
+		}
+		log.Debugln("Poll master fd one more time, last result ", result)
+	}
+}
+
+// Shutdown stops accepting new devices, then stops all the devices in
+// parallel, each of them waits for its in-flight commands up to timeout, then
+// aborts them.
+func (f *Frontend) Shutdown(timeout time.Duration) error {
+	syscall.Close(f.masterStopFds[1])
+	<-f.masterStopped
+	syscall.Close(f.masterStopFds[0])
+
+	f.statesMutex.Lock()
+	stopping := f.states
+	f.states = make(map[int64]*TcmuState)
+	f.statesMutex.Unlock()
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(stopping))
+	for _, state := range stopping {
+		go func(state *TcmuState) {
+			defer wg.Done()
+			state.Stop(timeout)
+			DevSetHandle(state.dev, 0)
+			log.Infof("Volume %v stopped", state.name)
+		}(state)
+	}
+	wg.Wait()
+
+	C.tcmulib_close(f.cxt)
+	return nil
+}
+
+func (f *Frontend) getState(dev TcmuDevice) *TcmuState {
+	f.statesMutex.Lock()
+	defer f.statesMutex.Unlock()
+	return f.states[DevGetHandle(dev)]
+}
+
+//export shOpen
+func shOpen(dev TcmuDevice) int {
+	var (
+		err error
+	)
+
+	state := &TcmuState{}
+	blockSizeStr := C.CString("hw_block_size")
+	defer C.free(unsafe.Pointer(blockSizeStr))
+	blockSize := int(C.tcmu_get_attribute(dev, blockSizeStr))
+	if blockSize == -1 {
+		log.Errorln("Cannot find valid hw_block_size")
+		return -C.EINVAL
+	}
+
+	size := int64(C.tcmu_get_device_size(dev))
+	if size == -1 {
+		log.Errorln("Cannot find valid disk size")
+		return -C.EINVAL
+	}
+
+	cfgString := C.GoString(C.tcmu_get_dev_cfgstring(dev))
+	if cfgString == "" {
+		log.Errorln("Cannot find configuration string")
+		return -C.EINVAL
+	}
+	cfg, err := config.Parse(cfgString)
+	if err != nil {
+		log.Errorln("Invalid configuration string: ", err)
+		return -C.EINVAL
+	}
+	state.name = cfg.Volume
+	state.timeout = cfg.Timeout
+
+	state.volume, err = frontend.openVolume(cfg.Volume, size, cfg.Replicas, cfg.Timeout)
+	if err != nil {
+		log.Errorf("Cannot open volume %v: %v", cfg.Volume, err)
+		return -C.EIO
+	}
+	state.device, err = scsi.NewDevice(cfg.Volume, state.volume, blockSize)
+	if err != nil {
+		log.Errorf("Cannot create SCSI device for volume %v: %v", cfg.Volume, err)
+		state.volume.Close()
+		return -C.EIO
+	}
+	state.device.DisableReservations()
+	state.dev = dev
+
+	state.processor, err = ring.NewProcessor(cfg.Volume, &tcmuRing{dev}, state.handleCommand,
+		state.volume, cfg.QueueDepth)
+	if err != nil {
+		log.Errorf("Cannot process commands of volume %v: %v", cfg.Volume, err)
+		state.volume.Close()
+		return -C.EIO
+	}
+
+	state.handle = atomic.AddInt64(&frontend.lastHandle, 1)
+	frontend.statesMutex.Lock()
+	frontend.states[state.handle] = state
+	frontend.statesMutex.Unlock()
+	DevSetHandle(dev, state.handle)
+
+	go state.processor.Run()
+
+	log.Debugf("Device added for volume %v with replicas %v, %v goroutines running",
+		cfg.Volume, cfg.Replicas, runtime.NumGoroutine())
+	return 0
+}
+
+// Stop stops the device, see ring.Processor.Stop. The device may be freed
+// once it returns.
+func (s *TcmuState) Stop(timeout time.Duration) {
+	s.processor.Stop(timeout)
+}
+
+//export shCheckConfig
+func shCheckConfig(cfgString *C.char, reason **C.char) C.bool {
+	if _, err := config.Parse(C.GoString(cfgString)); err != nil {
+		// libtcmu would free() the reason
+		*reason = C.CString(err.Error())
+		return false
+	}
+	return true
+}
+
+//export shClose
+func shClose(dev TcmuDevice) {
+	if DevGetHandle(dev) == 0 {
+		log.Debugln("Device removed, it has been stopped already")
+		return
+	}
+	state := frontend.getState(dev)
+	if state == nil {
+		log.Errorln("Cannot find state of the removed device")
+		return
+	}
+
+	frontend.statesMutex.Lock()
+	delete(frontend.states, state.handle)
+	frontend.statesMutex.Unlock()
+
+	// the device would be gone after we return, so stop using it now
+	state.Stop(time.Duration(state.timeout) * time.Second)
+	DevSetHandle(dev, 0)
+
+	log.Debugf("Device removed for volume %v, %v goroutines running",
+		state.name, runtime.NumGoroutine())
+}
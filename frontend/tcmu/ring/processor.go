@@ -0,0 +1,212 @@
+// Package ring processes the commands of a command ring, such as the one of
+// a TCMU device, with no cgo involved so it can be tested on its own.
+package ring
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/types"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "ring"})
+)
+
+// Command is a command of a Ring, only the ring and the handler look into it
+type Command interface{}
+
+// Ring is the command ring of a device, it's only used by Processor.Run
+type Ring interface {
+	// Start is called before taking the commands received
+	Start()
+	// Next returns the next command received, or nil if there's none
+	Next() Command
+	// Complete completes cmd with the SCSI status
+	Complete(cmd Command, status int)
+	// Done tells the device about the commands completed since Start
+	Done()
+	// Wait waits for the next command, or for stopFd or wakeFd to be
+	// readable. It returns 1 once stopFd is, 0 otherwise, or a negative
+	// errno.
+	Wait(stopFd, wakeFd int) int
+}
+
+// Handler handles cmd and returns its SCSI status
+type Handler func(cmd Command) int
+
+// Processor handles each command of the ring in a goroutine of its own, up
+// to the queue depth, and completes it in Run, along with the others handled
+// meanwhile.
+type Processor struct {
+	name       string
+	ring       Ring
+	handler    Handler
+	volume     types.Volume
+	queueDepth int
+
+	// the results of the commands handled, Run is woken up by wakeFds to
+	// complete them, unless woken is set already
+	completions chan completion
+	wakeFds     [2]int
+	woken       int32
+	handlers    *sync.WaitGroup
+
+	// closing stopFds[1] stops Run, which closes stopped when all the
+	// commands it started are completed
+	stopFds [2]int
+	stopped chan struct{}
+}
+
+type completion struct {
+	cmd    Command
+	status int
+}
+
+// NewProcessor makes the processor of the ring of the device of volume name
+func NewProcessor(name string, ring Ring, handler Handler, volume types.Volume, queueDepth int) (*Processor, error) {
+	p := &Processor{
+		name:        name,
+		ring:        ring,
+		handler:     handler,
+		volume:      volume,
+		queueDepth:  queueDepth,
+		completions: make(chan completion, queueDepth),
+		handlers:    &sync.WaitGroup{},
+		stopped:     make(chan struct{}),
+	}
+	if err := syscall.Pipe(p.stopFds[:]); err != nil {
+		return nil, fmt.Errorf("Cannot create pipe: %v", err)
+	}
+	if err := syscall.Pipe2(p.wakeFds[:], syscall.O_NONBLOCK); err != nil {
+		syscall.Close(p.stopFds[0])
+		syscall.Close(p.stopFds[1])
+		return nil, fmt.Errorf("Cannot create pipe: %v", err)
+	}
+	return p, nil
+}
+
+// Run is the only one using the ring, until Stop
+func (p *Processor) Run() {
+	defer close(p.stopped)
+
+	inflight := 0
+	for true {
+		p.ring.Start()
+		p.clearWake()
+		inflight -= p.completeHandled()
+		for cmd := p.ring.Next(); cmd != nil; cmd = p.ring.Next() {
+			for inflight >= p.queueDepth {
+				p.complete(<-p.completions)
+				inflight--
+			}
+			p.start(cmd)
+			inflight++
+		}
+		p.ring.Done()
+
+		ret := p.ring.Wait(p.stopFds[0], p.wakeFds[0])
+		if ret == 1 {
+			break
+		}
+		if ret != 0 {
+			log.Errorln("Fail to wait for next command", ret)
+			break
+		}
+	}
+
+	// no more new commands, those received already but not started are
+	// aborted, and those in flight are waited for
+	p.ring.Start()
+	for cmd := p.ring.Next(); cmd != nil; cmd = p.ring.Next() {
+		p.ring.Complete(cmd, scsi.SAM_STAT_TASK_ABORTED)
+	}
+	for ; inflight > 0; inflight-- {
+		p.complete(<-p.completions)
+	}
+	p.ring.Done()
+	p.handlers.Wait()
+}
+
+// Stop stops taking new commands and waits for the commands already started
+// to complete, then flushes the volume, all within timeout. Otherwise the
+// volume operations still outstanding are aborted by closing the volume, and
+// their commands are completed with error. It returns only once Run and all
+// the handlers are done, the ring may be freed afterwards.
+func (p *Processor) Stop(timeout time.Duration) {
+	syscall.Close(p.stopFds[1])
+
+	// one deadline for both the drain and the flush
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case <-p.stopped:
+		flushed := make(chan error, 1)
+		go func() {
+			flushed <- p.volume.Flush()
+		}()
+		select {
+		case err := <-flushed:
+			if err != nil {
+				log.Errorf("Fail to flush volume %v: %v", p.name, err)
+			}
+			p.volume.Close()
+		case <-deadline.C:
+			log.Errorf("Timeout flushing volume %v, abort it", p.name)
+			p.volume.Close()
+		}
+	case <-deadline.C:
+		log.Errorf("Timeout waiting for in-flight commands of volume %v, abort them", p.name)
+		p.volume.Close()
+		<-p.stopped
+	}
+	syscall.Close(p.stopFds[0])
+	syscall.Close(p.wakeFds[0])
+	syscall.Close(p.wakeFds[1])
+}
+
+// start handles cmd in a goroutine, its result is sent to completions
+func (p *Processor) start(cmd Command) {
+	p.handlers.Add(1)
+	go func() {
+		defer p.handlers.Done()
+		p.completions <- completion{cmd, p.handler(cmd)}
+		if atomic.CompareAndSwapInt32(&p.woken, 0, 1) {
+			syscall.Write(p.wakeFds[1], []byte{0})
+		}
+	}()
+}
+
+// clearWake empties wakeFds, the results sent to completions afterwards would
+// wake up Run again
+func (p *Processor) clearWake() {
+	var buf [64]byte
+	for {
+		if n, _ := syscall.Read(p.wakeFds[0], buf[:]); n < len(buf) {
+			break
+		}
+	}
+	atomic.StoreInt32(&p.woken, 0)
+}
+
+// completeHandled completes the commands handled so far, and returns how many
+func (p *Processor) completeHandled() int {
+	for n := 0; ; n++ {
+		select {
+		case c := <-p.completions:
+			p.complete(c)
+		default:
+			return n
+		}
+	}
+}
+
+func (p *Processor) complete(c completion) {
+	p.ring.Complete(c.cmd, c.status)
+}
@@ -0,0 +1,190 @@
+package ring
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/types"
+)
+
+// testRing takes the commands pushed, notifyFds wakes up Wait for them
+type testRing struct {
+	mutex     *sync.Mutex
+	pending   []Command
+	completed map[Command]int
+	notifyFds [2]int
+}
+
+func newTestRing(t *testing.T) *testRing {
+	r := &testRing{
+		mutex:     &sync.Mutex{},
+		completed: make(map[Command]int),
+	}
+	if err := syscall.Pipe2(r.notifyFds[:], syscall.O_NONBLOCK); err != nil {
+		t.Fatal("Fail to create pipe: ", err)
+	}
+	return r
+}
+
+func (r *testRing) close() {
+	syscall.Close(r.notifyFds[0])
+	syscall.Close(r.notifyFds[1])
+}
+
+// push adds cmd to the ring, Wait is woken up for it if notify
+func (r *testRing) push(cmd Command, notify bool) {
+	r.mutex.Lock()
+	r.pending = append(r.pending, cmd)
+	r.mutex.Unlock()
+	if notify {
+		syscall.Write(r.notifyFds[1], []byte{0})
+	}
+}
+
+func (r *testRing) status(cmd Command) (int, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status, ok := r.completed[cmd]
+	return status, ok
+}
+
+func (r *testRing) Start() {}
+
+func (r *testRing) Next() Command {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.pending) == 0 {
+		return nil
+	}
+	cmd := r.pending[0]
+	r.pending = r.pending[1:]
+	return cmd
+}
+
+func (r *testRing) Complete(cmd Command, status int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.completed[cmd] = status
+}
+
+func (r *testRing) Done() {}
+
+func (r *testRing) Wait(stopFd, wakeFd int) int {
+	fds := []unix.PollFd{
+		{Fd: int32(stopFd), Events: unix.POLLIN},
+		{Fd: int32(wakeFd), Events: unix.POLLIN},
+		{Fd: int32(r.notifyFds[0]), Events: unix.POLLIN},
+	}
+	if _, err := unix.Poll(fds, -1); err != nil && err != unix.EINTR {
+		return -int(err.(syscall.Errno))
+	}
+	if fds[0].Revents != 0 {
+		return 1
+	}
+	var buf [64]byte
+	syscall.Read(r.notifyFds[0], buf[:])
+	return 0
+}
+
+// testVolume only flushes and closes, the handlers wait for closed if stuck
+type testVolume struct {
+	types.Volume
+	flushed bool
+	closed  chan struct{}
+}
+
+func (v *testVolume) Flush() error {
+	v.flushed = true
+	return nil
+}
+
+func (v *testVolume) Close() error {
+	close(v.closed)
+	return nil
+}
+
+func TestProcessorStop(t *testing.T) {
+	r := newTestRing(t)
+	defer r.close()
+	volume := &testVolume{closed: make(chan struct{})}
+	p, err := NewProcessor("test", r, func(cmd Command) int {
+		return scsi.SAM_STAT_GOOD
+	}, volume, 2)
+	if err != nil {
+		t.Fatal("Fail to create processor: ", err)
+	}
+	go p.Run()
+
+	for i := 0; i < 8; i++ {
+		r.push(i, true)
+	}
+	for i := 0; i < 8; i++ {
+		for {
+			if _, ok := r.status(i); ok {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	p.Stop(time.Second)
+	if !volume.flushed {
+		t.Fatal("Volume is not flushed")
+	}
+	select {
+	case <-volume.closed:
+	default:
+		t.Fatal("Volume is not closed")
+	}
+}
+
+// TestProcessorStopTimeout checks a handler stuck past the timeout is
+// aborted by closing the volume, and Stop still waits for it and for its
+// command to be completed. The command not started yet is aborted.
+func TestProcessorStopTimeout(t *testing.T) {
+	r := newTestRing(t)
+	defer r.close()
+	volume := &testVolume{closed: make(chan struct{})}
+	started := make(chan struct{})
+	finished := false
+	p, err := NewProcessor("test", r, func(cmd Command) int {
+		close(started)
+		<-volume.closed
+		finished = true
+		return scsi.SAM_STAT_CHECK_CONDITION
+	}, volume, 2)
+	if err != nil {
+		t.Fatal("Fail to create processor: ", err)
+	}
+	go p.Run()
+
+	r.push("stuck", true)
+	<-started
+	// received but never noticed by Run before it's stopped
+	r.push("pending", false)
+
+	begin := time.Now()
+	timeout := 100 * time.Millisecond
+	p.Stop(timeout)
+	if time.Since(begin) < timeout {
+		t.Fatal("Stop returned before its timeout while a handler is stuck")
+	}
+	if !finished {
+		t.Fatal("Stop returned while a handler is still running")
+	}
+	if status, ok := r.status("stuck"); !ok || status != scsi.SAM_STAT_CHECK_CONDITION {
+		t.Fatalf("Stuck command completed %v with %v, expected %v", ok, status,
+			scsi.SAM_STAT_CHECK_CONDITION)
+	}
+	if status, ok := r.status("pending"); !ok || status != scsi.SAM_STAT_TASK_ABORTED {
+		t.Fatalf("Pending command completed %v with %v, expected %v", ok, status,
+			scsi.SAM_STAT_TASK_ABORTED)
+	}
+	if volume.flushed {
+		t.Fatal("Volume is flushed after the timeout")
+	}
+}
@@ -0,0 +1,78 @@
+package replica
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	BACKEND_BUFFERED = "buffered"
+	BACKEND_DIRECT   = "direct"
+	BACKEND_IO_URING = "io_uring"
+	// see NewMemory, it has no file
+	BACKEND_MEMORY = "memory"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "replica"})
+
+	// the backends of files and block devices
+	Backends = []string{BACKEND_BUFFERED, BACKEND_DIRECT, BACKEND_IO_URING}
+)
+
+// Backend stores the data of a replica. Reads beyond the end return io.EOF,
+// like os.File.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+	// Flush makes the writes completed so far durable
+	Flush() error
+	// Discard makes the range read as zeroes, and frees its space
+	Discard(offset, length int64) error
+	Size() (int64, error)
+	Close() error
+}
+
+// Open opens the file or the block device at path, which exists already, for
+// the I/O through the backend of the name
+func Open(name, path string) (Backend, error) {
+	switch name {
+	case BACKEND_BUFFERED:
+		return openBuffered(path)
+	case BACKEND_DIRECT:
+		return openDirect(path)
+	case BACKEND_IO_URING:
+		return openUring(path)
+	}
+	return nil, fmt.Errorf("Unknown backend %v, it should be one of %v", name, Backends)
+}
+
+// bufferedBackend goes through the page cache, the data is written back by
+// the kernel unless flushed
+type bufferedBackend struct {
+	*disk
+}
+
+func openBuffered(path string) (Backend, error) {
+	d, err := openDisk(path, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedBackend{d}, nil
+}
+
+func (b *bufferedBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	return b.file.ReadAt(buf, offset)
+}
+
+func (b *bufferedBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	return b.file.WriteAt(buf, offset)
+}
+
+// copyRange lets the kernel copy the data itself, see copyRange
+func (b *bufferedBackend) copyRange(offset, source, length int64) (int64, error) {
+	return copyFileRange(b.file, offset, b.file, source, length)
+}
@@ -0,0 +1,73 @@
+package replica
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	benchmarkSize        = int64(256 * 1024 * 1024)
+	benchmarkRequestSize = 4096
+	benchmarkWorkers     = 16
+)
+
+// BenchmarkBackend does random writes, then random reads, through each
+// backend on the same temporary file, with the workers in parallel. Set
+// TMPDIR to benchmark another filesystem, direct I/O isn't supported by
+// tmpfs.
+func BenchmarkBackend(b *testing.B) {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		b.Fatal("Fail to create temporary directory: ", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "disk.img")
+	if err := util.FindOrCreateDisk(path, benchmarkSize); err != nil {
+		b.Fatal("Fail to create disk: ", err)
+	}
+
+	for _, name := range Backends {
+		b.Run(name, func(b *testing.B) {
+			backend, err := Open(name, path)
+			if err != nil {
+				b.Skipf("Backend %v is not supported: %v", name, err)
+			}
+			defer backend.Close()
+
+			b.Run("write", func(b *testing.B) {
+				benchmarkIO(b, backend.WriteAt)
+			})
+			if err := backend.Flush(); err != nil {
+				b.Fatal("Fail to flush: ", err)
+			}
+			b.Run("read", func(b *testing.B) {
+				benchmarkIO(b, backend.ReadAt)
+			})
+		})
+	}
+}
+
+func benchmarkIO(b *testing.B, op func(buf []byte, offset int64) (int, error)) {
+	blocks := benchmarkSize / benchmarkRequestSize
+	b.SetBytes(benchmarkRequestSize)
+	b.SetParallelism((benchmarkWorkers + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		// aligned, so direct doesn't bounce the requests
+		pooled, buf := util.GetAlignedBuffer(benchmarkRequestSize, 4096)
+		defer util.PutBuffer(pooled)
+		for pb.Next() {
+			offset := random.Int63n(blocks) * benchmarkRequestSize
+			if _, err := op(buf, offset); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
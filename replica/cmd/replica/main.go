@@ -0,0 +1,224 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/replica"
+	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	port     = ":5000"
+	filename = "test.img"
+	size     = 1073741824
+	// the newest controller epoch seen
+	epochFile = filename + ".epoch"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "replica"})
+
+	disk        = flag.String("disk", filename, "the file, created if missing, or the block device storing the data")
+	backendName = flag.String("backend", replica.BACKEND_BUFFERED, fmt.Sprintf("how the disk file is accessed, one of %v, or %v to keep the data in memory instead", replica.Backends, replica.BACKEND_MEMORY))
+	memoryLimit = flag.Int64("memory-limit", 0, "the most memory the data may take with the memory backend, in bytes, 0 for no limit")
+
+	metadataName = regexp.MustCompile("^[a-z0-9_-]+$")
+
+	// the metadata files, kept in memory instead with the memory backend
+	memoryFiles      map[string][]byte
+	memoryFilesMutex = &sync.Mutex{}
+)
+
+// metadata is kept in the files next to the default disk file, even if the
+// data is elsewhere
+func metadataPath(name string) (string, error) {
+	if !metadataName.MatchString(name) {
+		return "", fmt.Errorf("Invalid metadata name %v", name)
+	}
+	return filename + "." + name + ".meta", nil
+}
+
+// readMetadata returns empty value if the metadata was never written
+func readMetadata(name string) ([]byte, error) {
+	path, err := metadataPath(name)
+	if err != nil {
+		return nil, err
+	}
+	value, err := readFile(path)
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+	return value, err
+}
+
+// writeMetadata replaces the metadata atomically, it's durable when returns
+func writeMetadata(name string, value []byte) error {
+	path, err := metadataPath(name)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, value)
+}
+
+func readFile(path string) ([]byte, error) {
+	if memoryFiles == nil {
+		return ioutil.ReadFile(path)
+	}
+	memoryFilesMutex.Lock()
+	defer memoryFilesMutex.Unlock()
+	value, ok := memoryFiles[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte{}, value...), nil
+}
+
+func writeFile(path string, value []byte) error {
+	if memoryFiles != nil {
+		memoryFilesMutex.Lock()
+		defer memoryFilesMutex.Unlock()
+		memoryFiles[path] = append([]byte{}, value...)
+		return nil
+	}
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readEpoch returns the newest controller epoch seen, so the fence survives
+// restarts of the replica
+func readEpoch() (int64, error) {
+	value, err := readFile(epochFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+func writeEpoch(epoch int64) error {
+	return writeFile(epochFile, []byte(strconv.FormatInt(epoch, 10)))
+}
+
+// metadataHandler answers the metadata requests, and passes the others to
+// handler
+func metadataHandler(handler rpc.RequestHandler) rpc.RequestHandler {
+	return func(req *rpc.Request) (*rpc.Response, error) {
+		if req.Header.Type == rpc.MSG_TYPE_READ_METADATA_REQUEST {
+			name, _ := rpc.DecodeMetadata(req.Data)
+			value, err := readMetadata(name)
+			if err != nil {
+				log.Errorln("read metadata failed: ", err.Error())
+				return nil, err
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_READ_METADATA_RESPONSE,
+					Length: int64(len(value)),
+					Result: "Success",
+				},
+				Data: value,
+			}, nil
+		}
+		if req.Header.Type == rpc.MSG_TYPE_WRITE_METADATA_REQUEST {
+			name, value := rpc.DecodeMetadata(req.Data)
+			if err := writeMetadata(name, value); err != nil {
+				log.Errorln("write metadata failed: ", err.Error())
+				return nil, err
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_WRITE_METADATA_RESPONSE,
+					Result: "Success",
+				},
+			}, nil
+		}
+		return handler(req)
+	}
+}
+
+func openBackend() replica.Backend {
+	if *backendName == replica.BACKEND_MEMORY {
+		log.Infof("Serving %v bytes from memory, limited to %v bytes", size, *memoryLimit)
+		memoryFiles = make(map[string][]byte)
+		return replica.NewMemory(size, *memoryLimit)
+	}
+
+	if err := util.FindOrCreateDisk(*disk, size); err != nil {
+		log.Fatalf("Fail to find or create disk: %v", err)
+	}
+	backend, err := replica.Open(*backendName, *disk)
+	if err != nil {
+		log.Fatalf("Fail to open disk file: %v", err)
+	}
+	diskSize, err := backend.Size()
+	if err != nil {
+		log.Fatalf("Fail to get disk size: %v", err)
+	}
+	if diskSize < size {
+		log.Fatalf("Disk %v has %v bytes, less than the %v of the volume", *disk, diskSize, size)
+	}
+	log.Infof("Serving %v of %v bytes through the %v backend", *disk, diskSize, *backendName)
+	return backend
+}
+
+func main() {
+	logrus.SetLevel(logrus.DebugLevel)
+	flag.Parse()
+
+	addr, err := net.ResolveTCPAddr("tcp4", port)
+	if err != nil {
+		log.Fatalf("failed to resolve %v: %v", port, err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen to: %v", err)
+	}
+
+	backend := openBackend()
+
+	epoch, err := readEpoch()
+	if err != nil {
+		log.Fatalf("Fail to read controller epoch: %v", err)
+	}
+	fence := rpc.NewFence(epoch, writeEpoch)
+	handler := metadataHandler(replica.Handler(backend))
+
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			log.Errorf("failed to accept connection %v", err)
+			continue
+		}
+		server := rpc.NewServer(conn, 128, fence.Handler(handler))
+		server.Start()
+	}
+}
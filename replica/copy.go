@@ -0,0 +1,113 @@
+package replica
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// the most copy_file_range(2) is asked to copy at once
+	maxCopyFileRange = 1024 * 1024 * 1024
+	// the chunk size when the data has to be copied through memory
+	copyBufferSize = 1024 * 1024
+)
+
+// rangeCopier is a backend which can copy within itself without the data
+// going through memory, it returns how many bytes have been copied when it
+// fails
+type rangeCopier interface {
+	copyRange(offset, source, length int64) (int64, error)
+}
+
+// copyRange copies length bytes at source to offset within the backend, the
+// ranges may overlap. With the page cache, the kernel copies the data itself
+// with copy_file_range(2), which may even share the extents on filesystems
+// supporting reflinks. Otherwise, e.g. the kernel is too old or the ranges
+// overlap, the data is copied through memory.
+func copyRange(backend Backend, offset, source, length int64) error {
+	if offset == source || length == 0 {
+		return nil
+	}
+	copier, ok := backend.(rangeCopier)
+	if ok && (offset+length <= source || source+length <= offset) {
+		done, err := copier.copyRange(offset, source, length)
+		if err == nil {
+			return nil
+		}
+		if !copyFileRangeUnusable(err) {
+			return err
+		}
+		log.Debugf("copy_file_range is not usable, copy through memory: %v", err)
+		offset += done
+		source += done
+		length -= done
+	}
+	return copyBuffered(backend, offset, source, length)
+}
+
+func copyFileRangeUnusable(err error) bool {
+	return err == unix.ENOSYS || err == unix.EXDEV || err == unix.EINVAL ||
+		err == unix.EOPNOTSUPP
+}
+
+// copyFileRange returns how many bytes have been copied when it fails
+func copyFileRange(dst *os.File, offset int64, src *os.File, source, length int64) (int64, error) {
+	done := int64(0)
+	for done < length {
+		size := length - done
+		if size > maxCopyFileRange {
+			size = maxCopyFileRange
+		}
+		roff, woff := source+done, offset+done
+		n, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, int(size), 0)
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			// the source is beyond the end of file
+			return done, io.ErrUnexpectedEOF
+		}
+		done += int64(n)
+	}
+	return done, nil
+}
+
+// copyBuffered copies backwards if the destination overlaps the end of the
+// source, so no source data is overwritten before it's copied
+func copyBuffered(backend Backend, offset, source, length int64) error {
+	backward := offset > source && offset < source+length
+
+	size := int64(copyBufferSize)
+	if size > length {
+		size = length
+	}
+	buf := util.GetBuffer(int(size))
+	defer util.PutBuffer(buf)
+	for done := int64(0); done < length; {
+		n := length - done
+		if n > size {
+			n = size
+		}
+		pos := done
+		if backward {
+			pos = length - done - n
+		}
+		read, err := backend.ReadAt(buf[:n], source+pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// beyond the end of file
+		for i := int64(read); i < n; i++ {
+			buf[i] = 0
+		}
+		if _, err := backend.WriteAt(buf[:n], offset+pos); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package replica
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// O_DIRECT needs the offsets, the lengths and the buffers aligned to the
+	// logical block size of the device, a page covers all of them
+	directAlignment = 4096
+)
+
+// directBackend bypasses the page cache with O_DIRECT. The requests not
+// aligned go through aligned buffers from the pool, the writes are read,
+// modified and written back then.
+type directBackend struct {
+	*disk
+	// the writes sharing blocks are done one after another, so a block
+	// read to be modified isn't written meanwhile
+	writes *util.RangeLock
+}
+
+func openDirect(path string) (Backend, error) {
+	d, err := openDisk(path, os.O_RDWR|syscall.O_DIRECT)
+	if err != nil {
+		return nil, err
+	}
+	return &directBackend{
+		disk:   d,
+		writes: util.NewRangeLock(),
+	}, nil
+}
+
+func isAligned(buf []byte, offset int64) bool {
+	return offset%directAlignment == 0 && len(buf)%directAlignment == 0 &&
+		(len(buf) == 0 || uintptr(unsafe.Pointer(&buf[0]))%directAlignment == 0)
+}
+
+// alignedBlocks returns the range of whole blocks covering the request
+func alignedBlocks(offset int64, length int) (int64, int64) {
+	start := offset / directAlignment * directAlignment
+	end := (offset + int64(length) + directAlignment - 1) / directAlignment * directAlignment
+	return start, end
+}
+
+func (b *directBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	if isAligned(buf, offset) {
+		return b.file.ReadAt(buf, offset)
+	}
+	start, end := alignedBlocks(offset, len(buf))
+	pooled, aligned := util.GetAlignedBuffer(int(end-start), directAlignment)
+	defer util.PutBuffer(pooled)
+
+	n, err := b.file.ReadAt(aligned, start)
+	skip := int(offset - start)
+	if n <= skip {
+		return 0, err
+	}
+	n = copy(buf, aligned[skip:n])
+	if n == len(buf) {
+		err = nil
+	}
+	return n, err
+}
+
+func (b *directBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	start, end := alignedBlocks(offset, len(buf))
+	hold := b.writes.Hold(util.Range{Start: start, End: end})
+	hold.Wait()
+	defer hold.Release()
+
+	if isAligned(buf, offset) {
+		return b.file.WriteAt(buf, offset)
+	}
+	pooled, aligned := util.GetAlignedBuffer(int(end-start), directAlignment)
+	defer util.PutBuffer(pooled)
+	if start != offset || end != offset+int64(len(buf)) {
+		n, err := b.file.ReadAt(aligned, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		// beyond the end of file
+		for i := n; i < len(aligned); i++ {
+			aligned[i] = 0
+		}
+	}
+	copy(aligned[offset-start:], buf)
+	if _, err := b.file.WriteAt(aligned, start); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (b *directBackend) Discard(offset, length int64) error {
+	start, end := alignedBlocks(offset, int(length))
+	hold := b.writes.Hold(util.Range{Start: start, End: end})
+	hold.Wait()
+	defer hold.Release()
+	return b.disk.Discard(offset, length)
+}
@@ -0,0 +1,147 @@
+package replica
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// from linux/falloc.h
+	FALLOC_FL_KEEP_SIZE  = 0x01
+	FALLOC_FL_PUNCH_HOLE = 0x02
+
+	// from linux/fs.h
+	BLKDISCARD   = 0x1277
+	BLKZEROOUT   = 0x127f
+	BLKSSZGET    = 0x1268
+	BLKGETSIZE64 = 0x80081272
+)
+
+// disk is the file or the block device under the backends, and what they
+// do alike with it
+type disk struct {
+	file   *os.File
+	path   string
+	device bool
+	// the logical block size of the device, its discards must be aligned to
+	blockSize int64
+	// the device reads the blocks discarded as zeroes
+	discardZeroes bool
+}
+
+// openDisk opens a block device exclusively, which fails if it's mounted,
+// or used by e.g. device mapper, md or another replica
+func openDisk(path string, flag int) (*disk, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	device := util.IsBlockDevice(stat.Mode())
+	if !stat.Mode().IsRegular() && !device {
+		return nil, fmt.Errorf("%v is neither a regular file nor a block device", path)
+	}
+	if device {
+		flag |= os.O_EXCL
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.EBUSY {
+		return nil, fmt.Errorf("Block device %v is mounted or in use", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &disk{
+		file:   file,
+		path:   path,
+		device: device,
+	}
+	if device {
+		blockSize := int32(0)
+		if err := d.ioctl(BLKSSZGET, unsafe.Pointer(&blockSize)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Fail to get the block size of block device %v: %v", path, err)
+		}
+		d.blockSize = int64(blockSize)
+		d.discardZeroes = discardZeroes(stat)
+	}
+	return d, nil
+}
+
+// discardZeroes tells if the device guarantees zeroes after a discard, only
+// the kernels before 4.12 may tell so
+func discardZeroes(stat os.FileInfo) bool {
+	rdev := uint64(stat.Sys().(*syscall.Stat_t).Rdev)
+	path := fmt.Sprintf("/sys/dev/block/%v:%v/queue/discard_zeroes_data", unix.Major(rdev), unix.Minor(rdev))
+	value, err := ioutil.ReadFile(path)
+	return err == nil && strings.TrimSpace(string(value)) == "1"
+}
+
+func (d *disk) ioctl(request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, d.file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (d *disk) Flush() error {
+	return d.file.Sync()
+}
+
+// Discard punches a hole in a file or a block device, which reads as zeroes
+// afterwards. A device which can't is discarded if that zeroes the blocks, or
+// has the zeroes written otherwise, up to rpc.MAX_DISCARD_LENGTH at once.
+func (d *disk) Discard(offset, length int64) error {
+	if !d.device {
+		return syscall.Fallocate(int(d.file.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, length)
+	}
+	if offset%d.blockSize != 0 || length%d.blockSize != 0 {
+		return fmt.Errorf("Discard of %v bytes at %v is not aligned to the %v bytes blocks of %v",
+			length, offset, d.blockSize, d.path)
+	}
+	// a device unmaps the blocks if it can guarantee they read as zeroes
+	// then
+	err := syscall.Fallocate(int(d.file.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, length)
+	if err != syscall.EOPNOTSUPP {
+		return err
+	}
+	r := [2]uint64{uint64(offset), uint64(length)}
+	if d.discardZeroes {
+		return d.ioctl(BLKDISCARD, unsafe.Pointer(&r))
+	}
+	// the others have the zeroes written instead, which must be done within
+	// the timeout of the request
+	if length > rpc.MAX_DISCARD_LENGTH {
+		return fmt.Errorf("Discard of %v bytes is more than the %v bytes %v can zero at once",
+			length, rpc.MAX_DISCARD_LENGTH, d.path)
+	}
+	return d.ioctl(BLKZEROOUT, unsafe.Pointer(&r))
+}
+
+func (d *disk) Size() (int64, error) {
+	if !d.device {
+		stat, err := d.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return stat.Size(), nil
+	}
+	size := uint64(0)
+	if err := d.ioctl(BLKGETSIZE64, unsafe.Pointer(&size)); err != nil {
+		return 0, fmt.Errorf("Fail to get the size of block device %v: %v", d.path, err)
+	}
+	return int64(size), nil
+}
+
+func (d *disk) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,91 @@
+package replica
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	testDeviceSize = int64(16 * 1024 * 1024)
+)
+
+// setupLoopDevice attaches a loop device to a temporary file, it skips the
+// test unless run by root with losetup
+func setupLoopDevice(t *testing.T) (string, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("Skip loop device test, it must be run by root")
+	}
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal("Fail to create temporary directory: ", err)
+	}
+	image := filepath.Join(dir, "disk.img")
+	if err := util.FindOrCreateDisk(image, testDeviceSize); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal("Fail to create disk: ", err)
+	}
+	output, err := exec.Command("losetup", "-f", "--show", image).Output()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skip("Skip loop device test, losetup failed: ", err)
+	}
+	device := strings.TrimSpace(string(output))
+	return device, func() {
+		if err := exec.Command("losetup", "-d", device).Run(); err != nil {
+			t.Error("Fail to detach loop device: ", err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBlockDevice(t *testing.T) {
+	device, cleanup := setupLoopDevice(t)
+	defer cleanup()
+
+	if err := util.FindOrCreateDisk(device, testDeviceSize); err != nil {
+		t.Fatal("Fail to find block device: ", err)
+	}
+	backend, err := Open(BACKEND_BUFFERED, device)
+	if err != nil {
+		t.Fatal("Fail to open block device: ", err)
+	}
+	defer backend.Close()
+
+	size, err := backend.Size()
+	if err != nil {
+		t.Fatal("Fail to get size: ", err)
+	}
+	if size != testDeviceSize {
+		t.Fatalf("Got size %v, expected %v", size, testDeviceSize)
+	}
+
+	if other, err := Open(BACKEND_BUFFERED, device); err == nil {
+		other.Close()
+		t.Fatal("Block device in use is opened again")
+	}
+
+	data := bytes.Repeat([]byte{0xff}, 8192)
+	if _, err := backend.WriteAt(data, 0); err != nil {
+		t.Fatal("Fail to write: ", err)
+	}
+	if err := backend.Discard(100, 4096); err == nil {
+		t.Fatal("Unaligned discard succeeded")
+	}
+	if err := backend.Discard(0, 4096); err != nil {
+		t.Fatal("Fail to discard: ", err)
+	}
+	buf := make([]byte, len(data))
+	if _, err := backend.ReadAt(buf, 0); err != nil {
+		t.Fatal("Fail to read: ", err)
+	}
+	if !bytes.Equal(buf, append(make([]byte, 4096), data[4096:]...)) {
+		t.Fatal("Discarded blocks don't read as zeroes")
+	}
+}
@@ -0,0 +1,92 @@
+package replica
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/util"
+)
+
+// Handler serves the reads, the writes, the flushes, the discards and the
+// copies from backend
+func Handler(backend Backend) rpc.RequestHandler {
+	return func(req *rpc.Request) (*rpc.Response, error) {
+		if req.Header.Type == rpc.MSG_TYPE_READ_REQUEST {
+			buf := util.GetBuffer(int(req.Header.Length))
+			n, err := backend.ReadAt(buf, req.Header.Offset)
+			if err != nil && err != io.EOF {
+				log.Errorln("read failed: ", err.Error())
+				util.PutBuffer(buf)
+				return nil, err
+			}
+			// beyond the end of file
+			for i := n; i < len(buf); i++ {
+				buf[i] = 0
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_READ_RESPONSE,
+					Length: req.Header.Length,
+					Result: "Success",
+				},
+				Data: buf,
+			}, nil
+		}
+		if req.Header.Type == rpc.MSG_TYPE_WRITE_REQUEST {
+			if _, err := backend.WriteAt(req.Data, req.Header.Offset); err != nil {
+				log.Errorln("write failed: ", err.Error())
+				return nil, err
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_WRITE_RESPONSE,
+					Result: "Success",
+				},
+			}, nil
+		}
+		if req.Header.Type == rpc.MSG_TYPE_FLUSH_REQUEST {
+			if err := backend.Flush(); err != nil {
+				log.Errorln("flush failed: ", err.Error())
+				return nil, err
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_FLUSH_RESPONSE,
+					Result: "Success",
+				},
+			}, nil
+		}
+		if req.Header.Type == rpc.MSG_TYPE_DISCARD_REQUEST {
+			if err := backend.Discard(req.Header.Offset, req.Header.Length); err != nil {
+				log.Errorln("discard failed: ", err.Error())
+				return nil, err
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_DISCARD_RESPONSE,
+					Result: "Success",
+				},
+			}, nil
+		}
+		if req.Header.Type == rpc.MSG_TYPE_COPY_REQUEST {
+			if err := copyRange(backend, req.Header.Offset, req.Header.Source, req.Header.Length); err != nil {
+				log.Errorln("copy failed: ", err.Error())
+				return nil, err
+			}
+			return &rpc.Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   rpc.MSG_TYPE_COPY_RESPONSE,
+					Result: "Success",
+				},
+			}, nil
+		}
+		return nil, fmt.Errorf("Invalid request type: %v", req.Header.Type)
+	}
+}
@@ -0,0 +1,143 @@
+package replica
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// the memory backend allocates the data by extents of this size, once
+	// they're written
+	memoryExtentSize = 64 * 1024
+)
+
+// memoryBackend keeps the data in memory, e.g. for tests or scratch volumes.
+// Only the extents written take memory, the others read as zeroes.
+type memoryBackend struct {
+	size int64
+	// the most memory the extents may take, 0 for no limit
+	limit   int64
+	extents map[int64][]byte
+	mutex   *sync.RWMutex
+}
+
+// NewMemory returns a backend of size bytes in memory. Writes needing more
+// than limit bytes of extents fail, unless limit is 0.
+func NewMemory(size, limit int64) Backend {
+	return &memoryBackend{
+		size:    size,
+		limit:   limit,
+		extents: make(map[int64][]byte),
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+// eachExtent calls f with the parts of the extents from offset to
+// offset+length, and their positions relative to offset
+func eachExtent(offset, length int64, f func(index, start, end, pos int64)) {
+	for pos := int64(0); pos < length; {
+		index := (offset + pos) / memoryExtentSize
+		start := (offset + pos) % memoryExtentSize
+		end := start + length - pos
+		if end > memoryExtentSize {
+			end = memoryExtentSize
+		}
+		f(index, start, end, pos)
+		pos += end - start
+	}
+}
+
+func (b *memoryBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if offset >= b.size {
+		return 0, io.EOF
+	}
+	length := int64(len(buf))
+	if offset+length > b.size {
+		length = b.size - offset
+	}
+	eachExtent(offset, length, func(index, start, end, pos int64) {
+		part := buf[pos : pos+end-start]
+		if extent, ok := b.extents[index]; ok {
+			copy(part, extent[start:end])
+			return
+		}
+		for i := range part {
+			part[i] = 0
+		}
+	})
+	if length < int64(len(buf)) {
+		return int(length), io.EOF
+	}
+	return len(buf), nil
+}
+
+func (b *memoryBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	length := int64(len(buf))
+	if offset < 0 || offset+length > b.size {
+		return 0, fmt.Errorf("Write of %v bytes at %v is beyond the %v bytes in memory", length, offset, b.size)
+	}
+	if b.limit != 0 {
+		missing := int64(0)
+		eachExtent(offset, length, func(index, start, end, pos int64) {
+			if _, ok := b.extents[index]; !ok {
+				missing++
+			}
+		})
+		if (int64(len(b.extents))+missing)*memoryExtentSize > b.limit {
+			return 0, fmt.Errorf("Memory limit of %v bytes reached", b.limit)
+		}
+	}
+	eachExtent(offset, length, func(index, start, end, pos int64) {
+		extent, ok := b.extents[index]
+		if !ok {
+			extent = make([]byte, memoryExtentSize)
+			b.extents[index] = extent
+		}
+		copy(extent[start:end], buf[pos:])
+	})
+	return len(buf), nil
+}
+
+func (b *memoryBackend) Flush() error {
+	return nil
+}
+
+// Discard frees the extents discarded whole, and zeroes the others
+func (b *memoryBackend) Discard(offset, length int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if offset+length > b.size {
+		length = b.size - offset
+	}
+	eachExtent(offset, length, func(index, start, end, pos int64) {
+		extent, ok := b.extents[index]
+		if !ok {
+			return
+		}
+		if start == 0 && end == memoryExtentSize {
+			delete(b.extents, index)
+			return
+		}
+		zero := extent[start:end]
+		for i := range zero {
+			zero[i] = 0
+		}
+	})
+	return nil
+}
+
+func (b *memoryBackend) Size() (int64, error) {
+	return b.size, nil
+}
+
+func (b *memoryBackend) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.extents = make(map[int64][]byte)
+	return nil
+}
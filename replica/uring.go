@@ -0,0 +1,367 @@
+package replica
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// from linux/io_uring.h, the syscalls are the same on all architectures
+	SYS_IO_URING_SETUP = 425
+	SYS_IO_URING_ENTER = 426
+
+	IORING_OFF_SQ_RING = 0
+	IORING_OFF_CQ_RING = 0x8000000
+	IORING_OFF_SQES    = 0x10000000
+
+	IORING_ENTER_GETEVENTS = 1 << 0
+
+	IORING_OP_NOP   = 0
+	IORING_OP_READ  = 22
+	IORING_OP_WRITE = 23
+
+	// the most I/Os in flight, the completion queue is twice as large so it
+	// never overflows
+	uringEntries = 128
+)
+
+type uringSQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringCQOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring instance, with its rings mapped
+type uring struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte
+	sqMem  []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []uringSQE
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []uringCQE
+}
+
+func newUring(entries uint32) (*uring, error) {
+	params := uringParams{}
+	fd, _, errno := syscall.Syscall(SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring is not available: %v", errno)
+	}
+	r := &uring{fd: int(fd)}
+
+	var err error
+	prot, flags := syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	if r.sqRing, err = syscall.Mmap(r.fd, IORING_OFF_SQ_RING, sqSize, prot, flags); err != nil {
+		r.close()
+		return nil, fmt.Errorf("Fail to map io_uring submission queue: %v", err)
+	}
+	cqSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if r.cqRing, err = syscall.Mmap(r.fd, IORING_OFF_CQ_RING, cqSize, prot, flags); err != nil {
+		r.close()
+		return nil, fmt.Errorf("Fail to map io_uring completion queue: %v", err)
+	}
+	sqesSize := int(params.sqEntries * uint32(unsafe.Sizeof(uringSQE{})))
+	if r.sqMem, err = syscall.Mmap(r.fd, IORING_OFF_SQES, sqesSize, prot, flags); err != nil {
+		r.close()
+		return nil, fmt.Errorf("Fail to map io_uring submission queue entries: %v", err)
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.ringMask]))
+	r.sqArray = (*[1 << 16]uint32)(unsafe.Pointer(&r.sqRing[params.sqOff.array]))[:params.sqEntries:params.sqEntries]
+	r.sqes = (*[1 << 16]uringSQE)(unsafe.Pointer(&r.sqMem[0]))[:params.sqEntries:params.sqEntries]
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[params.cqOff.ringMask]))
+	r.cqes = (*[1 << 17]uringCQE)(unsafe.Pointer(&r.cqRing[params.cqOff.cqes]))[:params.cqEntries:params.cqEntries]
+	return r, nil
+}
+
+// push queues sqe, there must be room for it. Only one goroutine may push.
+func (r *uring) push(sqe uringSQE) {
+	tail := atomic.LoadUint32(r.sqTail)
+	index := tail & r.sqMask
+	r.sqes[index] = sqe
+	r.sqArray[index] = index
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+func (r *uring) enter(submit, minComplete, flags uint32) (int, error) {
+	for {
+		n, _, errno := syscall.Syscall6(SYS_IO_URING_ENTER, uintptr(r.fd),
+			uintptr(submit), uintptr(minComplete), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
+
+func (r *uring) close() {
+	for _, mem := range [][]byte{r.sqMem, r.cqRing, r.sqRing} {
+		if mem != nil {
+			syscall.Munmap(mem)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// uringBackend submits the I/Os queued meanwhile with a single io_uring_enter
+// (2), instead of a syscall each
+type uringBackend struct {
+	*disk
+	fd       int32
+	ring     *uring
+	requests chan *uringRequest
+	slots    chan struct{}
+
+	// the requests submitted, by their user data
+	pending      map[uint64]*uringRequest
+	pendingMutex *sync.Mutex
+	lastID       uint64
+	stopped      chan struct{}
+}
+
+type uringRequest struct {
+	opcode uint8
+	buf    []byte
+	offset int64
+	result int32
+	done   chan struct{}
+}
+
+func openUring(path string) (Backend, error) {
+	d, err := openDisk(path, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := newUring(uringEntries)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	b := &uringBackend{
+		disk:         d,
+		fd:           int32(d.file.Fd()),
+		ring:         ring,
+		requests:     make(chan *uringRequest, uringEntries),
+		slots:        make(chan struct{}, uringEntries),
+		pending:      make(map[uint64]*uringRequest),
+		pendingMutex: &sync.Mutex{},
+		stopped:      make(chan struct{}),
+	}
+	go b.submit()
+	go b.complete()
+	return b, nil
+}
+
+// submit pushes the requests queued, then submits all of them at once
+func (b *uringBackend) submit() {
+	for req := range b.requests {
+		count := uint32(0)
+		for req != nil {
+			b.push(req)
+			count++
+			select {
+			case next, ok := <-b.requests:
+				if !ok {
+					next = nil
+				}
+				req = next
+			default:
+				req = nil
+			}
+		}
+		for count > 0 {
+			n, err := b.ring.enter(count, 0, 0)
+			if err == syscall.EAGAIN || err == syscall.EBUSY {
+				continue
+			}
+			if err != nil {
+				// the requests pushed would never complete
+				log.Fatalf("Fail to submit to io_uring: %v", err)
+			}
+			count -= uint32(n)
+		}
+	}
+}
+
+// push queues req, the request without done stops complete
+func (b *uringBackend) push(req *uringRequest) {
+	sqe := uringSQE{
+		opcode: req.opcode,
+		fd:     b.fd,
+		off:    uint64(req.offset),
+		len:    uint32(len(req.buf)),
+	}
+	if len(req.buf) != 0 {
+		sqe.addr = uint64(uintptr(unsafe.Pointer(&req.buf[0])))
+	}
+	if req.done != nil {
+		b.pendingMutex.Lock()
+		b.lastID++
+		sqe.userData = b.lastID
+		b.pending[sqe.userData] = req
+		b.pendingMutex.Unlock()
+	}
+	b.ring.push(sqe)
+}
+
+// complete waits for the completions, and passes the results to the requests
+func (b *uringBackend) complete() {
+	defer close(b.stopped)
+	for {
+		if _, err := b.ring.enter(0, 1, IORING_ENTER_GETEVENTS); err != nil {
+			log.Fatalf("Fail to wait for io_uring completions: %v", err)
+		}
+		head, tail := atomic.LoadUint32(b.ring.cqHead), atomic.LoadUint32(b.ring.cqTail)
+		stop := false
+		for ; head != tail; head++ {
+			cqe := b.ring.cqes[head&b.ring.cqMask]
+			if cqe.userData == 0 {
+				stop = true
+				continue
+			}
+			b.pendingMutex.Lock()
+			req := b.pending[cqe.userData]
+			delete(b.pending, cqe.userData)
+			b.pendingMutex.Unlock()
+			req.result = cqe.res
+			close(req.done)
+		}
+		atomic.StoreUint32(b.ring.cqHead, head)
+		if stop {
+			return
+		}
+	}
+}
+
+// do returns once the kernel has done the request
+func (b *uringBackend) do(opcode uint8, buf []byte, offset int64) (int, error) {
+	b.slots <- struct{}{}
+	defer func() {
+		<-b.slots
+	}()
+	req := &uringRequest{
+		opcode: opcode,
+		buf:    buf,
+		offset: offset,
+		done:   make(chan struct{}),
+	}
+	b.requests <- req
+	<-req.done
+	if req.result < 0 {
+		return 0, syscall.Errno(-req.result)
+	}
+	return int(req.result), nil
+}
+
+func (b *uringBackend) ReadAt(buf []byte, offset int64) (int, error) {
+	done := 0
+	for done < len(buf) {
+		n, err := b.do(IORING_OP_READ, buf[done:], offset+int64(done))
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			return done, io.EOF
+		}
+		done += n
+	}
+	return done, nil
+}
+
+func (b *uringBackend) WriteAt(buf []byte, offset int64) (int, error) {
+	done := 0
+	for done < len(buf) {
+		n, err := b.do(IORING_OP_WRITE, buf[done:], offset+int64(done))
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			return done, io.ErrShortWrite
+		}
+		done += n
+	}
+	return done, nil
+}
+
+// Close should be called once there is no I/O any more
+func (b *uringBackend) Close() error {
+	b.requests <- &uringRequest{opcode: IORING_OP_NOP}
+	close(b.requests)
+	<-b.stopped
+	b.ring.close()
+	return b.disk.Close()
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
@@ -11,10 +12,20 @@ import (
 	"github.com/Sirupsen/logrus"
 
 	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/util"
 )
 
 var (
 	log = logrus.WithFields(logrus.Fields{"pkg": "dummy_controller"})
+
+	// reused by the calls, a channel is only put back once nothing would
+	// send to it any more
+	respChans = sync.Pool{
+		New: func() interface{} {
+			return make(chan *Response, 1)
+		},
+	}
+	timers = sync.Pool{}
 )
 
 type Request struct {
@@ -33,76 +44,232 @@ type Client struct {
 	seqRespChanMapMutex *sync.Mutex
 	seqCounter          int64
 	requests            chan *Request
+	slots               chan struct{}
 	timeout             int
+	closed              bool
+	closedChan          chan struct{}
+	closeMutex          *sync.RWMutex
+	// the calls in progress, accessed atomically
+	calls int64
+	// a request sent takes a credit, its response gives it back, even if
+	// its call has given up, as the server holds the request until then.
+	// There are as many as the server can queue, the requests holding one
+	// are in credited.
+	credits     int
+	maxCredits  int
+	credited    map[int64]struct{}
+	creditMutex *sync.Mutex
+	creditCond  *sync.Cond
+
+	// no coalescing if the window is zero, see SetCoalescing
+	coalesceWindow    time.Duration
+	coalesceMaxLength int64
 }
 
-func NewClient(c *net.TCPConn, timeout, bufSize int) *Client {
+// NewClient makes a client which has at most queueDepth calls in progress,
+// the others wait for their turn. Fewer requests are sent at once if the
+// server can't queue as many.
+func NewClient(c *net.TCPConn, timeout, queueDepth int) *Client {
 	client := &Client{
 		conn:                c,
 		seqRespChanMap:      make(map[int64]chan *Response),
 		seqRespChanMapMutex: &sync.Mutex{},
 		seqCounter:          0,
-		requests:            make(chan *Request, bufSize),
+		requests:            make(chan *Request, queueDepth),
+		slots:               make(chan struct{}, queueDepth),
+		credited:            make(map[int64]struct{}),
+		creditMutex:         &sync.Mutex{},
 		timeout:             timeout,
+		closedChan:          make(chan struct{}),
+		closeMutex:          &sync.RWMutex{},
 	}
+	client.creditCond = sync.NewCond(client.creditMutex)
 
 	go client.startRequestProcess()
 	go client.startResponseProcess()
 	return client
 }
 
+// Close stops sending requests. Calls still waiting for their responses
+// would fail immediately. The connection is not closed by the client.
 func (c *Client) Close() {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
 	close(c.requests)
+	close(c.closedChan)
+
+	c.creditMutex.Lock()
+	c.creditCond.Broadcast()
+	c.creditMutex.Unlock()
 }
 
 func (c *Client) startRequestProcess() {
+	c.handshake()
 	for req := range c.requests {
-		header := req.Header
-		if err := SendRequest(c.conn, header); err != nil {
-			log.Error("Fail to send request:", err)
+		// the call has given up, and its data may have been reused
+		if !c.isWaiting(req.Header.Id) {
 			continue
 		}
-		if header.Type == MSG_TYPE_WRITE_REQUEST {
-			if err := SendData(c.conn, req.Data); err != nil {
-				log.Error("Fail to send data:", err)
+		if c.coalesceWindow > 0 && isCoalescable(req) {
+			batch, next := c.collect(req)
+			c.sendBatch(batch)
+			if next == nil {
 				continue
 			}
+			req = next
+		}
+		c.send(req)
+	}
+}
+
+// handshake gets the credits from the server. The servers which don't tell
+// are assumed to queue as many as the client.
+func (c *Client) handshake() {
+	credits := cap(c.slots)
+	defer func() {
+		c.creditMutex.Lock()
+		c.credits = credits
+		c.maxCredits = credits
+		c.creditCond.Broadcast()
+		c.creditMutex.Unlock()
+	}()
+
+	id := c.GetNewId()
+	respChan := make(chan *Response, 1)
+	c.seqRespChanMapMutex.Lock()
+	c.seqRespChanMap[id] = respChan
+	c.seqRespChanMapMutex.Unlock()
+	if err := SendRequest(c.conn, &Request{
+		Header: &block.Request{
+			Id:   id,
+			Type: MSG_TYPE_HANDSHAKE_REQUEST,
+		},
+	}); err != nil {
+		log.Error("Fail to send handshake:", err)
+		c.removeRespChan(id)
+		return
+	}
+
+	timer := getTimer(time.Duration(c.timeout) * time.Second)
+	defer putTimer(timer)
+	select {
+	case resp := <-respChan:
+		if resp.Header.Result != "Success" || resp.Header.Length <= 0 {
+			log.Errorf("Handshake failed: %v", resp.Header.Result)
+			return
 		}
+		if resp.Header.Length < int64(credits) {
+			credits = int(resp.Header.Length)
+		}
+	case <-timer.C:
+		log.Error("Timeout for handshake")
+		c.removeRespChan(id)
+	case <-c.closedChan:
+		c.removeRespChan(id)
+	}
+}
+
+// send sends the request once there is a credit for it
+func (c *Client) send(req *Request) {
+	if !c.takeCredit(req.Header.Id) {
+		return
+	}
+	// the call may have given up while waiting for the credit
+	if !c.isWaiting(req.Header.Id) {
+		c.putCredit(req.Header.Id)
+		return
+	}
+	if err := SendRequest(c.conn, req); err != nil {
+		log.Error("Fail to send request:", err)
+		c.putCredit(req.Header.Id)
+	}
+}
+
+// takeCredit waits for a credit for the request, it returns false if the
+// client is closed meanwhile
+func (c *Client) takeCredit(id int64) bool {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+	for c.credits == 0 {
+		select {
+		case <-c.closedChan:
+			return false
+		default:
+		}
+		c.creditCond.Wait()
+	}
+	c.credits--
+	c.credited[id] = struct{}{}
+	return true
+}
+
+// putCredit gives back the credit of the request if it holds one, so a
+// credit is given back once
+func (c *Client) putCredit(id int64) {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+	if _, exists := c.credited[id]; !exists {
+		return
+	}
+	delete(c.credited, id)
+	if c.credits < c.maxCredits {
+		c.credits++
 	}
+	c.creditCond.Signal()
+}
+
+// resetCredits gives back all the credits once the connection is gone, the
+// server holds no request any more
+func (c *Client) resetCredits() {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+	c.credited = make(map[int64]struct{})
+	c.credits = c.maxCredits
+	c.creditCond.Broadcast()
 }
 
 func (c *Client) startResponseProcess() {
+	defer c.resetCredits()
+
+	reader := bufio.NewReaderSize(c.conn, readBufferSize)
 	for {
 		var (
 			response *Response
 			data     []byte
 		)
-		respHeader, err := ReadResponse(c.conn)
+		respHeader, err := ReadResponse(reader)
 		if err != nil {
 			if err == io.EOF {
 				log.Info("Connection closed")
 				break
 			}
+			// the connection is reset, or the responses can't be told
+			// apart any more
 			log.Error("Fail to read response:", err)
-			continue
-		}
-		if respHeader.Result != "Success" {
-			log.Error("Operation failed: ", respHeader.Result)
-			continue
+			break
 		}
-		if respHeader.Type == MSG_TYPE_READ_RESPONSE {
-			data = make([]byte, respHeader.Length, respHeader.Length)
-			if err := ReceiveData(c.conn, data); err != nil {
+		// failed responses have no data, they are returned by Call as errors
+		if respHeader.Result == "Success" && hasData(int64(respHeader.Type)) {
+			data = util.GetBuffer(int(respHeader.Length))
+			if err := ReceiveData(reader, data); err != nil {
 				log.Error("Receive data failed:", err)
+				util.PutBuffer(data)
 				continue
 			}
 		}
 
-		c.seqRespChanMapMutex.Lock()
-		respChan := c.seqRespChanMap[respHeader.Id]
-		delete(c.seqRespChanMap, respHeader.Id)
-		c.seqRespChanMapMutex.Unlock()
-
+		c.putCredit(respHeader.Id)
+		respChan, exists := c.takeRespChan(respHeader.Id)
+		if !exists {
+			log.Errorf("Discard response of operation %v, it has timed out", respHeader.Id)
+			util.PutBuffer(data)
+			continue
+		}
 		response = &Response{
 			Header: respHeader,
 			Data:   data,
@@ -115,23 +282,111 @@ func (c *Client) GetNewId() int64 {
 	return atomic.AddInt64(&c.seqCounter, 1)
 }
 
+// Call sends the request and waits for its response. The data of the request
+// may be reused once it returns, even if it failed. The data of the response
+// may be put back with util.PutBuffer once consumed.
 func (c *Client) Call(request *Request) (*Response, error) {
 	var (
 		response *Response
 		err      error
 	)
+	select {
+	case c.slots <- struct{}{}:
+	case <-c.closedChan:
+		return nil, fmt.Errorf("Client is closed, cannot process operation")
+	}
+	defer func() {
+		<-c.slots
+	}()
+	atomic.AddInt64(&c.calls, 1)
+	defer atomic.AddInt64(&c.calls, -1)
+
 	request.Header.Id = c.GetNewId()
-	respChan := make(chan *Response)
+	respChan := respChans.Get().(chan *Response)
 	c.seqRespChanMapMutex.Lock()
 	c.seqRespChanMap[request.Header.Id] = respChan
 	c.seqRespChanMapMutex.Unlock()
+
+	c.closeMutex.RLock()
+	if c.closed {
+		c.closeMutex.RUnlock()
+		c.removeRespChan(request.Header.Id)
+		respChans.Put(respChan)
+		return nil, fmt.Errorf("Client is closed, cannot process operation %v", request.Header.Id)
+	}
 	c.requests <- request
+	c.closeMutex.RUnlock()
 
+	timer := getTimer(time.Duration(c.timeout) * time.Second)
 	select {
 	case response = <-respChan:
 		err = nil
-	case <-time.After(time.Duration(c.timeout) * time.Second):
+	case <-timer.C:
 		err = fmt.Errorf("Timeout for operation %v", request.Header.Id)
+	case <-c.closedChan:
+		err = fmt.Errorf("Client is closed, abort operation %v", request.Header.Id)
+	}
+	putTimer(timer)
+	if err != nil {
+		// the response may be on its way otherwise
+		if c.removeRespChan(request.Header.Id) {
+			respChans.Put(respChan)
+		}
+		return nil, err
+	}
+	respChans.Put(respChan)
+	switch response.Header.Result {
+	case "Success":
+		return response, nil
+	case RESULT_FENCED:
+		return nil, ErrFenced
+	}
+	return nil, fmt.Errorf("Operation %v failed: %v", request.Header.Id, response.Header.Result)
+}
+
+// takeRespChan removes the channel the response of the request should be sent
+// to, it doesn't exist if the call has given up
+func (c *Client) takeRespChan(id int64) (chan *Response, bool) {
+	c.seqRespChanMapMutex.Lock()
+	defer c.seqRespChanMapMutex.Unlock()
+	respChan, exists := c.seqRespChanMap[id]
+	delete(c.seqRespChanMap, id)
+	return respChan, exists
+}
+
+// removeRespChan returns false if the response has been taken already
+func (c *Client) removeRespChan(id int64) bool {
+	c.seqRespChanMapMutex.Lock()
+	defer c.seqRespChanMapMutex.Unlock()
+	_, exists := c.seqRespChanMap[id]
+	delete(c.seqRespChanMap, id)
+	return exists
+}
+
+// isWaiting tells if the call of the request is still waiting for its response
+func (c *Client) isWaiting(id int64) bool {
+	c.seqRespChanMapMutex.Lock()
+	defer c.seqRespChanMapMutex.Unlock()
+	_, exists := c.seqRespChanMap[id]
+	return exists
+}
+
+func getTimer(d time.Duration) *time.Timer {
+	if timer, ok := timers.Get().(*time.Timer); ok {
+		timer.Reset(d)
+		return timer
+	}
+	return time.NewTimer(d)
+}
+
+// putTimer stops the timer, and drains it if it has fired but not been
+// received, so the next Reset starts afresh
+func putTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
 	}
-	return response, err
+	timers.Put(timer)
 }
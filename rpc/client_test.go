@@ -0,0 +1,212 @@
+package rpc
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	testTimeout     = 5 // in seconds
+	testQueueDepth  = 128
+	testRequestSize = 4096
+	testSize        = int64(64 * 1024 * 1024)
+)
+
+// nullHandler is a replica which throws away the writes, and reads garbage
+func nullHandler(req *Request) (*Response, error) {
+	resp := &Response{
+		Header: &block.Response{
+			Id:     req.Header.Id,
+			Type:   uint64(req.Header.Type + 1),
+			Result: "Success",
+		},
+	}
+	if req.Header.Type == MSG_TYPE_READ_REQUEST {
+		resp.Header.Length = req.Header.Length
+		resp.Data = util.GetBuffer(int(req.Header.Length))
+	}
+	return resp, nil
+}
+
+// startServer serves handler on a localhost port, and returns a client
+// connected to it. The server stops once the client's connection is closed.
+func startServer(t testing.TB, handler RequestHandler) (*Client, *net.TCPConn) {
+	conn := serve(t, testQueueDepth, handler)
+	return NewClient(conn, testTimeout, testQueueDepth), conn
+}
+
+// serve serves handler on a localhost port, and returns the connection to it
+func serve(t testing.TB, queueDepth int, handler RequestHandler) *net.TCPConn {
+	addr, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to resolve: ", err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen to: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal("Cannot connect to server: ", err)
+	}
+	serverConn, ok := <-accepted
+	if !ok {
+		t.Fatal("Fail to accept connection")
+	}
+	NewServer(serverConn, queueDepth, handler).Start()
+	return conn
+}
+
+// TestCredits checks the calls giving up while the server is stalled don't
+// give back their credits, so the client never has more requests on the
+// server than negotiated, and the late responses give them back
+func TestCredits(t *testing.T) {
+	queueDepth := 4
+	var inflight, maxInflight int64
+	release := make(chan struct{})
+	// the server could queue more, the client negotiates fewer
+	conn := serve(t, 4*queueDepth, func(req *Request) (*Response, error) {
+		n := atomic.AddInt64(&inflight, 1)
+		defer atomic.AddInt64(&inflight, -1)
+		for max := atomic.LoadInt64(&maxInflight); n > max; max = atomic.LoadInt64(&maxInflight) {
+			if atomic.CompareAndSwapInt64(&maxInflight, max, n) {
+				break
+			}
+		}
+		<-release
+		return nullHandler(req)
+	})
+	defer conn.Close()
+	client := NewClient(conn, 1, queueDepth)
+	defer client.Close()
+
+	read := func() error {
+		resp, err := client.Call(&Request{
+			Header: &block.Request{
+				Type:   MSG_TYPE_READ_REQUEST,
+				Length: testRequestSize,
+			},
+		})
+		if err == nil {
+			util.PutBuffer(resp.Data)
+		}
+		return err
+	}
+
+	// the calls of the second round would be sent if the first one gave
+	// back its credits
+	for round := 0; round < 2; round++ {
+		errs := make(chan error, queueDepth)
+		for i := 0; i < queueDepth; i++ {
+			go func() {
+				errs <- read()
+			}()
+		}
+		for i := 0; i < queueDepth; i++ {
+			if err := <-errs; err == nil {
+				t.Fatal("Call succeeded while the server is stalled")
+			}
+		}
+	}
+	if max := atomic.LoadInt64(&maxInflight); max > int64(queueDepth) {
+		t.Fatalf("Server got %v requests at once, expected at most %v", max, queueDepth)
+	}
+
+	close(release)
+	if err := read(); err != nil {
+		t.Fatal("Fail to call once the server has answered: ", err)
+	}
+	client.creditMutex.Lock()
+	defer client.creditMutex.Unlock()
+	if client.credits != queueDepth || len(client.credited) != 0 {
+		t.Fatalf("Got %v credits and %v requests holding one, expected %v and none",
+			client.credits, len(client.credited), queueDepth)
+	}
+}
+
+// benchmarkCalls calls op from the workers in parallel, and reports the GC
+// pauses per op along with the allocations
+func benchmarkCalls(b *testing.B, op func(offset int64) error) {
+	var ops int64
+	var before, after runtime.MemStats
+	b.ReportAllocs()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddInt64(&ops, 1)
+			if err := op(n * testRequestSize % testSize); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	pause := time.Duration(after.PauseTotalNs - before.PauseTotalNs)
+	b.ReportMetric(float64(pause.Nanoseconds())/float64(b.N), "gc-pause-ns/op")
+}
+
+func BenchmarkCall(b *testing.B) {
+	for _, window := range []time.Duration{0, 100 * time.Microsecond} {
+		client, conn := startServer(b, nullHandler)
+		if window > 0 {
+			client.SetCoalescing(window, 1024*1024)
+		}
+		data := make([]byte, testRequestSize)
+		suffix := ""
+		if window > 0 {
+			suffix = "-coalesced"
+		}
+
+		b.Run("write"+suffix, func(b *testing.B) {
+			benchmarkCalls(b, func(offset int64) error {
+				_, err := client.Call(&Request{
+					Header: &block.Request{
+						Type:   MSG_TYPE_WRITE_REQUEST,
+						Offset: offset,
+						Length: int64(len(data)),
+					},
+					Data: data,
+				})
+				return err
+			})
+		})
+		b.Run("read"+suffix, func(b *testing.B) {
+			benchmarkCalls(b, func(offset int64) error {
+				resp, err := client.Call(&Request{
+					Header: &block.Request{
+						Type:   MSG_TYPE_READ_REQUEST,
+						Offset: offset,
+						Length: int64(len(data)),
+					},
+				})
+				if err == nil {
+					util.PutBuffer(resp.Data)
+				}
+				return err
+			})
+		})
+
+		conn.Close()
+		client.Close()
+	}
+}
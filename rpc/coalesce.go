@@ -0,0 +1,247 @@
+package rpc
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// the most requests looked at for one batch
+	maxCoalescedRequests = 128
+)
+
+// pendingRequest is a request in a batch, index is its order of arrival
+type pendingRequest struct {
+	index int
+	req   *Request
+}
+
+type byOffset []pendingRequest
+
+func (p byOffset) Len() int      { return len(p) }
+func (p byOffset) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byOffset) Less(i, j int) bool {
+	if p[i].req.Header.Offset != p[j].req.Header.Offset {
+		return p[i].req.Header.Offset < p[j].req.Header.Offset
+	}
+	return p[i].index < p[j].index
+}
+
+type byArrival []pendingRequest
+
+func (p byArrival) Len() int           { return len(p) }
+func (p byArrival) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byArrival) Less(i, j int) bool { return p[i].index < p[j].index }
+
+// SetCoalescing makes the client merge the reads, and the writes, which are
+// adjacent or overlapping into single requests of up to maxLength bytes. Once
+// a read or a write is to be sent, the client waits for more up to window,
+// which is the latency paid for fewer and larger requests. The calls still
+// complete one by one. It should be called before the first Call.
+func (c *Client) SetCoalescing(window time.Duration, maxLength int64) {
+	c.coalesceWindow = window
+	c.coalesceMaxLength = maxLength
+}
+
+func isCoalescable(req *Request) bool {
+	return req.Header.Type == MSG_TYPE_READ_REQUEST || req.Header.Type == MSG_TYPE_WRITE_REQUEST
+}
+
+// collect gathers the requests queued within the window after first. It
+// stops at the first request which cannot be coalesced, and returns it to be
+// sent after the batch. There is no point to wait once all the calls in
+// progress are in the batch, their callers would be waiting for it.
+func (c *Client) collect(first *Request) ([]*Request, *Request) {
+	batch := []*Request{first}
+	timer := getTimer(c.coalesceWindow)
+	defer putTimer(timer)
+	for len(batch) < maxCoalescedRequests {
+		if len(c.requests) == 0 && atomic.LoadInt64(&c.calls) <= int64(len(batch)) {
+			return batch, nil
+		}
+		select {
+		case req, ok := <-c.requests:
+			if !ok {
+				return batch, nil
+			}
+			if !c.isWaiting(req.Header.Id) {
+				continue
+			}
+			if !isCoalescable(req) {
+				return batch, req
+			}
+			batch = append(batch, req)
+		case <-timer.C:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// sendBatch sends the writes then the reads of the batch, those adjacent or
+// overlapping are merged
+func (c *Client) sendBatch(batch []*Request) {
+	var reads, writes []pendingRequest
+	for i, req := range batch {
+		if req.Header.Type == MSG_TYPE_WRITE_REQUEST {
+			writes = append(writes, pendingRequest{i, req})
+		} else {
+			reads = append(reads, pendingRequest{i, req})
+		}
+	}
+	for _, group := range [][]pendingRequest{writes, reads} {
+		sort.Sort(byOffset(group))
+		for len(group) > 0 {
+			n, end := 1, group[0].req.Header.Offset+group[0].req.Header.Length
+			for ; n < len(group); n++ {
+				header := group[n].req.Header
+				if header.Offset > end || header.Epoch != group[0].req.Header.Epoch {
+					break
+				}
+				newEnd := end
+				if header.Offset+header.Length > newEnd {
+					newEnd = header.Offset + header.Length
+				}
+				if newEnd-group[0].req.Header.Offset > c.coalesceMaxLength {
+					break
+				}
+				end = newEnd
+			}
+			c.sendMerged(group[:n])
+			group = group[n:]
+		}
+	}
+}
+
+// sendMerged sends the run of requests sorted by offset as one
+func (c *Client) sendMerged(run []pendingRequest) {
+	if len(run) == 1 {
+		c.send(run[0].req)
+		return
+	}
+
+	for _, m := range c.merge(run) {
+		if len(m.members) == 1 {
+			c.send(m.members[0].req)
+			continue
+		}
+		members := make([]*Request, len(m.members))
+		for i, p := range m.members {
+			members[i] = p.req
+		}
+		go c.split(m.req.Header, m.respChan, members)
+		c.send(m.req)
+		util.PutBuffer(m.req.Data)
+	}
+}
+
+// mergedRequest is a request made of members, its response is sent to
+// respChan
+type mergedRequest struct {
+	req      *Request
+	members  []pendingRequest
+	respChan chan *Response
+}
+
+// merge merges the requests of run whose calls are still waiting. Their data
+// is copied with seqRespChanMapMutex held, so no call can give up and reuse
+// its data meanwhile. Those which have given up are left out, which may split
+// the run where they were.
+func (c *Client) merge(run []pendingRequest) []*mergedRequest {
+	c.seqRespChanMapMutex.Lock()
+	defer c.seqRespChanMapMutex.Unlock()
+
+	merged := []*mergedRequest{}
+	var last *mergedRequest
+	for _, p := range run {
+		if _, waiting := c.seqRespChanMap[p.req.Header.Id]; !waiting {
+			continue
+		}
+		header := p.req.Header
+		if last == nil || header.Offset > last.req.Header.Offset+last.req.Header.Length {
+			last = &mergedRequest{
+				req: &Request{
+					Header: &block.Request{
+						Type:   header.Type,
+						Offset: header.Offset,
+						Epoch:  header.Epoch,
+					},
+				},
+			}
+			merged = append(merged, last)
+		}
+		if end := header.Offset + header.Length - last.req.Header.Offset; end > last.req.Header.Length {
+			last.req.Header.Length = end
+		}
+		last.members = append(last.members, p)
+	}
+
+	for _, m := range merged {
+		if len(m.members) == 1 {
+			continue
+		}
+		m.req.Header.Id = c.GetNewId()
+		if m.req.Header.Type == MSG_TYPE_WRITE_REQUEST {
+			// the later write wins where they overlap
+			byIndex := append([]pendingRequest{}, m.members...)
+			sort.Sort(byArrival(byIndex))
+			m.req.Data = util.GetBuffer(int(m.req.Header.Length))
+			for _, p := range byIndex {
+				copy(m.req.Data[p.req.Header.Offset-m.req.Header.Offset:], p.req.Data)
+			}
+		}
+		m.respChan = make(chan *Response, 1)
+		c.seqRespChanMap[m.req.Header.Id] = m.respChan
+	}
+	return merged
+}
+
+// split completes the calls of members with the response of the merged
+// request. The calls which have given up meanwhile are skipped, and so are
+// all of them if the merged request times out.
+func (c *Client) split(merged *block.Request, respChan chan *Response, members []*Request) {
+	var response *Response
+	timer := getTimer(time.Duration(c.timeout) * time.Second)
+	select {
+	case response = <-respChan:
+	case <-timer.C:
+	case <-c.closedChan:
+	}
+	putTimer(timer)
+	if response == nil {
+		c.removeRespChan(merged.Id)
+		return
+	}
+	defer util.PutBuffer(response.Data)
+
+	for _, req := range members {
+		memberChan, exists := c.takeRespChan(req.Header.Id)
+		if !exists {
+			continue
+		}
+		resp := &Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   response.Header.Type,
+				Result: response.Header.Result,
+			},
+		}
+		end := req.Header.Offset - merged.Offset + req.Header.Length
+		switch {
+		case response.Header.Result != "Success" || !hasData(int64(response.Header.Type)):
+		case end > int64(len(response.Data)):
+			resp.Header.Result = fmt.Sprintf("Response of %v bytes to merged operation %v is too short",
+				len(response.Data), merged.Id)
+		default:
+			resp.Header.Length = req.Header.Length
+			resp.Data = util.GetBuffer(int(req.Header.Length))
+			copy(resp.Data, response.Data[end-req.Header.Length:end])
+		}
+		memberChan <- resp
+	}
+}
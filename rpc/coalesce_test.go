@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/yasker/longhorn/block"
+)
+
+// TestMergeGivenUp checks the writes whose calls have given up are left out
+// of the merged requests, and their data isn't read
+func TestMergeGivenUp(t *testing.T) {
+	client, conn := startServer(t, nullHandler)
+	defer client.Close()
+	defer conn.Close()
+
+	var run []pendingRequest
+	for i := 0; i < 4; i++ {
+		req := &Request{
+			Header: &block.Request{
+				Id:     client.GetNewId(),
+				Type:   MSG_TYPE_WRITE_REQUEST,
+				Offset: int64(i * testRequestSize),
+				Length: testRequestSize,
+			},
+			Data: bytes.Repeat([]byte{byte(i + 1)}, testRequestSize),
+		}
+		run = append(run, pendingRequest{i, req})
+		if i != 1 {
+			client.seqRespChanMapMutex.Lock()
+			client.seqRespChanMap[req.Header.Id] = make(chan *Response, 1)
+			client.seqRespChanMapMutex.Unlock()
+		}
+	}
+	// the call of the second write has given up, and reuses its data
+	run[1].req.Data = nil
+
+	merged := client.merge(run)
+	if len(merged) != 2 {
+		t.Fatalf("Got %v merged requests, expected 2", len(merged))
+	}
+	if len(merged[0].members) != 1 || merged[0].members[0].req != run[0].req {
+		t.Fatal("The first write is not sent alone")
+	}
+	m := merged[1]
+	if len(m.members) != 2 || m.req.Header.Offset != 2*testRequestSize ||
+		m.req.Header.Length != 2*testRequestSize {
+		t.Fatalf("Merged %v requests at %v of %v bytes, expected 2 at %v of %v bytes",
+			len(m.members), m.req.Header.Offset, m.req.Header.Length,
+			2*testRequestSize, 2*testRequestSize)
+	}
+	expected := append(run[2].req.Data, run[3].req.Data...)
+	if !bytes.Equal(m.req.Data, expected) {
+		t.Fatal("Merged data doesn't match the writes")
+	}
+	if !client.isWaiting(m.req.Header.Id) {
+		t.Fatal("Merged request is not waiting for its response")
+	}
+}
+
+// TestSplitShort checks the members of a merged read beyond its response
+// fail, instead of getting the data partly
+func TestSplitShort(t *testing.T) {
+	client, conn := startServer(t, nullHandler)
+	defer client.Close()
+	defer conn.Close()
+
+	merged := &block.Request{
+		Id:     client.GetNewId(),
+		Type:   MSG_TYPE_READ_REQUEST,
+		Length: 2 * testRequestSize,
+	}
+	members := []*Request{}
+	memberChans := []chan *Response{}
+	for i := 0; i < 2; i++ {
+		req := &Request{
+			Header: &block.Request{
+				Id:     client.GetNewId(),
+				Type:   MSG_TYPE_READ_REQUEST,
+				Offset: int64(i * testRequestSize),
+				Length: testRequestSize,
+			},
+		}
+		members = append(members, req)
+		memberChans = append(memberChans, make(chan *Response, 1))
+		client.seqRespChanMapMutex.Lock()
+		client.seqRespChanMap[req.Header.Id] = memberChans[i]
+		client.seqRespChanMapMutex.Unlock()
+	}
+
+	respChan := make(chan *Response, 1)
+	respChan <- &Response{
+		Header: &block.Response{
+			Id:     merged.Id,
+			Type:   MSG_TYPE_READ_RESPONSE,
+			Length: testRequestSize + 1,
+			Result: "Success",
+		},
+		Data: bytes.Repeat([]byte{1}, testRequestSize+1),
+	}
+	client.split(merged, respChan, members)
+
+	if resp := <-memberChans[0]; resp.Header.Result != "Success" ||
+		!bytes.Equal(resp.Data, bytes.Repeat([]byte{1}, testRequestSize)) {
+		t.Fatalf("Member covered by the response got %v", resp.Header.Result)
+	}
+	if resp := <-memberChans[1]; resp.Header.Result == "Success" || resp.Data != nil {
+		t.Fatal("Member beyond the response succeeded")
+	}
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"sync"
+
+	"github.com/yasker/longhorn/block"
+)
+
+// Fence makes a replica reject the changes from controllers older than the
+// newest one it has seen, so a controller which has been taken over, e.g.
+// after a network partition, cannot write any more. Each request carries the
+// epoch of its controller, 0 if it doesn't take part in failover.
+type Fence struct {
+	// the changes are handled with mutex read locked, so once a newer epoch
+	// is saved no change from an older one is still being made
+	epoch int64
+	mutex *sync.RWMutex
+	save  func(epoch int64) error
+}
+
+// NewFence starts with the newest epoch seen before, save persists a newer
+// one before the request carrying it is handled.
+func NewFence(epoch int64, save func(epoch int64) error) *Fence {
+	return &Fence{
+		epoch: epoch,
+		mutex: &sync.RWMutex{},
+		save:  save,
+	}
+}
+
+// isChange tells if the request modifies the replica. Reads are never fenced,
+// the standby controller reads the metadata before it gets its epoch.
+func isChange(msgType int64) bool {
+	switch msgType {
+	case MSG_TYPE_WRITE_REQUEST, MSG_TYPE_DISCARD_REQUEST, MSG_TYPE_WRITE_METADATA_REQUEST,
+		MSG_TYPE_COPY_REQUEST:
+		return true
+	}
+	return false
+}
+
+// raise waits for the changes being made to complete, then saves epoch
+func (f *Fence) raise(epoch int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if epoch <= f.epoch {
+		return nil
+	}
+	if err := f.save(epoch); err != nil {
+		return err
+	}
+	log.Infof("Fence controllers older than epoch %v", epoch)
+	f.epoch = epoch
+	return nil
+}
+
+// Handler wraps handler, answering RESULT_FENCED to the changes from older
+// controllers
+func (f *Fence) Handler(handler RequestHandler) RequestHandler {
+	return func(req *Request) (*Response, error) {
+		if !isChange(req.Header.Type) {
+			return handler(req)
+		}
+		epoch := req.Header.Epoch
+
+		f.mutex.RLock()
+		for epoch > f.epoch {
+			f.mutex.RUnlock()
+			if err := f.raise(epoch); err != nil {
+				return nil, err
+			}
+			f.mutex.RLock()
+		}
+		defer f.mutex.RUnlock()
+
+		if epoch < f.epoch {
+			log.Errorf("Reject request %v from fenced epoch %v", req.Header.Id, epoch)
+			return &Response{
+				Header: &block.Response{
+					Id: req.Header.Id,
+					// the response types follow their requests
+					Type:   uint64(req.Header.Type + 1),
+					Result: RESULT_FENCED,
+				},
+			}, nil
+		}
+		return handler(req)
+	}
+}
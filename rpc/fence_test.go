@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/block"
+)
+
+func fenceRequest(epoch int64) *Request {
+	return &Request{
+		Header: &block.Request{
+			Type:  MSG_TYPE_WRITE_REQUEST,
+			Epoch: epoch,
+		},
+	}
+}
+
+// TestFenceAtomic checks a newer epoch is saved only once the changes from
+// the older one being made are done, and the older one is rejected after
+func TestFenceAtomic(t *testing.T) {
+	saved := make(chan int64, 2)
+	fence := NewFence(1, func(epoch int64) error {
+		saved <- epoch
+		return nil
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := fence.Handler(func(req *Request) (*Response, error) {
+		if req.Header.Epoch == 1 {
+			close(started)
+			<-release
+		}
+		return &Response{Header: &block.Response{Result: "Success"}}, nil
+	})
+
+	done := make(chan *Response, 2)
+	go func() {
+		resp, _ := handler(fenceRequest(1))
+		done <- resp
+	}()
+	<-started
+	go func() {
+		resp, _ := handler(fenceRequest(2))
+		done <- resp
+	}()
+
+	select {
+	case epoch := <-saved:
+		t.Fatalf("Epoch %v saved while a change of epoch 1 is being made", epoch)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if resp := <-done; resp.Header.Result != "Success" {
+			t.Fatalf("Change failed with %v", resp.Header.Result)
+		}
+	}
+	if epoch := <-saved; epoch != 2 {
+		t.Fatalf("Saved epoch %v, expected 2", epoch)
+	}
+
+	resp, err := handler(fenceRequest(1))
+	if err != nil || resp.Header.Result != RESULT_FENCED {
+		t.Fatalf("Change from a fenced epoch returned %v, %v", resp, err)
+	}
+	if resp, err := handler(fenceRequest(2)); err != nil || resp.Header.Result != "Success" {
+		t.Fatalf("Change from the current epoch returned %v, %v", resp, err)
+	}
+	if len(saved) != 0 {
+		t.Fatal("The same epoch is saved twice")
+	}
+}
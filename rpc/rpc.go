@@ -1,63 +1,131 @@
 package rpc
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 
-	"github.com/gogo/protobuf/proto"
-
 	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/util"
 )
 
 const (
 	MSG_HEADER_LENGTH = 5
 
+	// the connections are read through a buffer of the size, so the
+	// headers of small messages don't take a syscall each
+	readBufferSize = 64 * 1024
+
 	MSG_TYPE_READ_REQUEST   = 1
 	MSG_TYPE_READ_RESPONSE  = 2
 	MSG_TYPE_WRITE_REQUEST  = 3
 	MSG_TYPE_WRITE_RESPONSE = 4
+	MSG_TYPE_FLUSH_REQUEST  = 5
+	MSG_TYPE_FLUSH_RESPONSE = 6
+	// discarded range would be read as zeroes
+	MSG_TYPE_DISCARD_REQUEST  = 7
+	MSG_TYPE_DISCARD_RESPONSE = 8
+	// the most a discard request covers, a replica may have to write the
+	// zeroes within the timeout
+	MAX_DISCARD_LENGTH = 64 * 1024 * 1024
+	// small named blobs kept along with the volume, the data of the request
+	// is the name, followed by '\0' and the value for writes
+	MSG_TYPE_READ_METADATA_REQUEST   = 9
+	MSG_TYPE_READ_METADATA_RESPONSE  = 10
+	MSG_TYPE_WRITE_METADATA_REQUEST  = 11
+	MSG_TYPE_WRITE_METADATA_RESPONSE = 12
+	// copies length bytes from the source offset to offset within the
+	// replica, so the data doesn't go through the network
+	MSG_TYPE_COPY_REQUEST  = 13
+	MSG_TYPE_COPY_RESPONSE = 14
+	// the first request of a client, the length of the response is how many
+	// requests the server can queue, the client never has more outstanding
+	MSG_TYPE_HANDSHAKE_REQUEST  = 15
+	MSG_TYPE_HANDSHAKE_RESPONSE = 16
+
+	// the result of a request rejected because it's from a controller older
+	// than the newest one the replica has seen
+	RESULT_FENCED = "Fenced"
+)
+
+var (
+	ErrFenced = fmt.Errorf("Controller is fenced by a newer epoch")
 )
 
-func EncodeLength(length uint32) []byte {
-	bytes := make([]byte, MSG_HEADER_LENGTH)
-	binary.BigEndian.PutUint32(bytes, length)
-	return bytes
+// hasData tells if the message of the type is followed by data, whose size
+// is the length in the header
+func hasData(msgType int64) bool {
+	switch msgType {
+	case MSG_TYPE_READ_RESPONSE, MSG_TYPE_WRITE_REQUEST,
+		MSG_TYPE_READ_METADATA_REQUEST, MSG_TYPE_READ_METADATA_RESPONSE,
+		MSG_TYPE_WRITE_METADATA_REQUEST:
+		return true
+	}
+	return false
+}
+
+// EncodeMetadata builds the data of metadata requests, value is nil for reads
+func EncodeMetadata(name string, value []byte) []byte {
+	if value == nil {
+		return []byte(name)
+	}
+	data := make([]byte, 0, len(name)+1+len(value))
+	data = append(data, name...)
+	data = append(data, 0)
+	return append(data, value...)
+}
+
+func DecodeMetadata(data []byte) (string, []byte) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return string(data[:i]), data[i+1:]
+	}
+	return string(data), nil
 }
 
 func DecodeLength(bytes []byte) uint32 {
 	return binary.BigEndian.Uint32(bytes)
 }
 
-func SendRequest(conn io.Writer, req *block.Request) error {
-	data, err := proto.Marshal(req)
-	if err != nil {
-		return fmt.Errorf("Fail to encode message: ", err)
-	}
-	return send(conn, data)
+// message is a block.Request or a block.Response
+type message interface {
+	Size() int
+	MarshalTo(data []byte) (int, error)
 }
 
-func SendResponse(conn io.Writer, resp *block.Response) error {
-	data, err := proto.Marshal(resp)
-	if err != nil {
-		return fmt.Errorf("Fail to encode message: ", err)
-	}
-	return send(conn, data)
+// SendRequest writes the request followed by its data, if the type has any
+func SendRequest(conn io.Writer, req *Request) error {
+	return send(conn, req.Header, req.Data, hasData(req.Header.Type))
+}
+
+// SendResponse writes the response followed by its data, if the type has any
+func SendResponse(conn io.Writer, resp *Response) error {
+	return send(conn, resp.Header, resp.Data, hasData(int64(resp.Header.Type)))
 }
 
-func send(conn io.Writer, data []byte) error {
-	length := len(data)
+// send writes the length, the message and the data at once, with writev(2)
+// if conn is a net.TCPConn
+func send(conn io.Writer, msg message, data []byte, withData bool) error {
+	length := msg.Size()
 	if length >= (1 << (MSG_HEADER_LENGTH * 8)) {
-		return fmt.Errorf("Length exceed maximum header length: ", length)
+		return fmt.Errorf("Length exceed maximum header length: %v", length)
+	}
+	buf := util.GetBuffer(MSG_HEADER_LENGTH + length)
+	defer util.PutBuffer(buf)
+	binary.BigEndian.PutUint32(buf, uint32(length))
+	buf[MSG_HEADER_LENGTH-1] = 0
+	if _, err := msg.MarshalTo(buf[MSG_HEADER_LENGTH:]); err != nil {
+		return fmt.Errorf("Fail to encode message: %v", err)
 	}
-	lengthData := EncodeLength(uint32(length))
-	if _, err := conn.Write(lengthData); err != nil {
-		return fmt.Errorf("Fail to write message length size:", err)
+
+	buffers := net.Buffers{buf}
+	if withData && len(data) != 0 {
+		buffers = append(buffers, data)
 	}
-	if _, err := conn.Write(data); err != nil {
-		return fmt.Errorf("Fail to write message:", err)
+	if _, err := buffers.WriteTo(conn); err != nil {
+		return fmt.Errorf("Fail to write message: %v", err)
 	}
 	return nil
 }
@@ -67,10 +135,11 @@ func ReadRequest(conn io.Reader) (*block.Request, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer util.PutBuffer(data)
 
 	req := &block.Request{}
-	if err := proto.Unmarshal(data, req); err != nil {
-		return nil, fmt.Errorf("Fail to decode message: ", err)
+	if err := req.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("Fail to decode message: %v", err)
 	}
 	return req, nil
 }
@@ -80,40 +149,39 @@ func ReadResponse(conn io.Reader) (*block.Response, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer util.PutBuffer(data)
 
 	resp := &block.Response{}
-	if err := proto.Unmarshal(data, resp); err != nil {
-		return nil, fmt.Errorf("Fail to decode message: ", err)
+	if err := resp.Unmarshal(data); err != nil {
+		return nil, fmt.Errorf("Fail to decode message: %v", err)
 	}
 	return resp, nil
 }
 
+// receive returns the message in a buffer from util.GetBuffer
 func receive(conn io.Reader) ([]byte, error) {
-	lengthData := make([]byte, MSG_HEADER_LENGTH)
+	lengthData := util.GetBuffer(MSG_HEADER_LENGTH)
+	defer util.PutBuffer(lengthData)
 	_, err := io.ReadFull(conn, lengthData)
 	if IsEOF(err) {
 		return nil, io.EOF
 	}
 	if err != nil {
-		return nil, fmt.Errorf("Fail to read message length size:", err)
+		return nil, fmt.Errorf("Fail to read message length size: %v", err)
 	}
 
 	length := DecodeLength(lengthData)
 	if length == 0 {
 		return nil, fmt.Errorf("Fail to decode message length size")
 	}
-	data := make([]byte, length)
+	data := util.GetBuffer(int(length))
 	if _, err := io.ReadFull(conn, data); err != nil {
-		return nil, fmt.Errorf("Fail to read message with size ", length, err)
+		util.PutBuffer(data)
+		return nil, fmt.Errorf("Fail to read message with size %v: %v", length, err)
 	}
 	return data, nil
 }
 
-func SendData(conn io.Writer, buf []byte) error {
-	_, err := conn.Write(buf)
-	return err
-}
-
 func ReceiveData(conn io.Reader, buf []byte) error {
 	_, err := io.ReadFull(conn, buf)
 	return err
@@ -1,74 +1,84 @@
 package rpc
 
 import (
+	"bufio"
 	"io"
 	"net"
 	"sync"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/util"
 )
 
+// RequestHandler handles the request synchronously, the data of the request
+// is reused once it returns. The data of the response belongs to the server,
+// it's put back with util.PutBuffer once sent.
 type RequestHandler func(*Request) (*Response, error)
 
+// Server handles the requests of a connection, each in a goroutine of its own
+// up to queueDepth at once, which is advertised to the client in the
+// handshake. The responses are sent as the requests complete, but the
+// changes overlapping are handled one after another in the order they
+// arrive.
 type Server struct {
 	conn           *net.TCPConn
-	requests       chan *Request
+	queueDepth     int
 	responses      chan *Response
-	workers        int
+	slots          chan struct{}
 	waitGroup      *sync.WaitGroup
 	requestHandler RequestHandler
+	stopped        chan struct{}
+
+	// the changes are handled in the order they arrive where they overlap
+	changes *util.RangeLock
 }
 
-func NewServer(c *net.TCPConn, workers int, handler RequestHandler) *Server {
-	server := &Server{
+func NewServer(c *net.TCPConn, queueDepth int, handler RequestHandler) *Server {
+	return &Server{
 		conn:           c,
-		responses:      make(chan *Response, workers),
-		requests:       make(chan *Request, workers),
-		workers:        workers,
+		queueDepth:     queueDepth,
+		responses:      make(chan *Response, queueDepth),
+		slots:          make(chan struct{}, queueDepth),
+		waitGroup:      &sync.WaitGroup{},
 		requestHandler: handler,
+		stopped:        make(chan struct{}),
+		changes:        util.NewRangeLock(),
 	}
-
-	server.waitGroup = &sync.WaitGroup{}
-	server.waitGroup.Add(workers)
-	return server
 }
 
 func (s *Server) Start() {
 	go s.startResponseProcess()
 	go s.startRequestProcess()
-	for i := 0; i < s.workers; i++ {
-		go func() {
-			defer s.waitGroup.Done()
-			s.requestWorker()
-		}()
-	}
 }
 
+// Stop closes the connection, and waits for the requests being handled
 func (s *Server) Stop() {
-	close(s.requests)
-	close(s.responses)
-	s.waitGroup.Wait()
+	s.conn.Close()
+	<-s.stopped
 }
 
 func (s *Server) startResponseProcess() {
+	defer close(s.stopped)
 	for resp := range s.responses {
-		if err := SendResponse(s.conn, resp.Header); err != nil {
+		if err := SendResponse(s.conn, resp); err != nil {
 			log.Error("Fail to send response: ", err)
-			continue
-		}
-		if resp.Header.Type == MSG_TYPE_READ_RESPONSE {
-			if err := SendData(s.conn, resp.Data); err != nil {
-				log.Error("Fail to send data:", err)
-				continue
-			}
 		}
+		util.PutBuffer(resp.Data)
 	}
 }
 
 func (s *Server) startRequestProcess() {
+	defer func() {
+		s.waitGroup.Wait()
+		close(s.responses)
+	}()
+
+	reader := bufio.NewReaderSize(s.conn, readBufferSize)
 	for {
 		var err error
 
 		req := &Request{}
-		req.Header, err = ReadRequest(s.conn)
+		req.Header, err = ReadRequest(reader)
 		if err == io.EOF {
 			break
 		}
@@ -77,24 +87,75 @@ func (s *Server) startRequestProcess() {
 			continue
 		}
 
-		if req.Header.Type == MSG_TYPE_WRITE_REQUEST {
-			req.Data = make([]byte, req.Header.Length)
-			if err := ReceiveData(s.conn, req.Data); err != nil {
+		if hasData(req.Header.Type) {
+			req.Data = util.GetBuffer(int(req.Header.Length))
+			if err := ReceiveData(reader, req.Data); err != nil {
 				log.Error("Fail to receive data:", err)
+				util.PutBuffer(req.Data)
 				continue
 			}
 		}
-		s.requests <- req
+
+		if req.Header.Type == MSG_TYPE_HANDSHAKE_REQUEST {
+			s.responses <- &Response{
+				Header: &block.Response{
+					Id:     req.Header.Id,
+					Type:   MSG_TYPE_HANDSHAKE_RESPONSE,
+					Length: int64(s.queueDepth),
+					Result: "Success",
+				},
+			}
+			continue
+		}
+
+		s.slots <- struct{}{}
+		hold := s.holdChanges(req.Header)
+		s.waitGroup.Add(1)
+		go s.handleRequest(req, hold)
 	}
 }
 
-func (s *Server) requestWorker() {
-	for req := range s.requests {
-		resp, err := s.requestHandler(req)
-		if err != nil {
-			log.Error("Error handling request: ", err)
-			continue
+// holdChanges takes the place of the request among the changes, a copy has
+// its source too so it's not changed under the copy. It returns nil if the
+// request doesn't change anything.
+func (s *Server) holdChanges(header *block.Request) *util.RangeHold {
+	switch header.Type {
+	case MSG_TYPE_WRITE_REQUEST, MSG_TYPE_DISCARD_REQUEST:
+		return s.changes.Hold(util.Range{Start: header.Offset, End: header.Offset + header.Length})
+	case MSG_TYPE_COPY_REQUEST:
+		return s.changes.Hold(
+			util.Range{Start: header.Offset, End: header.Offset + header.Length},
+			util.Range{Start: header.Source, End: header.Source + header.Length})
+	}
+	return nil
+}
+
+// handleRequest handles the request once the earlier changes overlapping it
+// are done, if it's a change
+func (s *Server) handleRequest(req *Request, hold *util.RangeHold) {
+	defer func() {
+		<-s.slots
+		s.waitGroup.Done()
+	}()
+
+	if hold != nil {
+		hold.Wait()
+	}
+	resp, err := s.requestHandler(req)
+	if hold != nil {
+		hold.Release()
+	}
+	util.PutBuffer(req.Data)
+	if err != nil {
+		log.Error("Error handling request: ", err)
+		// the client would wait for the response otherwise
+		resp = &Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   uint64(req.Header.Type + 1),
+				Result: err.Error(),
+			},
 		}
-		s.responses <- resp
 	}
+	s.responses <- resp
 }
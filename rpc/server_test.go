@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yasker/longhorn/block"
+)
+
+// TestServerOrder sends overlapping writes to a server without waiting for
+// their responses, with the handler delaying each randomly. The server
+// should apply those overlapping in the order sent.
+func TestServerOrder(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skip stress test in short mode")
+	}
+
+	const (
+		regionSize = 64 * 1024
+		sectorSize = 512
+		count      = 2000
+	)
+	region := make([]byte, regionSize)
+	mutex := &sync.Mutex{}
+	conn := serve(t, testQueueDepth, func(req *Request) (*Response, error) {
+		time.Sleep(time.Duration(rand.Int63n(int64(200 * time.Microsecond))))
+		mutex.Lock()
+		copy(region[req.Header.Offset:], req.Data)
+		mutex.Unlock()
+		return nullHandler(req)
+	})
+	defer conn.Close()
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	expected := make([]byte, regionSize)
+	errs := make(chan error, 1)
+	go func() {
+		for i := 1; i <= count; i++ {
+			start := random.Intn(regionSize / sectorSize)
+			length := 1 + random.Intn(16)
+			if start+length > regionSize/sectorSize {
+				length = regionSize/sectorSize - start
+			}
+			data := make([]byte, length*sectorSize)
+			for j := 0; j < len(data); j += 8 {
+				binary.BigEndian.PutUint64(data[j:], uint64(i))
+			}
+			copy(expected[start*sectorSize:], data)
+			if err := SendRequest(conn, &Request{
+				Header: &block.Request{
+					Id:     int64(i),
+					Type:   MSG_TYPE_WRITE_REQUEST,
+					Offset: int64(start * sectorSize),
+					Length: int64(len(data)),
+				},
+				Data: data,
+			}); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < count; i++ {
+		resp, err := ReadResponse(reader)
+		if err != nil {
+			t.Fatal("Fail to read response: ", err)
+		}
+		if resp.Result != "Success" {
+			t.Fatalf("Write %v failed: %v", resp.Id, resp.Result)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal("Fail to send write: ", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !bytes.Equal(region, expected) {
+		t.Fatal("The last writes sent are not the last ones applied by the server")
+	}
+}
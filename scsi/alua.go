@@ -0,0 +1,187 @@
+package scsi
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	// service actions of MAINTENANCE IN and MAINTENANCE OUT
+	MI_REPORT_TARGET_PGS = 0x0a
+	MO_SET_TARGET_PGS    = 0x0a
+
+	// asymmetric access states
+	ALUA_ACTIVE_OPTIMIZED    = 0x00
+	ALUA_ACTIVE_NONOPTIMIZED = 0x01
+	ALUA_STANDBY             = 0x02
+	ALUA_UNAVAILABLE         = 0x03
+	ALUA_TRANSITIONING       = 0x0f
+
+	// supported states of the target port group descriptor, T_SUP, U_SUP,
+	// S_SUP and AO_SUP
+	ALUA_SUPPORTED_STATES = 0x80 | 0x08 | 0x04 | 0x01
+
+	// TPGS of the standard INQUIRY data, implicit and explicit ALUA
+	ALUA_TPGS = 0x30
+)
+
+// PortGroup is a target port group of the volume. Each controller fronting
+// the volume is a group with a single target port, whose relative target
+// port identifier is the same as the group ID.
+type PortGroup struct {
+	ID    uint16
+	State byte
+}
+
+// ALUA decides the asymmetric access states of the device, when more than one
+// controller fronts the same replicas.
+type ALUA interface {
+	// PortGroups returns all the target port groups of the volume, the
+	// local one first
+	PortGroups() []PortGroup
+	// Activate makes the local port group active/optimized, for SET TARGET
+	// PORT GROUPS
+	Activate() error
+}
+
+// EnableALUA makes the device report the target port groups of alua, and
+// refuse the commands the local access state doesn't allow. It should be
+// called before serving any command.
+func (d *Device) EnableALUA(alua ALUA) {
+	d.alua = alua
+	// they were loaded without knowing if the device is active
+	d.reloadReservations = 1
+}
+
+func (d *Device) localPortGroup() PortGroup {
+	return d.alua.PortGroups()[0]
+}
+
+func isActive(state byte) bool {
+	return state == ALUA_ACTIVE_OPTIMIZED || state == ALUA_ACTIVE_NONOPTIMIZED
+}
+
+// stateSense returns the sense of the commands refused in an inactive state
+func stateSense(state byte) []byte {
+	switch state {
+	case ALUA_STANDBY:
+		return BuildSense(NOT_READY, ASC_LUN_NOT_ACCESSIBLE_STANDBY)
+	case ALUA_UNAVAILABLE:
+		return BuildSense(NOT_READY, ASC_LUN_NOT_ACCESSIBLE_UNAVAILABLE)
+	}
+	return BuildSense(NOT_READY, ASC_LUN_NOT_ACCESSIBLE_TRANSITIONING)
+}
+
+// checkAccess returns the sense if the local access state doesn't allow the
+// command, see SPC-4 5.11.2.4
+func (d *Device) checkAccess(cdb []byte) []byte {
+	if d.alua == nil {
+		return nil
+	}
+	state := d.localPortGroup().State
+	if isActive(state) {
+		if atomic.CompareAndSwapInt32(&d.reloadReservations, 1, 0) {
+			// the other controller may have changed them while this
+			// one wasn't active
+			if err := d.reservations.reload(); err != nil {
+				log.Errorln("reload persistent reservations failed: ", err)
+				atomic.StoreInt32(&d.reloadReservations, 1)
+				return BuildSense(NOT_READY, ASC_LUN_NOT_ACCESSIBLE_TRANSITIONING)
+			}
+		}
+		return nil
+	}
+	atomic.StoreInt32(&d.reloadReservations, 1)
+
+	switch cdb[0] {
+	case INQUIRY, REPORT_LUNS, REQUEST_SENSE, MAINTENANCE_IN:
+		return nil
+	case MODE_SENSE, MODE_SENSE_10, MODE_SELECT, MODE_SELECT_10, MAINTENANCE_OUT:
+		if state != ALUA_TRANSITIONING {
+			return nil
+		}
+	}
+	// unlike SPC-4, PERSISTENT RESERVE IN and OUT are refused in standby
+	// as well, the reservations belong to the active controller
+	return stateSense(state)
+}
+
+func (d *Device) handleReportTargetPortGroups(cdb []byte) (byte, []byte, []byte) {
+	extended := false
+	switch cdb[1] >> 5 {
+	case 0:
+	case 1:
+		extended = true
+	default:
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+
+	var data []byte
+	if extended {
+		// no implicit transition time
+		data = make([]byte, 8)
+		data[4] = 0x10
+	} else {
+		data = make([]byte, 4)
+	}
+	for _, group := range d.alua.PortGroups() {
+		desc := make([]byte, 12)
+		desc[0] = group.State
+		desc[1] = ALUA_SUPPORTED_STATES
+		binary.BigEndian.PutUint16(desc[2:], group.ID)
+		desc[7] = 1 // target port count
+		binary.BigEndian.PutUint16(desc[10:], group.ID)
+		data = append(data, desc...)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return SAM_STAT_GOOD, truncate(data, int(binary.BigEndian.Uint32(cdb[6:]))), nil
+}
+
+// handleSetTargetPortGroups only lets the initiator activate the local port
+// group, the others would be fenced by the activation
+func (d *Device) handleSetTargetPortGroups(cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	length := int(binary.BigEndian.Uint32(cdb[6:]))
+	if length == 0 {
+		return SAM_STAT_GOOD, nil, nil
+	}
+	if length < 4 || len(dataOut) < length || (length-4)%4 != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+
+	local := d.localPortGroup()
+	activate := false
+	descs := dataOut[4:length]
+	for i := 0; i < len(descs); i += 4 {
+		state := descs[i] & 0x0f
+		id := binary.BigEndian.Uint16(descs[i+2:])
+		switch {
+		case id == local.ID && isActive(state):
+			activate = true
+		case id != local.ID && (state == ALUA_STANDBY || state == ALUA_UNAVAILABLE):
+		default:
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+		}
+	}
+	if activate && local.State != ALUA_ACTIVE_OPTIMIZED {
+		if err := d.alua.Activate(); err != nil {
+			log.Errorln("activate port group failed: ", err)
+			return CheckCondition(HARDWARE_ERROR, ASC_SET_TARGET_PORT_GROUPS_FAILED)
+		}
+	}
+	return SAM_STAT_GOOD, nil, nil
+}
+
+// portDesignators returns the relative target port and target port group
+// designation descriptors of VPD page 0x83
+func (d *Device) portDesignators() []byte {
+	if d.alua == nil {
+		return nil
+	}
+	id := d.localPortGroup().ID
+	// binary, associated with the target port
+	relativePort := []byte{0x01, 0x14, 0x00, 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(relativePort[6:], id)
+	portGroup := []byte{0x01, 0x15, 0x00, 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(portGroup[6:], id)
+	return append(relativePort, portGroup...)
+}
@@ -0,0 +1,77 @@
+package scsi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// CDBLength returns the length of the CDB from its operation code, or 0 if
+// the group is variable length or vendor specific.
+func CDBLength(opcode byte) int {
+	switch opcode >> 5 {
+	case 0:
+		return 6
+	case 1, 2:
+		return 10
+	case 4:
+		return 16
+	case 5:
+		return 12
+	}
+	return 0
+}
+
+// GetLBA returns the logical block address of READ and WRITE commands
+func GetLBA(cdb []byte) (uint64, error) {
+	if err := checkLength(cdb); err != nil {
+		return 0, err
+	}
+	switch CDBLength(cdb[0]) {
+	case 6:
+		return uint64(cdb[1]&0x1f)<<16 | uint64(cdb[2])<<8 | uint64(cdb[3]), nil
+	case 10, 12:
+		return uint64(binary.BigEndian.Uint32(cdb[2:])), nil
+	case 16:
+		return binary.BigEndian.Uint64(cdb[2:]), nil
+	}
+	return 0, fmt.Errorf("Cannot get LBA from command 0x%x", cdb[0])
+}
+
+// GetTransferLength returns the number of blocks of READ and WRITE commands
+func GetTransferLength(cdb []byte) (uint32, error) {
+	if err := checkLength(cdb); err != nil {
+		return 0, err
+	}
+	switch CDBLength(cdb[0]) {
+	case 6:
+		// 0 means 256 blocks for READ(6) and WRITE(6)
+		if cdb[4] == 0 {
+			return 256, nil
+		}
+		return uint32(cdb[4]), nil
+	case 10:
+		return uint32(binary.BigEndian.Uint16(cdb[7:])), nil
+	case 12:
+		return binary.BigEndian.Uint32(cdb[6:]), nil
+	case 16:
+		return binary.BigEndian.Uint32(cdb[10:]), nil
+	}
+	return 0, fmt.Errorf("Cannot get transfer length from command 0x%x", cdb[0])
+}
+
+// GetFUA tells if the write has to reach stable storage before completion
+func GetFUA(cdb []byte) bool {
+	// there is no FUA bit in READ(6) and WRITE(6)
+	return CDBLength(cdb[0]) != 6 && cdb[1]&0x08 != 0
+}
+
+func checkLength(cdb []byte) error {
+	if len(cdb) == 0 {
+		return fmt.Errorf("Empty CDB")
+	}
+	length := CDBLength(cdb[0])
+	if length == 0 || len(cdb) < length {
+		return fmt.Errorf("Invalid CDB length %v for command 0x%x", len(cdb), cdb[0])
+	}
+	return nil
+}
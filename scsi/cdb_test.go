@@ -0,0 +1,75 @@
+package scsi
+
+import (
+	"testing"
+)
+
+func TestCDBLength(t *testing.T) {
+	for opcode, length := range map[byte]int{
+		READ_6:               6,
+		WRITE_6:              6,
+		READ_10:              10,
+		WRITE_10:             10,
+		MODE_SENSE_10:        10,
+		READ_12:              12,
+		WRITE_12:             12,
+		READ_16:              16,
+		WRITE_16:             16,
+		SERVICE_ACTION_IN_16: 16,
+		0x7f:                 0, // variable length
+		0xc0:                 0, // vendor specific
+	} {
+		if l := CDBLength(opcode); l != length {
+			t.Errorf("CDB length of 0x%x is %v, expected %v", opcode, l, length)
+		}
+	}
+}
+
+func TestReadWriteCDB(t *testing.T) {
+	for _, c := range []struct {
+		cdb    []byte
+		lba    uint64
+		blocks uint32
+		fua    bool
+	}{
+		// the LBA of the 6 bytes CDBs has 21 bits, 0 blocks means 256
+		{[]byte{READ_6, 0xff, 0x34, 0x56, 0x08, 0x00}, 0x1f3456, 8, false},
+		{[]byte{WRITE_6, 0x01, 0x02, 0x03, 0x00, 0x00}, 0x010203, 256, false},
+		{[]byte{READ_10, 0x00, 0x12, 0x34, 0x56, 0x78, 0x00, 0x01, 0x00, 0x00}, 0x12345678, 256, false},
+		{[]byte{WRITE_10, 0x08, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0x00}, 0xffffffff, 0xffff, true},
+		{[]byte{READ_12, 0x08, 0x00, 0x00, 0x10, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}, 0x1000, 0x10000, true},
+		{[]byte{WRITE_12, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00}, 1, 8, false},
+		{[]byte{READ_16, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+			0x00, 0x00, 0x00, 0x20, 0x00, 0x00}, 0x0102030405060708, 32, false},
+		{[]byte{WRITE_16, 0x08, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00}, 0x100000000, 0x1000000, true},
+	} {
+		lba, err := GetLBA(c.cdb)
+		if err != nil || lba != c.lba {
+			t.Errorf("LBA of %x is 0x%x, %v, expected 0x%x", c.cdb, lba, err, c.lba)
+		}
+		blocks, err := GetTransferLength(c.cdb)
+		if err != nil || blocks != c.blocks {
+			t.Errorf("Transfer length of %x is %v, %v, expected %v", c.cdb, blocks, err, c.blocks)
+		}
+		if fua := GetFUA(c.cdb); fua != c.fua {
+			t.Errorf("FUA of %x is %v, expected %v", c.cdb, fua, c.fua)
+		}
+	}
+}
+
+func TestInvalidCDB(t *testing.T) {
+	for _, cdb := range [][]byte{
+		{},
+		{READ_10, 0, 0, 0, 0, 0, 0, 0, 0},
+		{WRITE_16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{0x7f, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if _, err := GetLBA(cdb); err == nil {
+			t.Errorf("LBA of %x should fail", cdb)
+		}
+		if _, err := GetTransferLength(cdb); err == nil {
+			t.Errorf("Transfer length of %x should fail", cdb)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package scsi
+
+import (
+	"encoding/binary"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/types"
+	"github.com/yasker/longhorn/util"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "scsi"})
+)
+
+// Device emulates a SCSI disk on top of a volume, for all the frontends
+// speaking SCSI.
+type Device struct {
+	name         string
+	volume       types.Volume
+	lbas         int64
+	blockSize    int
+	reservations *reservationState
+	// the frontend can't tell the initiators apart, see DisableReservations
+	noReservations bool
+	alua           ALUA
+	// set when the persistent reservations have to be loaded again before
+	// the device is active, accessed atomically
+	reloadReservations int32
+}
+
+// NewDevice creates the disk for volume name, whose size should be a
+// multiple of blockSize. The name is reported as the serial number. The
+// persistent reservations are loaded from the volume if it keeps them.
+func NewDevice(name string, volume types.Volume, blockSize int) (*Device, error) {
+	reservations, err := newReservationState(volume)
+	if err != nil {
+		return nil, err
+	}
+	return &Device{
+		name:         name,
+		volume:       volume,
+		lbas:         volume.Size() / int64(blockSize),
+		blockSize:    blockSize,
+		reservations: reservations,
+	}, nil
+}
+
+// DisableReservations makes the device refuse PERSISTENT RESERVE IN and OUT,
+// for the frontends which see all the initiators as one I_T nexus. The
+// reservations made through other frontends are still enforced.
+func (d *Device) DisableReservations() {
+	d.noReservations = true
+}
+
+// HandleCommand executes cdb with dataOut sent by the initiator through the
+// I_T nexus, which identifies the initiator for persistent reservations.
+// Returns the SCSI status, the data for the initiator and the sense data for
+// CHECK CONDITION. The data is not truncated to what the initiator expects,
+// the frontend should do it. The data belongs to the frontend, it may be put
+// back with util.PutBuffer once sent.
+func (d *Device) HandleCommand(nexus string, cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	if len(cdb) == 0 || len(cdb) < CDBLength(cdb[0]) {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	if sense := d.checkAccess(cdb); sense != nil {
+		return SAM_STAT_CHECK_CONDITION, nil, sense
+	}
+	if d.reservations.conflicts(nexus, cdb) {
+		return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+	}
+
+	switch cdb[0] {
+	case TEST_UNIT_READY:
+		return SAM_STAT_GOOD, nil, nil
+	case REQUEST_SENSE:
+		return d.handleRequestSense(cdb)
+	case INQUIRY:
+		return d.handleInquiry(cdb)
+	case REPORT_LUNS:
+		return handleReportLuns(cdb)
+	case FORMAT_UNIT:
+		// there is nothing to format, but the format parameters, e.g.
+		// protection information, aren't supported
+		if cdb[1]&0x10 != 0 {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+		}
+		return SAM_STAT_GOOD, nil, nil
+	case START_STOP:
+		// the volume is always started, and cannot be ejected
+		if cdb[4]&0x02 != 0 {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+		}
+		return SAM_STAT_GOOD, nil, nil
+	case ALLOW_MEDIUM_REMOVAL:
+		// not removable, nothing to prevent
+		return SAM_STAT_GOOD, nil, nil
+	case READ_BUFFER:
+		return handleReadBuffer(cdb)
+	case READ_CAPACITY:
+		return d.handleReadCapacity10(cdb)
+	case SERVICE_ACTION_IN_16:
+		if cdb[1]&0x1f == READ_CAPACITY_16 {
+			return d.handleReadCapacity16(cdb)
+		}
+	case MODE_SENSE, MODE_SENSE_10:
+		return d.handleModeSense(cdb)
+	case MODE_SELECT, MODE_SELECT_10:
+		return d.handleModeSelect(cdb, dataOut)
+	case SYNCHRONIZE_CACHE, SYNCHRONIZE_CACHE_16:
+		if err := d.volume.Flush(); err != nil {
+			log.Errorln("flush failed: ", err)
+			return CheckCondition(MEDIUM_ERROR, ASC_WRITE_ERROR)
+		}
+		return SAM_STAT_GOOD, nil, nil
+	case UNMAP:
+		return d.handleUnmap(cdb, dataOut)
+	case MAINTENANCE_IN:
+		switch cdb[1] & 0x1f {
+		case MI_REPORT_SUPPORTED_OPCODES:
+			return d.handleReportSupportedOpcodes(cdb)
+		case MI_REPORT_TARGET_PGS:
+			if d.alua != nil {
+				return d.handleReportTargetPortGroups(cdb)
+			}
+		}
+	case MAINTENANCE_OUT:
+		if cdb[1]&0x1f == MO_SET_TARGET_PGS && d.alua != nil {
+			return d.handleSetTargetPortGroups(cdb, dataOut)
+		}
+	case PERSISTENT_RESERVE_IN:
+		if !d.noReservations {
+			return d.handlePersistentReserveIn(cdb)
+		}
+	case PERSISTENT_RESERVE_OUT:
+		if !d.noReservations {
+			return d.handlePersistentReserveOut(nexus, cdb, dataOut)
+		}
+	case READ_6, READ_10, READ_12, READ_16:
+		return d.handleRead(cdb)
+	case WRITE_6, WRITE_10, WRITE_12, WRITE_16:
+		return d.handleWrite(cdb, dataOut)
+	case VERIFY, VERIFY_12, VERIFY_16:
+		return d.handleVerify(cdb, dataOut)
+	case EXTENDED_COPY:
+		return d.handleExtendedCopy(cdb, dataOut)
+	case RECEIVE_COPY_RESULTS:
+		return d.handleReceiveCopyResults(cdb)
+	}
+	log.Errorf("unknown command 0x%x", cdb[0])
+	return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_OPCODE)
+}
+
+// getRange returns the offset and length in bytes of READ and WRITE
+// commands, or the sense for an invalid range
+func (d *Device) getRange(cdb []byte) (int64, int64, []byte) {
+	lba, err := GetLBA(cdb)
+	if err != nil {
+		return 0, 0, BuildSense(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	blocks, err := GetTransferLength(cdb)
+	if err != nil {
+		return 0, 0, BuildSense(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	if lba > uint64(d.lbas) || uint64(blocks) > uint64(d.lbas)-lba {
+		return 0, 0, BuildSense(ILLEGAL_REQUEST, ASC_LBA_OUT_OF_RANGE)
+	}
+	if uint64(blocks)*uint64(d.blockSize) > MAX_TRANSFER_LENGTH {
+		return 0, 0, BuildSense(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	return int64(lba) * int64(d.blockSize), int64(blocks) * int64(d.blockSize), nil
+}
+
+func (d *Device) handleRead(cdb []byte) (byte, []byte, []byte) {
+	offset, length, sense := d.getRange(cdb)
+	if sense != nil {
+		return SAM_STAT_CHECK_CONDITION, nil, sense
+	}
+
+	buf := util.GetBuffer(int(length))
+	if _, err := d.volume.ReadAt(buf, offset); err != nil {
+		log.Errorln("read failed: ", err)
+		util.PutBuffer(buf)
+		return CheckCondition(MEDIUM_ERROR, ASC_READ_ERROR)
+	}
+	return SAM_STAT_GOOD, buf, nil
+}
+
+func (d *Device) handleWrite(cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	offset, length, sense := d.getRange(cdb)
+	if sense != nil {
+		return SAM_STAT_CHECK_CONDITION, nil, sense
+	}
+	if int64(len(dataOut)) < length {
+		log.Errorf("write failed: expect %v bytes, got %v", length, len(dataOut))
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+
+	if _, err := d.volume.WriteAt(dataOut[:length], offset); err != nil {
+		log.Errorln("write failed: ", err)
+		return CheckCondition(MEDIUM_ERROR, ASC_WRITE_ERROR)
+	}
+	if GetFUA(cdb) {
+		if err := d.volume.Flush(); err != nil {
+			log.Errorln("flush failed: ", err)
+			return CheckCondition(MEDIUM_ERROR, ASC_WRITE_ERROR)
+		}
+	}
+	return SAM_STAT_GOOD, nil, nil
+}
+
+// handleVerify reads the range back from the volume, and compares it with the
+// data of the initiator if BYTCHK is set
+func (d *Device) handleVerify(cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	offset, length, sense := d.getRange(cdb)
+	if sense != nil {
+		return SAM_STAT_CHECK_CONDITION, nil, sense
+	}
+	byteCheck := (cdb[1] >> 1) & 0x03
+	expectedLength := length
+	switch byteCheck {
+	case 0x00:
+		expectedLength = 0
+	case 0x02:
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	case 0x03:
+		// a single block to compare every block with
+		if length != 0 {
+			expectedLength = int64(d.blockSize)
+		}
+	}
+	if int64(len(dataOut)) < expectedLength {
+		log.Errorf("verify failed: expect %v bytes, got %v", expectedLength, len(dataOut))
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+
+	buf := util.GetBuffer(int(length))
+	defer util.PutBuffer(buf)
+	if _, err := d.volume.ReadAt(buf, offset); err != nil {
+		log.Errorln("verify failed: ", err)
+		return CheckCondition(MEDIUM_ERROR, ASC_READ_ERROR)
+	}
+	if byteCheck == 0x00 {
+		return SAM_STAT_GOOD, nil, nil
+	}
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != dataOut[int64(i)%expectedLength] {
+			sense := BuildSense(MISCOMPARE, ASC_MISCOMPARE_DURING_VERIFY)
+			// the information field is the offset of the first
+			// different byte
+			sense[0] |= 0x80
+			binary.BigEndian.PutUint32(sense[3:], uint32(i))
+			return SAM_STAT_CHECK_CONDITION, nil, sense
+		}
+	}
+	return SAM_STAT_GOOD, nil, nil
+}
+
+func (d *Device) handleReadCapacity10(cdb []byte) (byte, []byte, []byte) {
+	data := make([]byte, 8)
+	lastLBA := uint64(d.lbas - 1)
+	if lastLBA > 0xffffffff {
+		// the initiator should try READ CAPACITY(16)
+		lastLBA = 0xffffffff
+	}
+	binary.BigEndian.PutUint32(data, uint32(lastLBA))
+	binary.BigEndian.PutUint32(data[4:], uint32(d.blockSize))
+	return SAM_STAT_GOOD, data, nil
+}
+
+func (d *Device) handleReadCapacity16(cdb []byte) (byte, []byte, []byte) {
+	data := make([]byte, 32)
+	binary.BigEndian.PutUint64(data, uint64(d.lbas-1))
+	binary.BigEndian.PutUint32(data[8:], uint32(d.blockSize))
+	data[14] = 0x80 | 0x40 // LBPME, LBPRZ
+	return SAM_STAT_GOOD, truncate(data, int(binary.BigEndian.Uint32(cdb[10:]))), nil
+}
+
+func (d *Device) handleUnmap(cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	// ANCHOR is not supported
+	if cdb[1]&0x01 != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	length := int(binary.BigEndian.Uint16(cdb[7:]))
+	if length == 0 {
+		return SAM_STAT_GOOD, nil, nil
+	}
+	if length < 8 || len(dataOut) < length {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	descLength := int(binary.BigEndian.Uint16(dataOut[2:]))
+	if descLength > length-8 || descLength%16 != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	if descLength/16 > MAX_UNMAP_DESCRIPTORS {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+	}
+
+	// check all of them before discarding anything
+	descs := dataOut[8 : 8+descLength]
+	for i := 0; i < len(descs); i += 16 {
+		lba := binary.BigEndian.Uint64(descs[i:])
+		blocks := uint64(binary.BigEndian.Uint32(descs[i+8:]))
+		if lba > uint64(d.lbas) || blocks > uint64(d.lbas)-lba {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_LBA_OUT_OF_RANGE)
+		}
+		if blocks*uint64(d.blockSize) > MAX_UNMAP_LENGTH {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+		}
+	}
+	for i := 0; i < len(descs); i += 16 {
+		lba := int64(binary.BigEndian.Uint64(descs[i:]))
+		blocks := int64(binary.BigEndian.Uint32(descs[i+8:]))
+		if blocks == 0 {
+			continue
+		}
+		if err := d.volume.Discard(lba*int64(d.blockSize), blocks*int64(d.blockSize)); err != nil {
+			log.Errorln("unmap failed: ", err)
+			return CheckCondition(MEDIUM_ERROR, ASC_WRITE_ERROR)
+		}
+	}
+	return SAM_STAT_GOOD, nil, nil
+}
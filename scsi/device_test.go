@@ -0,0 +1,254 @@
+package scsi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/yasker/longhorn/test/testvolume"
+)
+
+const (
+	testName      = "test"
+	testSize      = int64(1024 * 1024 * 1024)
+	testBlockSize = 512
+	testNexus     = "iqn.2016-04.com.rancher:initiator,i,0x800000000001"
+)
+
+func newTestDevice(t *testing.T) *Device {
+	d, err := NewDevice(testName, testvolume.New(testSize), testBlockSize)
+	if err != nil {
+		t.Fatal("Fail to create device: ", err)
+	}
+	return d
+}
+
+// unhex decodes the golden data, which may be split by spaces
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+type golden struct {
+	name   string
+	cdb    string
+	status byte
+	data   string
+	sense  string
+}
+
+func checkGolden(t *testing.T, d *Device, cases []golden) {
+	for _, c := range cases {
+		status, data, sense := d.HandleCommand(testNexus, unhex(c.cdb), nil)
+		if status != c.status {
+			t.Errorf("%v: status 0x%x, expected 0x%x", c.name, status, c.status)
+		}
+		if !bytes.Equal(data, unhex(c.data)) {
+			t.Errorf("%v: data\n%x\nexpected\n%x", c.name, data, unhex(c.data))
+		}
+		if !bytes.Equal(sense, unhex(c.sense)) {
+			t.Errorf("%v: sense\n%x\nexpected\n%x", c.name, sense, unhex(c.sense))
+		}
+	}
+}
+
+func TestInquiry(t *testing.T) {
+	checkGolden(t, newTestDevice(t), []golden{
+		{
+			name: "standard",
+			cdb:  "12 00 00 00 ff 00",
+			data: "00 00 05 02 1f 08 00 02" +
+				"4c 49 4f 2d 4f 52 47 20" + // LIO-ORG
+				"54 43 4d 55 20 64 65 76 69 63 65 20 20 20 20 20" + // TCMU device
+				"30 30 30 32", // 0002
+		},
+		{
+			name: "standard, truncated",
+			cdb:  "12 00 00 00 08 00",
+			data: "00 00 05 02 1f 08 00 02",
+		},
+		{
+			name: "supported pages",
+			cdb:  "12 01 00 00 ff 00",
+			data: "00 00 00 06 00 80 83 b0 b1 b2",
+		},
+		{
+			name: "unit serial number",
+			cdb:  "12 01 80 00 ff 00",
+			data: "00 80 00 04 74 65 73 74",
+		},
+		{
+			name: "device identification",
+			cdb:  "12 01 83 00 ff 00",
+			data: "00 83 00 24" +
+				// NAA 6 of LIO, from the SHA-1 of the name
+				"01 03 00 10 60 01 40 5a 94 a8 fe 5c cb 19 ba 61 c4 c0 87 3d" +
+				// T10 vendor ID, then the name
+				"02 01 00 0c 4c 49 4f 2d 4f 52 47 20 74 65 73 74",
+		},
+		{
+			name: "block limits",
+			cdb:  "12 01 b0 00 ff 00",
+			data: "00 b0 00 3c" +
+				"00 00 00 08" + // optimal transfer length granularity
+				"00 01 00 00" + // maximum transfer length
+				"00 01 00 00" + // optimal transfer length
+				"00 00 00 00" +
+				"00 20 00 00" + // maximum unmap LBA count
+				"00 00 00 40" + // maximum unmap block descriptor count
+				"00 00 00 08" + // optimal unmap granularity
+				strings.Repeat("00", 0x3c-28),
+		},
+		{
+			name: "block device characteristics",
+			cdb:  "12 01 b1 00 ff 00",
+			data: "00 b1 00 3c 00 01" + strings.Repeat("00", 0x3c-2),
+		},
+		{
+			name: "logical block provisioning",
+			cdb:  "12 01 b2 00 ff 00",
+			data: "00 b2 00 04 00 84 02 00",
+		},
+		{
+			name:   "unknown page",
+			cdb:    "12 01 c0 00 ff 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 24 00 00 00 00 00",
+		},
+		{
+			name:   "page code without EVPD",
+			cdb:    "12 00 80 00 ff 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 24 00 00 00 00 00",
+		},
+	})
+}
+
+func TestModeSense(t *testing.T) {
+	recovery := "01 0a 00 00 00 00 00 00 00 00 00 00"
+	caching := "08 12 04 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00"
+	control := "0a 0a 00 00 00 00 00 00 00 00 00 00"
+	checkGolden(t, newTestDevice(t), []golden{
+		{
+			name: "all pages",
+			cdb:  "1a 00 3f 00 ff 00",
+			data: "2f 00 10 00" + recovery + caching + control,
+		},
+		{
+			name: "caching, 10 bytes",
+			cdb:  "5a 00 08 00 00 00 00 00 ff 00",
+			data: "00 1a 00 10 00 00 00 00" + caching,
+		},
+		{
+			name: "caching, changeable",
+			cdb:  "1a 00 48 00 ff 00",
+			data: "17 00 10 00 08 12" + strings.Repeat("00", 18),
+		},
+		{
+			name: "truncated",
+			cdb:  "1a 00 3f 00 06 00",
+			data: "2f 00 10 00 01 0a",
+		},
+		{
+			name:   "saved",
+			cdb:    "1a 00 ff 00 ff 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 39 00 00 00 00 00",
+		},
+		{
+			name:   "subpage",
+			cdb:    "1a 00 08 01 ff 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 24 00 00 00 00 00",
+		},
+	})
+}
+
+func TestReadCapacity(t *testing.T) {
+	checkGolden(t, newTestDevice(t), []golden{
+		{
+			name: "10",
+			cdb:  "25 00 00 00 00 00 00 00 00 00",
+			data: "00 1f ff ff 00 00 02 00",
+		},
+		{
+			name: "16",
+			cdb:  "9e 10 00 00 00 00 00 00 00 00 00 00 00 20 00 00",
+			data: "00 00 00 00 00 1f ff ff 00 00 02 00 00 00 c0 00" + strings.Repeat("00", 16),
+		},
+		{
+			name: "16, truncated",
+			cdb:  "9e 10 00 00 00 00 00 00 00 00 00 00 00 0c 00 00",
+			data: "00 00 00 00 00 1f ff ff 00 00 02 00",
+		},
+	})
+}
+
+func TestSense(t *testing.T) {
+	checkGolden(t, newTestDevice(t), []golden{
+		{
+			name: "request sense",
+			cdb:  "03 00 00 00 ff 00",
+			data: "70 00 00 00 00 00 00 0a 00 00 00 00 00 00 00 00 00 00",
+		},
+		{
+			name:   "unknown opcode",
+			cdb:    "ff 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 20 00 00 00 00 00",
+		},
+		{
+			name:   "LBA out of range",
+			cdb:    "28 00 00 20 00 00 00 00 01 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 21 00 00 00 00 00",
+		},
+		{
+			name:   "too long",
+			cdb:    "88 00 00 00 00 00 00 00 00 00 00 01 00 01 00 00",
+			status: SAM_STAT_CHECK_CONDITION,
+			sense:  "70 00 05 00 00 00 00 0a 00 00 00 00 24 00 00 00 00 00",
+		},
+	})
+
+	// the information field has the offset of the first different byte
+	d := newTestDevice(t)
+	dataOut := make([]byte, testBlockSize)
+	dataOut[100] = 1
+	status, _, sense := d.HandleCommand(testNexus, unhex("2f 02 00 00 00 00 00 00 01 00"), dataOut)
+	expected := unhex("f0 00 0e 00 00 00 64 0a 00 00 00 00 1d 00 00 00 00 00")
+	if status != SAM_STAT_CHECK_CONDITION || !bytes.Equal(sense, expected) {
+		t.Errorf("verify: status 0x%x, sense\n%x\nexpected\n%x", status, sense, expected)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	d := newTestDevice(t)
+	data := bytes.Repeat([]byte{0x5a}, 8*testBlockSize)
+	for _, c := range []struct {
+		write string
+		read  string
+	}{
+		{"0a 00 00 10 08 00", "08 00 00 10 08 00"},
+		{"2a 00 00 00 00 20 00 00 08 00", "28 00 00 00 00 20 00 00 08 00"},
+		{"aa 08 00 00 00 30 00 00 00 08 00 00", "a8 00 00 00 00 30 00 00 00 08 00 00"},
+		{"8a 00 00 00 00 00 00 1f ff f8 00 00 00 08 00 00", "88 00 00 00 00 00 00 1f ff f8 00 00 00 08 00 00"},
+	} {
+		if status, _, sense := d.HandleCommand(testNexus, unhex(c.write), data); status != SAM_STAT_GOOD {
+			t.Fatalf("%v failed with sense %x", c.write, sense)
+		}
+		status, read, sense := d.HandleCommand(testNexus, unhex(c.read), nil)
+		if status != SAM_STAT_GOOD || !bytes.Equal(read, data) {
+			t.Fatalf("%v failed with sense %x", c.read, sense)
+		}
+	}
+	// written nowhere else
+	status, read, _ := d.HandleCommand(testNexus, unhex("28 00 00 00 00 18 00 00 08 00"), nil)
+	if status != SAM_STAT_GOOD || !bytes.Equal(read, make([]byte, len(data))) {
+		t.Fatal("Blocks not written are not zeroes")
+	}
+}
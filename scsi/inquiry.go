@@ -0,0 +1,140 @@
+package scsi
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+const (
+	// same as libtcmu reported, so the existing udev rules keep working
+	VENDOR_ID   = "LIO-ORG"
+	PRODUCT_ID  = "TCMU device"
+	PRODUCT_REV = "0002"
+
+	VPD_SUPPORTED_PAGES         = 0x00
+	VPD_UNIT_SERIAL             = 0x80
+	VPD_DEVICE_ID               = 0x83
+	VPD_BLOCK_LIMITS            = 0xb0
+	VPD_BLOCK_DEVICE_CHARACTERS = 0xb1
+	VPD_LB_PROVISIONING         = 0xb2
+
+	// IEEE company ID of LIO, as libtcmu used in the NAA designator
+	NAA_COMPANY_ID = "001405"
+)
+
+func (d *Device) handleInquiry(cdb []byte) (byte, []byte, []byte) {
+	allocationLength := int(binary.BigEndian.Uint16(cdb[3:]))
+
+	// CMDDT is obsolete
+	if cdb[1]&0x02 != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	if cdb[1]&0x01 == 0 {
+		if cdb[2] != 0 {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+		}
+		return SAM_STAT_GOOD, truncate(d.standardInquiry(), allocationLength), nil
+	}
+
+	var page []byte
+	switch cdb[2] {
+	case VPD_SUPPORTED_PAGES:
+		page = []byte{VPD_SUPPORTED_PAGES, VPD_UNIT_SERIAL, VPD_DEVICE_ID,
+			VPD_BLOCK_LIMITS, VPD_BLOCK_DEVICE_CHARACTERS, VPD_LB_PROVISIONING}
+	case VPD_UNIT_SERIAL:
+		page = []byte(d.name)
+	case VPD_DEVICE_ID:
+		page = d.deviceIdentification()
+	case VPD_BLOCK_LIMITS:
+		page = d.blockLimits()
+	case VPD_BLOCK_DEVICE_CHARACTERS:
+		page = make([]byte, 0x3c)
+		binary.BigEndian.PutUint16(page, 1) // non-rotating medium
+	case VPD_LB_PROVISIONING:
+		page = make([]byte, 4)
+		// UNMAP is supported, and the unmapped blocks are read as zeroes
+		page[1] = 0x80 | 0x04 // LBPU, LBPRZ
+		page[2] = 0x02        // thin provisioned
+	default:
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+
+	// peripheral device type is 0, direct access block device
+	data := make([]byte, 4, 4+len(page))
+	data[1] = cdb[2]
+	binary.BigEndian.PutUint16(data[2:], uint16(len(page)))
+	data = append(data, page...)
+	return SAM_STAT_GOOD, truncate(data, allocationLength), nil
+}
+
+func (d *Device) standardInquiry() []byte {
+	data := make([]byte, 36)
+	data[2] = 0x05 // SPC-3
+	data[3] = 0x02 // response data format
+	data[4] = byte(len(data) - 5)
+	data[5] = 0x08 // 3PC, EXTENDED COPY
+	if d.alua != nil {
+		data[5] |= ALUA_TPGS
+	}
+	data[7] = 0x02 // CMDQUE
+	copyPadded(data[8:16], VENDOR_ID)
+	copyPadded(data[16:32], PRODUCT_ID)
+	copyPadded(data[32:36], PRODUCT_REV)
+	return data
+}
+
+// deviceIdentification returns the designation descriptors of VPD page 0x83.
+// The logical unit ones are derived from the volume name, so they are the
+// same wherever and whenever the volume is served.
+func (d *Device) deviceIdentification() []byte {
+	// NAA IEEE Registered Extended, binary
+	naa := []byte{0x01, 0x03, 0x00, 16}
+	naa = append(naa, NAADesignator(d.name)...)
+
+	// T10 vendor ID based, ASCII
+	id := make([]byte, 8, 8+len(d.name))
+	copyPadded(id, VENDOR_ID)
+	id = append(id, d.name...)
+	if len(id) > 255 {
+		id = id[:255]
+	}
+	t10 := []byte{0x02, 0x01, 0x00, byte(len(id))}
+	t10 = append(t10, id...)
+
+	return append(append(naa, t10...), d.portDesignators()...)
+}
+
+// NAADesignator returns the 16 bytes NAA designator of the volume, which
+// udev names the disk by, e.g. /dev/disk/by-id/wwn-0x6001405...
+func NAADesignator(name string) []byte {
+	sum := sha1.Sum([]byte(name))
+	// NAA 6, the company ID, then 100 bits of vendor specific identifier
+	s := "6" + NAA_COMPANY_ID + hex.EncodeToString(sum[:])[:25]
+	naa, _ := hex.DecodeString(s)
+	return naa
+}
+
+// blockLimits returns VPD page 0xb0, in blocks
+func (d *Device) blockLimits() []byte {
+	page := make([]byte, 0x3c)
+	granularity := uint32(1)
+	if d.blockSize < UNMAP_GRANULARITY {
+		granularity = uint32(UNMAP_GRANULARITY / d.blockSize)
+	}
+	binary.BigEndian.PutUint16(page[2:], uint16(granularity)) // optimal transfer length granularity
+	binary.BigEndian.PutUint32(page[4:], uint32(MAX_TRANSFER_LENGTH/d.blockSize))
+	binary.BigEndian.PutUint32(page[8:], uint32(MAX_TRANSFER_LENGTH/d.blockSize)) // optimal transfer length
+	binary.BigEndian.PutUint32(page[16:], uint32(MAX_UNMAP_LENGTH/d.blockSize))
+	binary.BigEndian.PutUint32(page[20:], MAX_UNMAP_DESCRIPTORS)
+	binary.BigEndian.PutUint32(page[24:], granularity)
+	return page
+}
+
+// copyPadded copies s to buf, padded with spaces as SCSI ASCII fields are
+func copyPadded(buf []byte, s string) {
+	n := copy(buf, s)
+	for i := n; i < len(buf); i++ {
+		buf[i] = ' '
+	}
+}
@@ -0,0 +1,129 @@
+package scsi
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	MODE_PAGE_RW_ERROR_RECOVERY = 0x01
+	MODE_PAGE_CACHING           = 0x08
+	MODE_PAGE_CONTROL           = 0x0a
+	MODE_PAGE_ALL               = 0x3f
+
+	// page control field of MODE SENSE
+	MODE_PC_CURRENT    = 0
+	MODE_PC_CHANGEABLE = 1
+	MODE_PC_DEFAULT    = 2
+	MODE_PC_SAVED      = 3
+
+	// device specific parameter of the mode parameter header
+	MODE_DPOFUA = 0x10
+)
+
+// modePage returns the current values of a mode page, nothing can be changed
+func modePage(code byte, changeable bool) []byte {
+	var page []byte
+	switch code {
+	case MODE_PAGE_RW_ERROR_RECOVERY:
+		page = make([]byte, 12)
+	case MODE_PAGE_CACHING:
+		page = make([]byte, 20)
+		if !changeable {
+			// writes are cached by the replicas until SYNCHRONIZE CACHE
+			page[2] = 0x04 // WCE
+		}
+	case MODE_PAGE_CONTROL:
+		page = make([]byte, 12)
+	default:
+		return nil
+	}
+	page[0] = code
+	page[1] = byte(len(page) - 2)
+	return page
+}
+
+func (d *Device) handleModeSense(cdb []byte) (byte, []byte, []byte) {
+	code := cdb[2] & 0x3f
+	pc := cdb[2] >> 6
+	if cdb[3] != 0 {
+		// no subpages
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	if pc == MODE_PC_SAVED {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_SAVING_PARAMETERS_NOT_SUPPORTED)
+	}
+
+	pages := []byte{}
+	if code == MODE_PAGE_ALL {
+		for _, c := range []byte{MODE_PAGE_RW_ERROR_RECOVERY, MODE_PAGE_CACHING, MODE_PAGE_CONTROL} {
+			pages = append(pages, modePage(c, pc == MODE_PC_CHANGEABLE)...)
+		}
+	} else {
+		pages = modePage(code, pc == MODE_PC_CHANGEABLE)
+		if pages == nil {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+		}
+	}
+
+	// no block descriptors
+	var data []byte
+	if cdb[0] == MODE_SENSE {
+		data = make([]byte, 4, 4+len(pages))
+		data = append(data, pages...)
+		data[0] = byte(len(data) - 1)
+		data[2] = MODE_DPOFUA
+		return SAM_STAT_GOOD, truncate(data, int(cdb[4])), nil
+	}
+	data = make([]byte, 8, 8+len(pages))
+	data = append(data, pages...)
+	binary.BigEndian.PutUint16(data, uint16(len(data)-2))
+	data[3] = MODE_DPOFUA
+	return SAM_STAT_GOOD, truncate(data, int(binary.BigEndian.Uint16(cdb[7:]))), nil
+}
+
+// handleModeSelect accepts the pages only if nothing is changed
+func (d *Device) handleModeSelect(cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	// PF has to be set, and SP cannot be
+	if cdb[1]&0x10 == 0 || cdb[1]&0x01 != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+
+	var length, headerLength, blockDescLength int
+	if cdb[0] == MODE_SELECT {
+		length, headerLength = int(cdb[4]), 4
+	} else {
+		length, headerLength = int(binary.BigEndian.Uint16(cdb[7:])), 8
+	}
+	if length == 0 {
+		return SAM_STAT_GOOD, nil, nil
+	}
+	if len(dataOut) < length || length < headerLength {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	data := dataOut[:length]
+	if cdb[0] == MODE_SELECT {
+		blockDescLength = int(data[3])
+	} else {
+		blockDescLength = int(binary.BigEndian.Uint16(data[6:]))
+	}
+
+	pages := data[headerLength:]
+	if blockDescLength > len(pages) {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	pages = pages[blockDescLength:]
+	for len(pages) != 0 {
+		if len(pages) < 2 || len(pages) < int(pages[1])+2 {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+		}
+		page := pages[:int(pages[1])+2]
+		current := modePage(page[0]&0x3f, false)
+		// the PS bit is ignored, and there are no subpages
+		if current == nil || page[0]&0x40 != 0 || !bytes.Equal(page[1:], current[1:]) {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+		}
+		pages = pages[len(page):]
+	}
+	return SAM_STAT_GOOD, nil, nil
+}
@@ -0,0 +1,189 @@
+package scsi
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// service action of MAINTENANCE IN
+	MI_REPORT_SUPPORTED_OPCODES = 0x0c
+
+	// reporting options of REPORT SUPPORTED OPERATION CODES
+	RSOC_ALL             = 0x00
+	RSOC_OPCODE          = 0x01
+	RSOC_OPCODE_SA       = 0x02
+	RSOC_OPCODE_MAYBE_SA = 0x03
+
+	// SUPPORT field of the one command parameter data
+	RSOC_NOT_SUPPORTED = 0x01
+	RSOC_SUPPORTED     = 0x03
+
+	// command timeouts descriptor, there are no timeouts to report
+	RSOC_TIMEOUTS_LENGTH = 12
+)
+
+// opcode is a command reported by REPORT SUPPORTED OPERATION CODES. usage is
+// the CDB usage data, the bits of the CDB the device looks at.
+type opcode struct {
+	opcode           byte
+	serviceAction    uint16
+	hasServiceAction bool
+	// only supported with ALUA
+	alua bool
+	// only supported unless the reservations are disabled
+	reservation bool
+	usage       []byte
+}
+
+var (
+	opcodes = []opcode{
+		{opcode: TEST_UNIT_READY, usage: []byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{opcode: REQUEST_SENSE, usage: []byte{0xff, 0x00, 0x00, 0x00, 0xff, 0x00}},
+		{opcode: FORMAT_UNIT, usage: []byte{0xff, 0x10, 0x00, 0x00, 0x00, 0x00}},
+		{opcode: READ_6, usage: []byte{0xff, 0x1f, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: WRITE_6, usage: []byte{0xff, 0x1f, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: INQUIRY, usage: []byte{0xff, 0x03, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: MODE_SELECT, usage: []byte{0xff, 0x11, 0x00, 0x00, 0xff, 0x00}},
+		{opcode: MODE_SENSE, usage: []byte{0xff, 0x00, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: START_STOP, usage: []byte{0xff, 0x00, 0x00, 0x00, 0x02, 0x00}},
+		{opcode: ALLOW_MEDIUM_REMOVAL, usage: []byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{opcode: READ_CAPACITY, usage: []byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{opcode: READ_10, usage: []byte{0xff, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: WRITE_10, usage: []byte{0xff, 0x08, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: VERIFY, usage: []byte{0xff, 0x06, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: SYNCHRONIZE_CACHE, usage: []byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{opcode: READ_BUFFER, usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: UNMAP, usage: []byte{0xff, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: MODE_SELECT_10, usage: []byte{0xff, 0x11, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: MODE_SENSE_10, usage: []byte{0xff, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_IN, serviceAction: PR_IN_READ_KEYS, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_IN, serviceAction: PR_IN_READ_RESERVATION, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_IN, serviceAction: PR_IN_REPORT_CAPABILITIES, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_REGISTER, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_RESERVE, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_RELEASE, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_CLEAR, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_PREEMPT, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_PREEMPT_AND_ABORT, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: PERSISTENT_RESERVE_OUT, serviceAction: PR_OUT_REGISTER_AND_IGNORE_KEY, hasServiceAction: true, reservation: true,
+			usage: []byte{0xff, 0x1f, 0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00}},
+		{opcode: EXTENDED_COPY, serviceAction: XCOPY_LID1, hasServiceAction: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: RECEIVE_COPY_RESULTS, serviceAction: RCR_OPERATING_PARAMETERS, hasServiceAction: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: READ_16, usage: []byte{0xff, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: WRITE_16, usage: []byte{0xff, 0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: VERIFY_16, usage: []byte{0xff, 0x06, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: SYNCHRONIZE_CACHE_16, usage: []byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{opcode: SERVICE_ACTION_IN_16, serviceAction: READ_CAPACITY_16, hasServiceAction: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: REPORT_LUNS, usage: []byte{0xff, 0x00, 0xff, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: MAINTENANCE_IN, serviceAction: MI_REPORT_TARGET_PGS, hasServiceAction: true, alua: true,
+			usage: []byte{0xff, 0xff, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: MAINTENANCE_IN, serviceAction: MI_REPORT_SUPPORTED_OPCODES, hasServiceAction: true,
+			usage: []byte{0xff, 0x1f, 0x87, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: MAINTENANCE_OUT, serviceAction: MO_SET_TARGET_PGS, hasServiceAction: true, alua: true,
+			usage: []byte{0xff, 0x1f, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: READ_12, usage: []byte{0xff, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: WRITE_12, usage: []byte{0xff, 0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+		{opcode: VERIFY_12, usage: []byte{0xff, 0x06, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00}},
+	}
+)
+
+// supportedOpcodes returns the commands the device supports
+func (d *Device) supportedOpcodes() []opcode {
+	supported := make([]opcode, 0, len(opcodes))
+	for _, op := range opcodes {
+		if op.alua && d.alua == nil {
+			continue
+		}
+		if op.reservation && d.noReservations {
+			continue
+		}
+		supported = append(supported, op)
+	}
+	return supported
+}
+
+func (d *Device) handleReportSupportedOpcodes(cdb []byte) (byte, []byte, []byte) {
+	// RCTD, there are no timeouts but the descriptors are still returned
+	timeouts := cdb[2]&0x80 != 0
+	requestedOpcode := cdb[3]
+	requestedServiceAction := binary.BigEndian.Uint16(cdb[4:])
+	allocationLength := int(binary.BigEndian.Uint32(cdb[6:]))
+
+	timeoutsDescriptor := make([]byte, RSOC_TIMEOUTS_LENGTH)
+	binary.BigEndian.PutUint16(timeoutsDescriptor, RSOC_TIMEOUTS_LENGTH-2)
+
+	var data []byte
+	switch options := cdb[2] & 0x07; options {
+	case RSOC_ALL:
+		data = make([]byte, 4)
+		for _, op := range d.supportedOpcodes() {
+			desc := make([]byte, 8)
+			desc[0] = op.opcode
+			binary.BigEndian.PutUint16(desc[2:], op.serviceAction)
+			if op.hasServiceAction {
+				desc[5] |= 0x01 // SERVACTV
+			}
+			if timeouts {
+				desc[5] |= 0x02 // CTDP
+			}
+			binary.BigEndian.PutUint16(desc[6:], uint16(len(op.usage)))
+			data = append(data, desc...)
+			if timeouts {
+				data = append(data, timeoutsDescriptor...)
+			}
+		}
+		binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	case RSOC_OPCODE, RSOC_OPCODE_SA, RSOC_OPCODE_MAYBE_SA:
+		var usage []byte
+		for _, op := range d.supportedOpcodes() {
+			if op.opcode != requestedOpcode {
+				continue
+			}
+			if op.hasServiceAction && options == RSOC_OPCODE ||
+				!op.hasServiceAction && options == RSOC_OPCODE_SA {
+				return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+			}
+			if !op.hasServiceAction || op.serviceAction == requestedServiceAction {
+				usage = op.usage
+				break
+			}
+		}
+
+		data = make([]byte, 4)
+		if usage == nil {
+			data[1] = RSOC_NOT_SUPPORTED
+			break
+		}
+		data[1] = RSOC_SUPPORTED
+		if timeouts {
+			data[1] |= 0x80 // CTDP
+		}
+		binary.BigEndian.PutUint16(data[2:], uint16(len(usage)))
+		data = append(data, usage...)
+		if timeouts {
+			data = append(data, timeoutsDescriptor...)
+		}
+	default:
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	return SAM_STAT_GOOD, truncate(data, allocationLength), nil
+}
@@ -0,0 +1,385 @@
+package scsi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/yasker/longhorn/types"
+)
+
+// See SPC-4 5.12 and 6.15, 6.16. Only the LU scope is supported, and the
+// reservations always persist through power loss, as they are replicated
+// with the volume if it's a types.MetadataStore.
+const (
+	PR_IN_READ_KEYS           = 0x00
+	PR_IN_READ_RESERVATION    = 0x01
+	PR_IN_REPORT_CAPABILITIES = 0x02
+
+	PR_OUT_REGISTER                = 0x00
+	PR_OUT_RESERVE                 = 0x01
+	PR_OUT_RELEASE                 = 0x02
+	PR_OUT_CLEAR                   = 0x03
+	PR_OUT_PREEMPT                 = 0x04
+	PR_OUT_PREEMPT_AND_ABORT       = 0x05
+	PR_OUT_REGISTER_AND_IGNORE_KEY = 0x06
+
+	PR_TYPE_WRITE_EXCLUSIVE           = 0x01
+	PR_TYPE_EXCLUSIVE_ACCESS          = 0x03
+	PR_TYPE_WRITE_EXCLUSIVE_REG_ONLY  = 0x05
+	PR_TYPE_EXCLUSIVE_ACCESS_REG_ONLY = 0x06
+	PR_TYPE_WRITE_EXCLUSIVE_ALL_REG   = 0x07
+	PR_TYPE_EXCLUSIVE_ACCESS_ALL_REG  = 0x08
+
+	PR_OUT_PARAMETER_LENGTH = 24
+
+	// name of the metadata the reservations are kept in
+	reservationsMetadata = "scsi-reservations"
+)
+
+type reservations struct {
+	Generation uint32
+	// registered reservation keys, by I_T nexus
+	Registrations map[string]uint64
+	Reserved      bool
+	Type          byte
+	// unused for the all registrants types, every registrant holds it
+	Holder string
+}
+
+// reservationState is the reservations of a device, and where to persist them
+type reservationState struct {
+	current *reservations
+	mutex   *sync.RWMutex
+	store   types.MetadataStore
+}
+
+func newReservationState(volume types.Volume) (*reservationState, error) {
+	s := &reservationState{
+		current: &reservations{
+			Registrations: make(map[string]uint64),
+		},
+		mutex: &sync.RWMutex{},
+	}
+	store, ok := volume.(types.MetadataStore)
+	if !ok {
+		return s, nil
+	}
+	s.store = store
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload loads the reservations from the store again
+func (s *reservationState) reload() error {
+	if s.store == nil {
+		return nil
+	}
+	value, err := s.store.GetMetadata(reservationsMetadata)
+	if err != nil {
+		return fmt.Errorf("Fail to load persistent reservations: %v", err)
+	}
+	current := &reservations{}
+	if len(value) != 0 {
+		if err := json.Unmarshal(value, current); err != nil {
+			return fmt.Errorf("Invalid persistent reservations %q: %v", value, err)
+		}
+	}
+	if current.Registrations == nil {
+		current.Registrations = make(map[string]uint64)
+	}
+
+	s.mutex.Lock()
+	s.current = current
+	s.mutex.Unlock()
+	return nil
+}
+
+func (r *reservations) clone() *reservations {
+	c := *r
+	c.Registrations = make(map[string]uint64)
+	for nexus, key := range r.Registrations {
+		c.Registrations[nexus] = key
+	}
+	return &c
+}
+
+func (r *reservations) allRegistrants() bool {
+	return r.Type == PR_TYPE_WRITE_EXCLUSIVE_ALL_REG || r.Type == PR_TYPE_EXCLUSIVE_ACCESS_ALL_REG
+}
+
+func (r *reservations) isHolder(nexus string) bool {
+	if !r.Reserved {
+		return false
+	}
+	if r.allRegistrants() {
+		_, ok := r.Registrations[nexus]
+		return ok
+	}
+	return r.Holder == nexus
+}
+
+func (r *reservations) release() {
+	r.Reserved = false
+	r.Type = 0
+	r.Holder = ""
+}
+
+func (r *reservations) unregister(nexus string) {
+	delete(r.Registrations, nexus)
+	if !r.Reserved {
+		return
+	}
+	if r.allRegistrants() {
+		// released when the last registrant is gone
+		if len(r.Registrations) == 0 {
+			r.release()
+		}
+	} else if r.Holder == nexus {
+		r.release()
+	}
+}
+
+// conflicts tells if nexus cannot run the command because of the reservation
+func (r *reservations) conflicts(nexus string, cdb []byte) bool {
+	if !r.Reserved || r.isHolder(nexus) {
+		return false
+	}
+	_, registered := r.Registrations[nexus]
+	registrantsAllowed := r.Type != PR_TYPE_WRITE_EXCLUSIVE && r.Type != PR_TYPE_EXCLUSIVE_ACCESS
+	if registered && registrantsAllowed {
+		return false
+	}
+
+	switch cdb[0] {
+	case INQUIRY, REPORT_LUNS, REQUEST_SENSE, TEST_UNIT_READY, READ_CAPACITY,
+		SERVICE_ACTION_IN_16, MAINTENANCE_IN, PERSISTENT_RESERVE_IN, PERSISTENT_RESERVE_OUT,
+		RECEIVE_COPY_RESULTS:
+		return false
+	case ALLOW_MEDIUM_REMOVAL:
+		// unless it prevents the removal
+		return cdb[4]&0x03 != 0
+	case START_STOP:
+		// unless it starts the unit without power condition
+		return cdb[4] != 0x01
+	case READ_6, READ_10, READ_12, READ_16, MODE_SENSE, MODE_SENSE_10,
+		VERIFY, VERIFY_12, VERIFY_16, READ_BUFFER:
+		// only the exclusive access types deny reads
+		return r.Type == PR_TYPE_EXCLUSIVE_ACCESS ||
+			r.Type == PR_TYPE_EXCLUSIVE_ACCESS_REG_ONLY ||
+			r.Type == PR_TYPE_EXCLUSIVE_ACCESS_ALL_REG
+	}
+	return true
+}
+
+func (s *reservationState) conflicts(nexus string, cdb []byte) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.current.conflicts(nexus, cdb)
+}
+
+func (d *Device) handlePersistentReserveIn(cdb []byte) (byte, []byte, []byte) {
+	s := d.reservations
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	r := s.current
+
+	var data []byte
+	switch cdb[1] & 0x1f {
+	case PR_IN_READ_KEYS:
+		data = make([]byte, 8, 8+8*len(r.Registrations))
+		for _, key := range r.Registrations {
+			data = append(data, make([]byte, 8)...)
+			binary.BigEndian.PutUint64(data[len(data)-8:], key)
+		}
+	case PR_IN_READ_RESERVATION:
+		data = make([]byte, 8)
+		if r.Reserved {
+			desc := make([]byte, 16)
+			if !r.allRegistrants() {
+				binary.BigEndian.PutUint64(desc, r.Registrations[r.Holder])
+			}
+			desc[13] = r.Type
+			data = append(data, desc...)
+		}
+	case PR_IN_REPORT_CAPABILITIES:
+		data = make([]byte, 8)
+		binary.BigEndian.PutUint16(data, 8)
+		data[2] = 0x01                             // PTPL_C
+		data[3] = 0x80 | 0x01                      // TMV, PTPL_A
+		data[4] = 0x80 | 0x40 | 0x20 | 0x08 | 0x02 // supported types
+		data[5] = 0x01
+		return SAM_STAT_GOOD, truncate(data, int(binary.BigEndian.Uint16(cdb[7:]))), nil
+	default:
+		// READ FULL STATUS is not supported
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	binary.BigEndian.PutUint32(data, r.Generation)
+	binary.BigEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return SAM_STAT_GOOD, truncate(data, int(binary.BigEndian.Uint16(cdb[7:]))), nil
+}
+
+func (d *Device) handlePersistentReserveOut(nexus string, cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	action := cdb[1] & 0x1f
+	scope, prType := cdb[2]>>4, cdb[2]&0x0f
+	length := binary.BigEndian.Uint32(cdb[5:])
+	if length != PR_OUT_PARAMETER_LENGTH || len(dataOut) < PR_OUT_PARAMETER_LENGTH {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	key := binary.BigEndian.Uint64(dataOut)
+	saKey := binary.BigEndian.Uint64(dataOut[8:])
+	// SPEC_I_PT and ALL_TG_PT are not supported, APTPL is always on
+	if dataOut[20]&0x0c != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+	}
+
+	switch action {
+	case PR_OUT_RESERVE, PR_OUT_RELEASE, PR_OUT_PREEMPT, PR_OUT_PREEMPT_AND_ABORT:
+		if scope != 0 || !validReservationType(prType) {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+		}
+	}
+
+	s := d.reservations
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// work on a copy, which becomes current only after it's persisted
+	r := s.current.clone()
+	registeredKey, registered := r.Registrations[nexus]
+	changed := false
+
+	switch action {
+	case PR_OUT_REGISTER, PR_OUT_REGISTER_AND_IGNORE_KEY:
+		if action == PR_OUT_REGISTER {
+			if (!registered && key != 0) || (registered && key != registeredKey) {
+				return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+			}
+		}
+		if saKey == 0 {
+			if registered {
+				r.unregister(nexus)
+				changed = true
+			}
+		} else {
+			r.Registrations[nexus] = saKey
+			changed = true
+		}
+		if changed {
+			r.Generation++
+		}
+	case PR_OUT_RESERVE:
+		if !registered || key != registeredKey {
+			return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+		}
+		if r.Reserved {
+			if !r.isHolder(nexus) || r.Type != prType {
+				return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+			}
+			break
+		}
+		r.Reserved, r.Type, r.Holder = true, prType, nexus
+		changed = true
+	case PR_OUT_RELEASE:
+		if !registered || key != registeredKey {
+			return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+		}
+		if !r.isHolder(nexus) {
+			break
+		}
+		if r.Type != prType {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_RELEASE_OF_PERSISTENT_RESERVATION)
+		}
+		r.release()
+		changed = true
+	case PR_OUT_CLEAR:
+		if !registered || key != registeredKey {
+			return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+		}
+		r.release()
+		r.Registrations = make(map[string]uint64)
+		r.Generation++
+		changed = true
+	case PR_OUT_PREEMPT, PR_OUT_PREEMPT_AND_ABORT:
+		// the tasks of the preempted are not aborted, the frontends would
+		// have completed them
+		if !registered || key != registeredKey {
+			return SAM_STAT_RESERVATION_CONFLICT, nil, nil
+		}
+		status, sense := r.preempt(nexus, saKey, prType)
+		if status != SAM_STAT_GOOD {
+			return status, nil, sense
+		}
+		r.Generation++
+		changed = true
+	default:
+		// REGISTER AND MOVE is not supported
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+
+	if !changed {
+		return SAM_STAT_GOOD, nil, nil
+	}
+	if s.store != nil {
+		value, err := json.Marshal(r)
+		if err != nil {
+			log.Errorln("Fail to encode persistent reservations: ", err)
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INSUFFICIENT_REGISTRATION_RESOURCES)
+		}
+		if err := s.store.SetMetadata(reservationsMetadata, value); err != nil {
+			log.Errorln("Fail to persist reservations: ", err)
+			return CheckCondition(ILLEGAL_REQUEST, ASC_INSUFFICIENT_REGISTRATION_RESOURCES)
+		}
+	}
+	s.current = r
+	return SAM_STAT_GOOD, nil, nil
+}
+
+// preempt removes the registrations of saKey, and takes over the reservation
+// if it's held by them
+func (r *reservations) preempt(nexus string, saKey uint64, prType byte) (byte, []byte) {
+	removeRegistrations := func(all bool) bool {
+		removed := false
+		for n, k := range r.Registrations {
+			if n != nexus && (all || k == saKey) {
+				delete(r.Registrations, n)
+				removed = true
+			}
+		}
+		return removed
+	}
+
+	if r.Reserved && r.allRegistrants() && saKey == 0 {
+		removeRegistrations(true)
+		r.Type, r.Holder = prType, nexus
+		return SAM_STAT_GOOD, nil
+	}
+	if saKey == 0 {
+		return SAM_STAT_CHECK_CONDITION, BuildSense(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+	}
+	if r.Reserved && !r.allRegistrants() && r.Registrations[r.Holder] == saKey {
+		removeRegistrations(false)
+		r.Reserved, r.Type, r.Holder = true, prType, nexus
+		return SAM_STAT_GOOD, nil
+	}
+	if !removeRegistrations(false) {
+		return SAM_STAT_RESERVATION_CONFLICT, nil
+	}
+	if r.Reserved && r.allRegistrants() && len(r.Registrations) == 0 {
+		r.release()
+	}
+	return SAM_STAT_GOOD, nil
+}
+
+func validReservationType(prType byte) bool {
+	switch prType {
+	case PR_TYPE_WRITE_EXCLUSIVE, PR_TYPE_EXCLUSIVE_ACCESS,
+		PR_TYPE_WRITE_EXCLUSIVE_REG_ONLY, PR_TYPE_EXCLUSIVE_ACCESS_REG_ONLY,
+		PR_TYPE_WRITE_EXCLUSIVE_ALL_REG, PR_TYPE_EXCLUSIVE_ACCESS_ALL_REG:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package scsi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	nexusA = "iqn.2016-04.com.rancher:a,i,0x800000000001"
+	nexusB = "iqn.2016-04.com.rancher:b,i,0x800000000002"
+	nexusC = "iqn.2016-04.com.rancher:c,i,0x800000000003"
+
+	readCDB  = "28 00 00 00 00 00 00 00 01 00"
+	writeCDB = "2a 00 00 00 00 00 00 00 01 00"
+)
+
+// prOut returns PERSISTENT RESERVE OUT of action, with its parameter list
+func prOut(action, prType byte, key, saKey uint64) ([]byte, []byte) {
+	cdb := []byte{PERSISTENT_RESERVE_OUT, action, prType, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(cdb[5:], PR_OUT_PARAMETER_LENGTH)
+	data := make([]byte, PR_OUT_PARAMETER_LENGTH)
+	binary.BigEndian.PutUint64(data, key)
+	binary.BigEndian.PutUint64(data[8:], saKey)
+	return cdb, data
+}
+
+type prStep struct {
+	name   string
+	nexus  string
+	cdb    []byte
+	data   []byte
+	status byte
+}
+
+func outStep(name, nexus string, action, prType byte, key, saKey uint64, status byte) prStep {
+	cdb, data := prOut(action, prType, key, saKey)
+	return prStep{name, nexus, cdb, data, status}
+}
+
+func ioStep(name, nexus, cdb string, status byte) prStep {
+	var data []byte
+	if cdb == writeCDB {
+		data = make([]byte, testBlockSize)
+	}
+	return prStep{name, nexus, unhex(cdb), data, status}
+}
+
+func runSteps(t *testing.T, d *Device, steps []prStep) {
+	for _, s := range steps {
+		status, _, sense := d.HandleCommand(s.nexus, s.cdb, s.data)
+		if status != s.status {
+			t.Fatalf("%v: status 0x%x, expected 0x%x, sense %x", s.name, status, s.status, sense)
+		}
+	}
+}
+
+// readKeys returns the generation and the keys registered
+func readKeys(t *testing.T, d *Device) (uint32, []uint64) {
+	status, data, _ := d.HandleCommand(nexusA, unhex("5e 00 00 00 00 00 00 10 00 00"), nil)
+	if status != SAM_STAT_GOOD {
+		t.Fatalf("READ KEYS status 0x%x", status)
+	}
+	keys := []uint64{}
+	for i := 8; i < len(data); i += 8 {
+		keys = append(keys, binary.BigEndian.Uint64(data[i:]))
+	}
+	return binary.BigEndian.Uint32(data), keys
+}
+
+// readReservation returns the key and the type of the reservation, if any
+func readReservation(t *testing.T, d *Device) (bool, uint64, byte) {
+	status, data, _ := d.HandleCommand(nexusA, unhex("5e 01 00 00 00 00 00 10 00 00"), nil)
+	if status != SAM_STAT_GOOD {
+		t.Fatalf("READ RESERVATION status 0x%x", status)
+	}
+	if binary.BigEndian.Uint32(data[4:]) == 0 {
+		return false, 0, 0
+	}
+	return true, binary.BigEndian.Uint64(data[8:]), data[21]
+}
+
+func TestReservationRegister(t *testing.T) {
+	d := newTestDevice(t)
+	runSteps(t, d, []prStep{
+		outStep("reserve unregistered", nexusA, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0, 0, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("register with a key", nexusA, PR_OUT_REGISTER, 0, 0xa, 0xa, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("register", nexusA, PR_OUT_REGISTER, 0, 0, 0xa, SAM_STAT_GOOD),
+		outStep("register with a wrong key", nexusA, PR_OUT_REGISTER, 0, 0x5, 0xaa, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("register again", nexusA, PR_OUT_REGISTER, 0, 0xa, 0xaa, SAM_STAT_GOOD),
+		outStep("register and ignore key", nexusB, PR_OUT_REGISTER_AND_IGNORE_KEY, 0, 0x5, 0xb, SAM_STAT_GOOD),
+	})
+	if generation, keys := readKeys(t, d); generation != 3 || len(keys) != 2 {
+		t.Fatalf("Generation %v and keys %x, expected 3 and two keys", generation, keys)
+	}
+
+	runSteps(t, d, []prStep{
+		outStep("unregister", nexusB, PR_OUT_REGISTER, 0, 0xb, 0, SAM_STAT_GOOD),
+		// nothing changes, so neither does the generation
+		outStep("unregister again", nexusB, PR_OUT_REGISTER, 0, 0, 0, SAM_STAT_GOOD),
+	})
+	if generation, keys := readKeys(t, d); generation != 4 || len(keys) != 1 || keys[0] != 0xaa {
+		t.Fatalf("Generation %v and keys %x, expected 4 and aa", generation, keys)
+	}
+}
+
+func TestReservationReserve(t *testing.T) {
+	d := newTestDevice(t)
+	runSteps(t, d, []prStep{
+		outStep("register a", nexusA, PR_OUT_REGISTER, 0, 0, 0xa, SAM_STAT_GOOD),
+		outStep("register b", nexusB, PR_OUT_REGISTER, 0, 0, 0xb, SAM_STAT_GOOD),
+		outStep("reserve with a wrong key", nexusA, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0xb, 0, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("reserve an invalid type", nexusA, PR_OUT_RESERVE, 0x02, 0xa, 0, SAM_STAT_CHECK_CONDITION),
+		outStep("reserve", nexusA, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0xa, 0, SAM_STAT_GOOD),
+		outStep("reserve again", nexusA, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0xa, 0, SAM_STAT_GOOD),
+		outStep("reserve another type", nexusA, PR_OUT_RESERVE, PR_TYPE_EXCLUSIVE_ACCESS, 0xa, 0, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("reserve held by another", nexusB, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0xb, 0, SAM_STAT_RESERVATION_CONFLICT),
+	})
+	if reserved, key, prType := readReservation(t, d); !reserved || key != 0xa || prType != PR_TYPE_WRITE_EXCLUSIVE {
+		t.Fatalf("Reservation %v of key %x and type %v, expected of a", reserved, key, prType)
+	}
+
+	runSteps(t, d, []prStep{
+		outStep("release by another", nexusB, PR_OUT_RELEASE, PR_TYPE_WRITE_EXCLUSIVE, 0xb, 0, SAM_STAT_GOOD),
+		outStep("release another type", nexusA, PR_OUT_RELEASE, PR_TYPE_EXCLUSIVE_ACCESS, 0xa, 0, SAM_STAT_CHECK_CONDITION),
+		outStep("release", nexusA, PR_OUT_RELEASE, PR_TYPE_WRITE_EXCLUSIVE, 0xa, 0, SAM_STAT_GOOD),
+	})
+	if reserved, _, _ := readReservation(t, d); reserved {
+		t.Fatal("Reservation is still held once released")
+	}
+
+	runSteps(t, d, []prStep{
+		outStep("reserve by b", nexusB, PR_OUT_RESERVE, PR_TYPE_EXCLUSIVE_ACCESS, 0xb, 0, SAM_STAT_GOOD),
+		// the holder unregistering releases it
+		outStep("unregister the holder", nexusB, PR_OUT_REGISTER, 0, 0xb, 0, SAM_STAT_GOOD),
+	})
+	if reserved, _, _ := readReservation(t, d); reserved {
+		t.Fatal("Reservation is still held once its holder unregistered")
+	}
+}
+
+func TestReservationConflicts(t *testing.T) {
+	cases := []struct {
+		prType byte
+		// the status of a read, then a write, from a registrant which
+		// doesn't hold the reservation, then from an initiator not
+		// registered
+		registrant   [2]byte
+		unregistered [2]byte
+	}{
+		{PR_TYPE_WRITE_EXCLUSIVE,
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_RESERVATION_CONFLICT},
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_RESERVATION_CONFLICT}},
+		{PR_TYPE_EXCLUSIVE_ACCESS,
+			[2]byte{SAM_STAT_RESERVATION_CONFLICT, SAM_STAT_RESERVATION_CONFLICT},
+			[2]byte{SAM_STAT_RESERVATION_CONFLICT, SAM_STAT_RESERVATION_CONFLICT}},
+		{PR_TYPE_WRITE_EXCLUSIVE_REG_ONLY,
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_GOOD},
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_RESERVATION_CONFLICT}},
+		{PR_TYPE_EXCLUSIVE_ACCESS_REG_ONLY,
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_GOOD},
+			[2]byte{SAM_STAT_RESERVATION_CONFLICT, SAM_STAT_RESERVATION_CONFLICT}},
+		{PR_TYPE_WRITE_EXCLUSIVE_ALL_REG,
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_GOOD},
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_RESERVATION_CONFLICT}},
+		{PR_TYPE_EXCLUSIVE_ACCESS_ALL_REG,
+			[2]byte{SAM_STAT_GOOD, SAM_STAT_GOOD},
+			[2]byte{SAM_STAT_RESERVATION_CONFLICT, SAM_STAT_RESERVATION_CONFLICT}},
+	}
+	for _, c := range cases {
+		t.Logf("Reservation type %v", c.prType)
+		d := newTestDevice(t)
+		runSteps(t, d, []prStep{
+			outStep("register a", nexusA, PR_OUT_REGISTER, 0, 0, 0xa, SAM_STAT_GOOD),
+			outStep("register b", nexusB, PR_OUT_REGISTER, 0, 0, 0xb, SAM_STAT_GOOD),
+			outStep("reserve", nexusA, PR_OUT_RESERVE, c.prType, 0xa, 0, SAM_STAT_GOOD),
+			ioStep("holder reads", nexusA, readCDB, SAM_STAT_GOOD),
+			ioStep("holder writes", nexusA, writeCDB, SAM_STAT_GOOD),
+			ioStep("registrant reads", nexusB, readCDB, c.registrant[0]),
+			ioStep("registrant writes", nexusB, writeCDB, c.registrant[1]),
+			ioStep("unregistered reads", nexusC, readCDB, c.unregistered[0]),
+			ioStep("unregistered writes", nexusC, writeCDB, c.unregistered[1]),
+			ioStep("unregistered inquires", nexusC, "12 00 00 00 24 00", SAM_STAT_GOOD),
+		})
+	}
+}
+
+func TestReservationPreempt(t *testing.T) {
+	d := newTestDevice(t)
+	runSteps(t, d, []prStep{
+		outStep("register a", nexusA, PR_OUT_REGISTER, 0, 0, 0xa, SAM_STAT_GOOD),
+		outStep("register b", nexusB, PR_OUT_REGISTER, 0, 0, 0xb, SAM_STAT_GOOD),
+		outStep("register c", nexusC, PR_OUT_REGISTER, 0, 0, 0xc, SAM_STAT_GOOD),
+		outStep("reserve by b", nexusB, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0xb, 0, SAM_STAT_GOOD),
+		outStep("preempt unregistered", "other", PR_OUT_PREEMPT, PR_TYPE_WRITE_EXCLUSIVE, 0x1, 0xb, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("preempt no key", nexusA, PR_OUT_PREEMPT, PR_TYPE_WRITE_EXCLUSIVE, 0xa, 0, SAM_STAT_CHECK_CONDITION),
+		outStep("preempt a key not registered", nexusA, PR_OUT_PREEMPT, PR_TYPE_WRITE_EXCLUSIVE, 0xa, 0xd, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("preempt the holder", nexusA, PR_OUT_PREEMPT, PR_TYPE_EXCLUSIVE_ACCESS, 0xa, 0xb, SAM_STAT_GOOD),
+		ioStep("preempted writes", nexusB, writeCDB, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("preempted reserves", nexusB, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE, 0xb, 0, SAM_STAT_RESERVATION_CONFLICT),
+	})
+	if reserved, key, prType := readReservation(t, d); !reserved || key != 0xa || prType != PR_TYPE_EXCLUSIVE_ACCESS {
+		t.Fatalf("Reservation %v of key %x and type %v, expected of a", reserved, key, prType)
+	}
+	if _, keys := readKeys(t, d); len(keys) != 2 {
+		t.Fatalf("Keys %x, expected those of a and c", keys)
+	}
+
+	runSteps(t, d, []prStep{
+		// not the holder, only the registration goes
+		outStep("preempt a registrant", nexusA, PR_OUT_PREEMPT_AND_ABORT, PR_TYPE_EXCLUSIVE_ACCESS, 0xa, 0xc, SAM_STAT_GOOD),
+	})
+	if _, keys := readKeys(t, d); len(keys) != 1 || keys[0] != 0xa {
+		t.Fatalf("Keys %x, expected a", keys)
+	}
+}
+
+func TestReservationPreemptAllRegistrants(t *testing.T) {
+	d := newTestDevice(t)
+	runSteps(t, d, []prStep{
+		outStep("register a", nexusA, PR_OUT_REGISTER, 0, 0, 0xa, SAM_STAT_GOOD),
+		outStep("register b", nexusB, PR_OUT_REGISTER, 0, 0, 0xb, SAM_STAT_GOOD),
+		outStep("reserve", nexusB, PR_OUT_RESERVE, PR_TYPE_WRITE_EXCLUSIVE_ALL_REG, 0xb, 0, SAM_STAT_GOOD),
+		// all the others are preempted with no key
+		outStep("preempt all", nexusA, PR_OUT_PREEMPT, PR_TYPE_WRITE_EXCLUSIVE, 0xa, 0, SAM_STAT_GOOD),
+		ioStep("preempted writes", nexusB, writeCDB, SAM_STAT_RESERVATION_CONFLICT),
+	})
+	if reserved, key, prType := readReservation(t, d); !reserved || key != 0xa || prType != PR_TYPE_WRITE_EXCLUSIVE {
+		t.Fatalf("Reservation %v of key %x and type %v, expected of a", reserved, key, prType)
+	}
+}
+
+func TestReservationClear(t *testing.T) {
+	d := newTestDevice(t)
+	runSteps(t, d, []prStep{
+		outStep("register a", nexusA, PR_OUT_REGISTER, 0, 0, 0xa, SAM_STAT_GOOD),
+		outStep("register b", nexusB, PR_OUT_REGISTER, 0, 0, 0xb, SAM_STAT_GOOD),
+		outStep("reserve", nexusA, PR_OUT_RESERVE, PR_TYPE_EXCLUSIVE_ACCESS, 0xa, 0, SAM_STAT_GOOD),
+		outStep("clear unregistered", nexusC, PR_OUT_CLEAR, 0, 0, 0, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("clear with a wrong key", nexusB, PR_OUT_CLEAR, 0, 0xa, 0, SAM_STAT_RESERVATION_CONFLICT),
+		outStep("clear", nexusB, PR_OUT_CLEAR, 0, 0xb, 0, SAM_STAT_GOOD),
+		ioStep("unregistered writes", nexusC, writeCDB, SAM_STAT_GOOD),
+	})
+	if reserved, _, _ := readReservation(t, d); reserved {
+		t.Fatal("Reservation is still held once cleared")
+	}
+	if _, keys := readKeys(t, d); len(keys) != 0 {
+		t.Fatalf("Keys %x left once cleared", keys)
+	}
+}
+
+func TestReservationParameters(t *testing.T) {
+	d := newTestDevice(t)
+	cdb, data := prOut(PR_OUT_REGISTER, 0, 0, 0xa)
+	// SPEC_I_PT isn't supported
+	data[20] = 0x08
+	if status, _, _ := d.HandleCommand(nexusA, cdb, data); status != SAM_STAT_CHECK_CONDITION {
+		t.Fatalf("SPEC_I_PT status 0x%x, expected CHECK CONDITION", status)
+	}
+	cdb, data = prOut(PR_OUT_REGISTER, 0, 0, 0xa)
+	if status, _, _ := d.HandleCommand(nexusA, cdb, data[:16]); status != SAM_STAT_CHECK_CONDITION {
+		t.Fatalf("Short parameter list status 0x%x, expected CHECK CONDITION", status)
+	}
+	cdb, data = prOut(PR_OUT_RESERVE, 0x10|PR_TYPE_WRITE_EXCLUSIVE, 0, 0)
+	if status, _, _ := d.HandleCommand(nexusA, cdb, data); status != SAM_STAT_CHECK_CONDITION {
+		t.Fatalf("Scope other than LU status 0x%x, expected CHECK CONDITION", status)
+	}
+}
+
+func TestReservationsDisabled(t *testing.T) {
+	d := newTestDevice(t)
+	d.DisableReservations()
+	invalid := BuildSense(ILLEGAL_REQUEST, ASC_INVALID_OPCODE)
+	cdb, data := prOut(PR_OUT_REGISTER, 0, 0, 0xa)
+	if status, _, sense := d.HandleCommand(nexusA, cdb, data); status != SAM_STAT_CHECK_CONDITION ||
+		!bytes.Equal(sense, invalid) {
+		t.Fatalf("PERSISTENT RESERVE OUT status 0x%x, sense %x, expected invalid opcode", status, sense)
+	}
+	if status, _, sense := d.HandleCommand(nexusA, unhex("5e 00 00 00 00 00 00 10 00 00"), nil); status != SAM_STAT_CHECK_CONDITION ||
+		!bytes.Equal(sense, invalid) {
+		t.Fatalf("PERSISTENT RESERVE IN status 0x%x, sense %x, expected invalid opcode", status, sense)
+	}
+	// and not reported as supported
+	status, data, _ := d.HandleCommand(nexusA, unhex("a3 0c 02 5e 00 00 00 00 02 00 00 00"), nil)
+	if status != SAM_STAT_GOOD || data[1] != RSOC_NOT_SUPPORTED {
+		t.Fatalf("REPORT SUPPORTED OPERATION CODES of READ KEYS status 0x%x, data %x, expected not supported", status, data)
+	}
+}
@@ -0,0 +1,128 @@
+package scsi
+
+import (
+	"encoding/binary"
+)
+
+// See SPC-4 and SBC-3. The names follow the ones in <scsi/scsi.h>.
+const (
+	TEST_UNIT_READY        = 0x00
+	REQUEST_SENSE          = 0x03
+	FORMAT_UNIT            = 0x04
+	READ_6                 = 0x08
+	WRITE_6                = 0x0a
+	INQUIRY                = 0x12
+	MODE_SELECT            = 0x15
+	MODE_SENSE             = 0x1a
+	START_STOP             = 0x1b
+	ALLOW_MEDIUM_REMOVAL   = 0x1e
+	READ_CAPACITY          = 0x25
+	READ_10                = 0x28
+	WRITE_10               = 0x2a
+	VERIFY                 = 0x2f
+	SYNCHRONIZE_CACHE      = 0x35
+	READ_BUFFER            = 0x3c
+	UNMAP                  = 0x42
+	MODE_SELECT_10         = 0x55
+	MODE_SENSE_10          = 0x5a
+	PERSISTENT_RESERVE_IN  = 0x5e
+	PERSISTENT_RESERVE_OUT = 0x5f
+	EXTENDED_COPY          = 0x83
+	RECEIVE_COPY_RESULTS   = 0x84
+	READ_16                = 0x88
+	WRITE_16               = 0x8a
+	VERIFY_16              = 0x8f
+	SYNCHRONIZE_CACHE_16   = 0x91
+	SERVICE_ACTION_IN_16   = 0x9e
+	REPORT_LUNS            = 0xa0
+	MAINTENANCE_IN         = 0xa3
+	MAINTENANCE_OUT        = 0xa4
+	READ_12                = 0xa8
+	WRITE_12               = 0xaa
+	VERIFY_12              = 0xaf
+
+	// service actions of SERVICE_ACTION_IN_16
+	READ_CAPACITY_16 = 0x10
+
+	SAM_STAT_GOOD                 = 0x00
+	SAM_STAT_CHECK_CONDITION      = 0x02
+	SAM_STAT_RESERVATION_CONFLICT = 0x18
+	SAM_STAT_TASK_ABORTED         = 0x40
+
+	// sense keys
+	NO_SENSE        = 0x00
+	NOT_READY       = 0x02
+	MEDIUM_ERROR    = 0x03
+	HARDWARE_ERROR  = 0x04
+	ILLEGAL_REQUEST = 0x05
+	COPY_ABORTED    = 0x0a
+	MISCOMPARE      = 0x0e
+
+	// additional sense code and qualifier
+	ASC_LUN_NOT_ACCESSIBLE_TRANSITIONING          = 0x040a
+	ASC_LUN_NOT_ACCESSIBLE_STANDBY                = 0x040b
+	ASC_LUN_NOT_ACCESSIBLE_UNAVAILABLE            = 0x040c
+	ASC_UNREACHABLE_COPY_TARGET                   = 0x0804
+	ASC_WRITE_ERROR                               = 0x0c00
+	ASC_READ_ERROR                                = 0x1100
+	ASC_PARAMETER_LIST_LENGTH_ERROR               = 0x1a00
+	ASC_MISCOMPARE_DURING_VERIFY                  = 0x1d00
+	ASC_INVALID_OPCODE                            = 0x2000
+	ASC_LBA_OUT_OF_RANGE                          = 0x2100
+	ASC_INVALID_FIELD_IN_CDB                      = 0x2400
+	ASC_LUN_NOT_SUPPORTED                         = 0x2500
+	ASC_INVALID_FIELD_IN_PARAMETER_LIST           = 0x2600
+	ASC_INVALID_RELEASE_OF_PERSISTENT_RESERVATION = 0x2604
+	ASC_TOO_MANY_TARGET_DESCRIPTORS               = 0x2606
+	ASC_UNSUPPORTED_TARGET_DESCRIPTOR_TYPE        = 0x2607
+	ASC_TOO_MANY_SEGMENT_DESCRIPTORS              = 0x2608
+	ASC_UNSUPPORTED_SEGMENT_DESCRIPTOR_TYPE       = 0x2609
+	ASC_SAVING_PARAMETERS_NOT_SUPPORTED           = 0x3900
+	ASC_INSUFFICIENT_REGISTRATION_RESOURCES       = 0x5504
+	ASC_SET_TARGET_PORT_GROUPS_FAILED             = 0x670a
+
+	// fixed format sense data, without additional sense bytes
+	SENSE_LENGTH = 18
+
+	// the most a READ or WRITE may transfer, in bytes, as the frontends
+	// accept at most
+	MAX_TRANSFER_LENGTH = 32 * 1024 * 1024
+	// the most an UNMAP may discard, in bytes, and in how many descriptors
+	MAX_UNMAP_LENGTH      = 1024 * 1024 * 1024
+	MAX_UNMAP_DESCRIPTORS = 64
+	// replicas punch holes in their files by filesystem blocks
+	UNMAP_GRANULARITY = 4096
+)
+
+// BuildSense returns the fixed format sense data of the current error
+func BuildSense(key byte, asc uint16) []byte {
+	sense := make([]byte, SENSE_LENGTH)
+	sense[0] = 0x70
+	sense[2] = key
+	sense[7] = SENSE_LENGTH - 8
+	binary.BigEndian.PutUint16(sense[12:], asc)
+	return sense
+}
+
+// CheckCondition is the result of a command failed with sense data
+func CheckCondition(key byte, asc uint16) (byte, []byte, []byte) {
+	return SAM_STAT_CHECK_CONDITION, nil, BuildSense(key, asc)
+}
+
+// IsDataOut tells if the command may carry data from the initiator
+func IsDataOut(opcode byte) bool {
+	switch opcode {
+	case WRITE_6, WRITE_10, WRITE_12, WRITE_16, MODE_SELECT, MODE_SELECT_10, UNMAP,
+		PERSISTENT_RESERVE_OUT, MAINTENANCE_OUT, VERIFY, VERIFY_12, VERIFY_16, EXTENDED_COPY:
+		return true
+	}
+	return false
+}
+
+// truncate cuts data to the allocation length of the command
+func truncate(data []byte, allocationLength int) []byte {
+	if len(data) > allocationLength {
+		return data[:allocationLength]
+	}
+	return data
+}
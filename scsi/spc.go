@@ -0,0 +1,70 @@
+package scsi
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// SELECT REPORT of REPORT LUNS
+	REPORT_LUNS_ALL         = 0x00
+	REPORT_LUNS_WELL_KNOWN  = 0x01
+	REPORT_LUNS_ALL_LOGICAL = 0x02
+
+	// modes of READ BUFFER
+	READ_BUFFER_HEADER_AND_DATA   = 0x00
+	READ_BUFFER_DATA              = 0x02
+	READ_BUFFER_DESCRIPTOR        = 0x03
+	READ_BUFFER_ECHO_DESCRIPTOR   = 0x0b
+	READ_BUFFER_DESCRIPTOR_LENGTH = 4
+)
+
+// handleRequestSense returns the sense the next command would get because of
+// the access state, there are no deferred errors otherwise. Only the fixed
+// format is supported, DESC is ignored.
+func (d *Device) handleRequestSense(cdb []byte) (byte, []byte, []byte) {
+	sense := BuildSense(NO_SENSE, 0)
+	if d.alua != nil {
+		if state := d.localPortGroup().State; !isActive(state) {
+			sense = stateSense(state)
+		}
+	}
+	return SAM_STAT_GOOD, truncate(sense, int(cdb[4])), nil
+}
+
+// handleReportLuns reports LUN 0 as the only one, whichever LUN it's sent to
+func handleReportLuns(cdb []byte) (byte, []byte, []byte) {
+	var data []byte
+	switch cdb[2] {
+	case REPORT_LUNS_ALL, REPORT_LUNS_ALL_LOGICAL:
+		data = make([]byte, 16)
+		binary.BigEndian.PutUint32(data, 8)
+	case REPORT_LUNS_WELL_KNOWN:
+		// there are no well known LUNs
+		data = make([]byte, 8)
+	default:
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	return SAM_STAT_GOOD, truncate(data, int(binary.BigEndian.Uint32(cdb[6:]))), nil
+}
+
+// handleReadBuffer reports buffers of no capacity, there is no WRITE BUFFER to
+// fill them
+func handleReadBuffer(cdb []byte) (byte, []byte, []byte) {
+	// only buffer 0
+	if cdb[2] != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	allocationLength := int(cdb[6])<<16 | int(cdb[7])<<8 | int(cdb[8])
+
+	var data []byte
+	switch cdb[1] & 0x1f {
+	case READ_BUFFER_HEADER_AND_DATA, READ_BUFFER_DESCRIPTOR, READ_BUFFER_ECHO_DESCRIPTOR:
+		// the capacity is 0, and so is the offset boundary
+		data = make([]byte, READ_BUFFER_DESCRIPTOR_LENGTH)
+	case READ_BUFFER_DATA:
+		data = []byte{}
+	default:
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	return SAM_STAT_GOOD, truncate(data, allocationLength), nil
+}
@@ -0,0 +1,202 @@
+package scsi
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/yasker/longhorn/types"
+	"github.com/yasker/longhorn/util"
+)
+
+const (
+	// service actions of EXTENDED COPY and RECEIVE COPY RESULTS
+	XCOPY_LID1               = 0x00
+	RCR_OPERATING_PARAMETERS = 0x03
+
+	// the only CSCD descriptor, and the only segment descriptor supported
+	XCOPY_IDENTIFICATION_DESCRIPTOR = 0xe4
+	XCOPY_BLOCK_TO_BLOCK            = 0x02
+
+	XCOPY_HEADER_LENGTH  = 16
+	XCOPY_CSCD_LENGTH    = 32
+	XCOPY_SEGMENT_LENGTH = 28
+
+	// the copies are only within the volume, so the source and the
+	// destination descriptors both designate it, at most one each
+	XCOPY_MAX_CSCDS    = 2
+	XCOPY_MAX_SEGMENTS = 16
+	// a segment may be copied through memory, as much as a WRITE
+	XCOPY_MAX_SEGMENT_LENGTH = MAX_TRANSFER_LENGTH
+)
+
+// copySegment is a block to block segment descriptor, in bytes
+type copySegment struct {
+	offset int64
+	source int64
+	length int64
+}
+
+// handleExtendedCopy copies the segments within the volume. Only the NAA
+// designator of the volume is accepted as the copy target, there are no
+// copies between volumes. The copy is done when the command completes, so
+// there are no copy results kept.
+func (d *Device) handleExtendedCopy(cdb []byte, dataOut []byte) (byte, []byte, []byte) {
+	// LID4 is not supported
+	if cdb[1]&0x1f != XCOPY_LID1 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	length := int(binary.BigEndian.Uint32(cdb[10:]))
+	if length == 0 {
+		return SAM_STAT_GOOD, nil, nil
+	}
+	if length < XCOPY_HEADER_LENGTH || len(dataOut) < length {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	params := dataOut[XCOPY_HEADER_LENGTH:length]
+	cscdLength := int(binary.BigEndian.Uint16(dataOut[2:]))
+	segmentLength := int(binary.BigEndian.Uint32(dataOut[8:]))
+	inlineLength := int(binary.BigEndian.Uint32(dataOut[12:]))
+	if cscdLength%XCOPY_CSCD_LENGTH != 0 || cscdLength > len(params) ||
+		segmentLength > len(params)-cscdLength ||
+		inlineLength > len(params)-cscdLength-segmentLength {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+	}
+	if inlineLength != 0 {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+	}
+	if cscdLength/XCOPY_CSCD_LENGTH > XCOPY_MAX_CSCDS {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_TOO_MANY_TARGET_DESCRIPTORS)
+	}
+
+	local := make([]bool, cscdLength/XCOPY_CSCD_LENGTH)
+	for i := range local {
+		desc := params[i*XCOPY_CSCD_LENGTH : (i+1)*XCOPY_CSCD_LENGTH]
+		if desc[0] != XCOPY_IDENTIFICATION_DESCRIPTOR {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_UNSUPPORTED_TARGET_DESCRIPTOR_TYPE)
+		}
+		local[i] = d.isLocalCSCD(desc)
+	}
+
+	// check all of them before copying anything
+	segments := params[cscdLength : cscdLength+segmentLength]
+	copies := []copySegment{}
+	for len(segments) > 0 {
+		if len(copies) == XCOPY_MAX_SEGMENTS {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_TOO_MANY_SEGMENT_DESCRIPTORS)
+		}
+		if len(segments) < 4 {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+		}
+		if segments[0] != XCOPY_BLOCK_TO_BLOCK {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_UNSUPPORTED_SEGMENT_DESCRIPTOR_TYPE)
+		}
+		descLength := 4 + int(binary.BigEndian.Uint16(segments[2:]))
+		if descLength != XCOPY_SEGMENT_LENGTH || len(segments) < descLength {
+			return CheckCondition(ILLEGAL_REQUEST, ASC_PARAMETER_LIST_LENGTH_ERROR)
+		}
+		segment, sense := d.parseCopySegment(segments[:descLength], local)
+		if sense != nil {
+			return SAM_STAT_CHECK_CONDITION, nil, sense
+		}
+		copies = append(copies, segment)
+		segments = segments[descLength:]
+	}
+	for _, c := range copies {
+		if c.length == 0 {
+			continue
+		}
+		if err := d.copy(c); err != nil {
+			log.Errorln("extended copy failed: ", err)
+			return CheckCondition(MEDIUM_ERROR, ASC_WRITE_ERROR)
+		}
+	}
+	return SAM_STAT_GOOD, nil, nil
+}
+
+// isLocalCSCD tells if the identification descriptor is the NAA designator of
+// the volume
+func (d *Device) isLocalCSCD(desc []byte) bool {
+	// NUL, or not a direct access block device
+	if desc[1]&0x3f != 0 {
+		return false
+	}
+	designator := desc[4:24]
+	codeSet := designator[0] & 0x0f
+	association := (designator[1] >> 4) & 0x03
+	designatorType := designator[1] & 0x0f
+	if codeSet != 0x01 || association != 0x00 || designatorType != 0x03 || designator[3] != 16 {
+		return false
+	}
+	return bytes.Equal(designator[4:20], NAADesignator(d.name))
+}
+
+func (d *Device) parseCopySegment(desc []byte, local []bool) (copySegment, []byte) {
+	source := int(binary.BigEndian.Uint16(desc[4:]))
+	destination := int(binary.BigEndian.Uint16(desc[6:]))
+	if source >= len(local) || destination >= len(local) {
+		return copySegment{}, BuildSense(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+	}
+	if !local[source] || !local[destination] {
+		return copySegment{}, BuildSense(COPY_ABORTED, ASC_UNREACHABLE_COPY_TARGET)
+	}
+
+	// both are the volume, so the block size is the same whichever DC is
+	blocks := uint64(binary.BigEndian.Uint16(desc[10:]))
+	sourceLBA := binary.BigEndian.Uint64(desc[12:])
+	destinationLBA := binary.BigEndian.Uint64(desc[20:])
+	for _, lba := range []uint64{sourceLBA, destinationLBA} {
+		if lba > uint64(d.lbas) || blocks > uint64(d.lbas)-lba {
+			return copySegment{}, BuildSense(ILLEGAL_REQUEST, ASC_LBA_OUT_OF_RANGE)
+		}
+	}
+	if blocks*uint64(d.blockSize) > XCOPY_MAX_SEGMENT_LENGTH {
+		return copySegment{}, BuildSense(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_PARAMETER_LIST)
+	}
+	return copySegment{
+		offset: int64(destinationLBA) * int64(d.blockSize),
+		source: int64(sourceLBA) * int64(d.blockSize),
+		length: int64(blocks) * int64(d.blockSize),
+	}, nil
+}
+
+// copy lets the volume copy by itself if it can, e.g. the replicas copy
+// within their files, otherwise the data is read out and written back
+func (d *Device) copy(c copySegment) error {
+	if copier, ok := d.volume.(types.Copier); ok {
+		return copier.Copy(c.offset, c.source, c.length)
+	}
+	buf := util.GetBuffer(int(c.length))
+	defer util.PutBuffer(buf)
+	if _, err := d.volume.ReadAt(buf, c.source); err != nil {
+		return err
+	}
+	_, err := d.volume.WriteAt(buf, c.offset)
+	return err
+}
+
+// handleReceiveCopyResults only reports the operating parameters, the copies
+// are done synchronously
+func (d *Device) handleReceiveCopyResults(cdb []byte) (byte, []byte, []byte) {
+	if cdb[1]&0x1f != RCR_OPERATING_PARAMETERS {
+		return CheckCondition(ILLEGAL_REQUEST, ASC_INVALID_FIELD_IN_CDB)
+	}
+	allocationLength := int(binary.BigEndian.Uint32(cdb[10:]))
+
+	descriptorTypes := []byte{XCOPY_BLOCK_TO_BLOCK, XCOPY_IDENTIFICATION_DESCRIPTOR}
+	data := make([]byte, 44, 44+len(descriptorTypes))
+	data[4] = 0x01 // SNLID, the list identifiers aren't kept
+	binary.BigEndian.PutUint16(data[8:], XCOPY_MAX_CSCDS)
+	binary.BigEndian.PutUint16(data[10:], XCOPY_MAX_SEGMENTS)
+	binary.BigEndian.PutUint32(data[12:], XCOPY_MAX_CSCDS*XCOPY_CSCD_LENGTH+XCOPY_MAX_SEGMENTS*XCOPY_SEGMENT_LENGTH)
+	binary.BigEndian.PutUint32(data[16:], XCOPY_MAX_SEGMENT_LENGTH)
+	// no inline data, held data or stream devices
+	binary.BigEndian.PutUint16(data[34:], 1) // total concurrent copies
+	data[36] = 1                             // maximum concurrent copies
+	for size := d.blockSize; size > 1; size >>= 1 {
+		data[37]++ // data segment granularity, log2 of the block size
+	}
+	data[43] = byte(len(descriptorTypes))
+	data = append(data, descriptorTypes...)
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return SAM_STAT_GOOD, truncate(data, allocationLength), nil
+}
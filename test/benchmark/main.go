@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/yasker/longhorn/block"
+	"github.com/yasker/longhorn/engine"
+	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/scsi"
+	"github.com/yasker/longhorn/util"
+)
+
+var (
+	log = logrus.WithFields(logrus.Fields{"pkg": "benchmark"})
+
+	requestSize = flag.Int("request-size", 4096, "request size of each IO")
+	workers     = flag.Int("workers", 16, "worker numbers")
+
+	coalesceWindow = flag.Duration("coalesce-window", 0, "how long to wait for adjacent I/Os to merge with, 0 disables coalescing")
+
+	size      = int64(64 * 1024 * 1024)
+	blockSize = 512
+	timeout   = 5 // in seconds
+)
+
+// handler is a replica which throws away the writes, and reads garbage
+func handler(req *rpc.Request) (*rpc.Response, error) {
+	resp := &rpc.Response{
+		Header: &block.Response{
+			Id:     req.Header.Id,
+			Type:   uint64(req.Header.Type + 1),
+			Result: "Success",
+		},
+	}
+	if req.Header.Type == rpc.MSG_TYPE_READ_REQUEST {
+		resp.Header.Length = req.Header.Length
+		resp.Data = util.GetBuffer(int(req.Header.Length))
+	}
+	return resp, nil
+}
+
+func startReplica() string {
+	addr, err := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal("failed to resolve: ", err)
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen to: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.AcceptTCP()
+			if err != nil {
+				log.Errorf("failed to accept connection %v", err)
+				continue
+			}
+			server := rpc.NewServer(conn, 128, handler)
+			server.Start()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// run reports the allocations and the GC pauses per I/O of op, which is
+// called by the workers in parallel
+func run(name string, op func(offset int64) error) {
+	var ops int64
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	result := testing.Benchmark(func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetParallelism((*workers + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				n := atomic.AddInt64(&ops, 1)
+				offset := n * int64(*requestSize) % size
+				if err := op(offset); err != nil {
+					log.Fatalf("%v failed: %v", name, err)
+				}
+			}
+		})
+	})
+	runtime.ReadMemStats(&after)
+
+	pause := time.Duration(after.PauseTotalNs - before.PauseTotalNs)
+	fmt.Printf("%-12s %v %v\n", name, result, result.MemString())
+	fmt.Printf("%-12s %v GCs, %v GC pause, %v GC pause per I/O\n", "",
+		after.NumGC-before.NumGC, pause, pause/time.Duration(ops))
+}
+
+func main() {
+	flag.Parse()
+
+	client := func() *rpc.Client {
+		addr, err := net.ResolveTCPAddr("tcp4", startReplica())
+		if err != nil {
+			log.Fatal("failed to resolve: ", err)
+		}
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			log.Fatal("Cannot connect to replica: ", err)
+		}
+		client := rpc.NewClient(conn, timeout, 128)
+		if *coalesceWindow > 0 {
+			client.SetCoalescing(*coalesceWindow, 1024*1024)
+		}
+		return client
+	}()
+	data := make([]byte, *requestSize)
+
+	run("rpc-write", func(offset int64) error {
+		_, err := client.Call(&rpc.Request{
+			Header: &block.Request{
+				Type:   rpc.MSG_TYPE_WRITE_REQUEST,
+				Offset: offset,
+				Length: int64(len(data)),
+			},
+			Data: data,
+		})
+		return err
+	})
+	run("rpc-read", func(offset int64) error {
+		resp, err := client.Call(&rpc.Request{
+			Header: &block.Request{
+				Type:   rpc.MSG_TYPE_READ_REQUEST,
+				Offset: offset,
+				Length: int64(len(data)),
+			},
+		})
+		if err == nil {
+			util.PutBuffer(resp.Data)
+		}
+		return err
+	})
+
+	// the path of a TCMU command through the controller, with two replicas
+	volume, err := engine.New("benchmark", size, []string{startReplica(), startReplica()}, timeout)
+	if err != nil {
+		log.Fatal("Fail to open volume: ", err)
+	}
+	if *coalesceWindow > 0 {
+		volume.SetCoalescing(*coalesceWindow, 1024*1024)
+	}
+	device, err := scsi.NewDevice("benchmark", volume, blockSize)
+	if err != nil {
+		log.Fatal("Fail to create device: ", err)
+	}
+	command := func(opcode byte, offset int64) error {
+		cdb := make([]byte, 10)
+		cdb[0] = opcode
+		lba, blocks := offset/int64(blockSize), *requestSize/blockSize
+		cdb[2], cdb[3], cdb[4], cdb[5] = byte(lba>>24), byte(lba>>16), byte(lba>>8), byte(lba)
+		cdb[7], cdb[8] = byte(blocks>>8), byte(blocks)
+
+		var dataOut []byte
+		if scsi.IsDataOut(opcode) {
+			// as copied from the iovec
+			dataOut = util.GetBuffer(*requestSize)
+			copy(dataOut, data)
+			defer util.PutBuffer(dataOut)
+		}
+		status, dataIn, _ := device.HandleCommand("benchmark", cdb, dataOut)
+		util.PutBuffer(dataIn)
+		if status != scsi.SAM_STAT_GOOD {
+			return fmt.Errorf("SCSI status 0x%x", status)
+		}
+		return nil
+	}
+	run("scsi-write", func(offset int64) error {
+		return command(scsi.WRITE_10, offset)
+	})
+	run("scsi-read", func(offset int64) error {
+		return command(scsi.READ_10, offset)
+	})
+}
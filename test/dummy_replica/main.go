@@ -12,6 +12,7 @@ import (
 
 	"github.com/yasker/longhorn/block"
 	"github.com/yasker/longhorn/rpc"
+	"github.com/yasker/longhorn/util"
 )
 
 const (
@@ -44,7 +45,7 @@ func RequestHandler(req *rpc.Request) (*rpc.Response, error) {
 				Length: req.Header.Length,
 				Result: "Success",
 			},
-			Data: make([]byte, req.Header.Length),
+			Data: util.GetBuffer(int(req.Header.Length)),
 		}, nil
 	}
 	if req.Header.Type == rpc.MSG_TYPE_WRITE_REQUEST {
@@ -56,6 +57,51 @@ func RequestHandler(req *rpc.Request) (*rpc.Response, error) {
 			},
 		}, nil
 	}
+	if req.Header.Type == rpc.MSG_TYPE_FLUSH_REQUEST {
+		return &rpc.Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   rpc.MSG_TYPE_FLUSH_RESPONSE,
+				Result: "Success",
+			},
+		}, nil
+	}
+	if req.Header.Type == rpc.MSG_TYPE_DISCARD_REQUEST {
+		return &rpc.Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   rpc.MSG_TYPE_DISCARD_RESPONSE,
+				Result: "Success",
+			},
+		}, nil
+	}
+	if req.Header.Type == rpc.MSG_TYPE_COPY_REQUEST {
+		return &rpc.Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   rpc.MSG_TYPE_COPY_RESPONSE,
+				Result: "Success",
+			},
+		}, nil
+	}
+	if req.Header.Type == rpc.MSG_TYPE_READ_METADATA_REQUEST {
+		return &rpc.Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   rpc.MSG_TYPE_READ_METADATA_RESPONSE,
+				Result: "Success",
+			},
+		}, nil
+	}
+	if req.Header.Type == rpc.MSG_TYPE_WRITE_METADATA_REQUEST {
+		return &rpc.Response{
+			Header: &block.Response{
+				Id:     req.Header.Id,
+				Type:   rpc.MSG_TYPE_WRITE_METADATA_RESPONSE,
+				Result: "Success",
+			},
+		}, nil
+	}
 	return nil, fmt.Errorf("Invalid request type: ", req.Header.Type)
 }
 
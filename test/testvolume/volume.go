@@ -0,0 +1,45 @@
+// Package testvolume is a volume in memory for the tests of the frontends,
+// with no replica or engine behind.
+package testvolume
+
+import (
+	"sync"
+
+	"github.com/yasker/longhorn/replica"
+)
+
+// Volume is a types.Volume over the memory backend of the replica, which
+// counts its flushes
+type Volume struct {
+	replica.Backend
+	size    int64
+	flushes int
+	mutex   *sync.Mutex
+}
+
+// New returns a volume of size bytes in memory, reading as zeroes
+func New(size int64) *Volume {
+	return &Volume{
+		Backend: replica.NewMemory(size, 0),
+		size:    size,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (v *Volume) Size() int64 {
+	return v.size
+}
+
+func (v *Volume) Flush() error {
+	v.mutex.Lock()
+	v.flushes++
+	v.mutex.Unlock()
+	return v.Backend.Flush()
+}
+
+// Flushes returns how many times the volume was flushed
+func (v *Volume) Flushes() int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.flushes
+}
@@ -0,0 +1,64 @@
+package types
+
+import (
+	"io"
+	"time"
+)
+
+// Volume is the block storage served by a frontend. Offsets and lengths are
+// in bytes.
+type Volume interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Flush makes sure all the completed writes are persistent.
+	Flush() error
+	// Discard tells the range is no longer used, it would be read as
+	// zeroes afterwards.
+	Discard(offset, length int64) error
+	Size() int64
+	// Close releases the volume. Outstanding operations would be aborted.
+	Close() error
+}
+
+// MetadataStore keeps small named blobs along with a volume, e.g. the SCSI
+// persistent reservations, so they survive restarts of the frontend. A volume
+// may implement it.
+type MetadataStore interface {
+	// GetMetadata returns empty value if name was never set
+	GetMetadata(name string) ([]byte, error)
+	// SetMetadata is persistent when it returns
+	SetMetadata(name string, value []byte) error
+}
+
+// Copier is a volume which copies data within itself without reading it out
+// first. A volume may implement it.
+type Copier interface {
+	// Copy copies length bytes at source to offset, the ranges may
+	// overlap
+	Copy(offset, source, length int64) error
+}
+
+// Fenceable is a volume whose replicas reject the changes from the
+// controllers older than the newest one they have seen, so only one of the
+// controllers fronting the same replicas can write. A volume may implement
+// it.
+type Fenceable interface {
+	// SetEpoch makes the following requests carry the epoch of the
+	// controller, which increases each time a controller takes over
+	SetEpoch(epoch int64)
+}
+
+// VolumeOpener opens the volume name of size bytes, which is backed by the
+// replicas at the given addresses. timeout is in seconds, for each replica
+// operation.
+type VolumeOpener func(name string, size int64, replicas []string, timeout int) (Volume, error)
+
+// Frontend exposes volumes to their consumers, e.g. as a SCSI device through
+// TCMU.
+type Frontend interface {
+	Startup() error
+	// Shutdown stops taking new requests and waits for the in-flight ones
+	// up to timeout, then flushes and closes all the volumes.
+	Shutdown(timeout time.Duration) error
+}
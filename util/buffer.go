@@ -0,0 +1,84 @@
+package util
+
+import (
+	"sync"
+	"unsafe"
+)
+
+const (
+	// the buffers are pooled by the power of two sizes from 512 bytes to
+	// 32 MiB, the most a SCSI command or an rpc message carries
+	minBufferShift = 9
+	maxBufferShift = 25
+)
+
+var (
+	bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+	// the *[]byte kept in bufferPools, recycled so putting a buffer back
+	// doesn't allocate
+	bufferRefs = sync.Pool{
+		New: func() interface{} {
+			return new([]byte)
+		},
+	}
+)
+
+// bufferClass returns the pool of buffers with at least size bytes, or -1 if
+// it's too large to be pooled
+func bufferClass(size int) int {
+	class := 0
+	for 1<<uint(class+minBufferShift) < size {
+		class++
+	}
+	if class >= len(bufferPools) {
+		return -1
+	}
+	return class
+}
+
+// GetBuffer returns a buffer of length bytes, whose content is undefined. It
+// should be put back with PutBuffer once it's no longer used.
+func GetBuffer(length int) []byte {
+	if length == 0 {
+		return []byte{}
+	}
+	class := bufferClass(length)
+	if class < 0 {
+		return make([]byte, length)
+	}
+	if ref, ok := bufferPools[class].Get().(*[]byte); ok {
+		buf := *ref
+		*ref = nil
+		bufferRefs.Put(ref)
+		return buf[:length]
+	}
+	return make([]byte, length, 1<<uint(class+minBufferShift))
+}
+
+// GetAlignedBuffer returns a buffer of length bytes at an address aligned to
+// alignment, e.g. for O_DIRECT. The first one returned is the one to put back
+// with PutBuffer.
+func GetAlignedBuffer(length, alignment int) ([]byte, []byte) {
+	buf := GetBuffer(length + alignment)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(alignment)); rem != 0 {
+		skip = alignment - rem
+	}
+	return buf, buf[skip : skip+length]
+}
+
+// PutBuffer makes buf available to GetBuffer again, nothing may use it
+// afterwards. Buffers not from GetBuffer are fine, they are pooled if their
+// capacity fits a pool.
+func PutBuffer(buf []byte) {
+	if cap(buf) < 1<<minBufferShift {
+		return
+	}
+	class := bufferClass(cap(buf))
+	if class < 0 || cap(buf) != 1<<uint(class+minBufferShift) {
+		return
+	}
+	ref := bufferRefs.Get().(*[]byte)
+	*ref = buf[:cap(buf)]
+	bufferPools[class].Put(ref)
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestGetBuffer(t *testing.T) {
+	for _, length := range []int{1, 512, 513, 4096, 1 << 25, 1<<25 + 1} {
+		buf := GetBuffer(length)
+		if len(buf) != length {
+			t.Fatalf("Got %v bytes, expected %v", len(buf), length)
+		}
+		PutBuffer(buf)
+	}
+
+	// the buffers come back from their pool by capacity
+	buf := GetBuffer(3000)
+	if cap(buf) != 4096 {
+		t.Fatalf("Buffer of 3000 bytes has capacity %v, expected 4096", cap(buf))
+	}
+	PutBuffer(buf)
+	if buf := GetBuffer(4000); cap(buf) != 4096 {
+		t.Fatalf("Buffer of 4000 bytes has capacity %v, expected 4096", cap(buf))
+	}
+}
+
+func TestGetAlignedBuffer(t *testing.T) {
+	for _, length := range []int{512, 4096, 65536} {
+		buf, aligned := GetAlignedBuffer(length, 4096)
+		if len(aligned) != length || uintptr(unsafe.Pointer(&aligned[0]))%4096 != 0 {
+			t.Fatalf("Buffer of %v bytes at %p is not aligned", len(aligned), &aligned[0])
+		}
+		PutBuffer(buf)
+	}
+}
+
+// benchmarkBuffers reports the GC pauses per op along with the allocations
+func benchmarkBuffers(b *testing.B, length int, get func(int) []byte, put func([]byte)) {
+	var before, after runtime.MemStats
+	b.ReportAllocs()
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf := get(length)
+			buf[0] = 1
+			put(buf)
+		}
+	})
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	pause := time.Duration(after.PauseTotalNs - before.PauseTotalNs)
+	b.ReportMetric(float64(pause.Nanoseconds())/float64(b.N), "gc-pause-ns/op")
+}
+
+func BenchmarkBuffer(b *testing.B) {
+	for _, length := range []int{4096, 1024 * 1024} {
+		b.Run("pool-"+sizeName(length), func(b *testing.B) {
+			benchmarkBuffers(b, length, GetBuffer, PutBuffer)
+		})
+		b.Run("make-"+sizeName(length), func(b *testing.B) {
+			benchmarkBuffers(b, length, func(n int) []byte {
+				return make([]byte, n)
+			}, func([]byte) {})
+		})
+	}
+}
+
+func sizeName(length int) string {
+	if length >= 1024*1024 {
+		return fmt.Sprintf("%vMiB", length/1024/1024)
+	}
+	return fmt.Sprintf("%vKiB", length/1024)
+}
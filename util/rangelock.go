@@ -0,0 +1,91 @@
+package util
+
+import (
+	"sync"
+)
+
+// Range is from Start to End, End excluded
+type Range struct {
+	Start int64
+	End   int64
+}
+
+func (r Range) overlaps(other Range) bool {
+	return r.Start < other.End && other.Start < r.End
+}
+
+// RangeLock keeps the order of the users of overlapping ranges, each waits for
+// the earlier ones overlapping it to be done. Those not overlapping go in
+// parallel.
+type RangeLock struct {
+	mutex *sync.Mutex
+	holds []*RangeHold
+}
+
+// RangeHold is the place of a user of some ranges in a RangeLock
+type RangeHold struct {
+	lock    *RangeLock
+	ranges  []Range
+	backing [2]Range
+	earlier []*RangeHold
+	done    chan struct{}
+}
+
+func NewRangeLock() *RangeLock {
+	return &RangeLock{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Hold takes the place after the users of the ranges so far. The ranges
+// should be used after Wait, then Release.
+func (l *RangeLock) Hold(ranges ...Range) *RangeHold {
+	h := &RangeHold{
+		lock: l,
+		done: make(chan struct{}),
+	}
+	h.ranges = append(h.backing[:0], ranges...)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, other := range l.holds {
+		if other.overlaps(h.ranges) {
+			h.earlier = append(h.earlier, other)
+		}
+	}
+	l.holds = append(l.holds, h)
+	return h
+}
+
+func (h *RangeHold) overlaps(ranges []Range) bool {
+	for _, a := range h.ranges {
+		for _, b := range ranges {
+			if a.overlaps(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wait returns once the earlier users overlapping are done
+func (h *RangeHold) Wait() {
+	for _, other := range h.earlier {
+		<-other.done
+	}
+	h.earlier = nil
+}
+
+// Release lets the later users overlapping go
+func (h *RangeHold) Release() {
+	l := h.lock
+	l.mutex.Lock()
+	for i, other := range l.holds {
+		if other == h {
+			l.holds = append(l.holds[:i], l.holds[i+1:]...)
+			break
+		}
+	}
+	l.mutex.Unlock()
+	close(h.done)
+}
@@ -0,0 +1,86 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// wait waits for the hold in a goroutine, the channel is closed once it's done
+func wait(h *RangeHold) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		h.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// blocked tells if the wait is still blocked after a while
+func blocked(done chan struct{}) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+func TestRangeLockOverlap(t *testing.T) {
+	l := NewRangeLock()
+	first := l.Hold(Range{Start: 0, End: 4096})
+	second := l.Hold(Range{Start: 2048, End: 8192})
+	third := l.Hold(Range{Start: 6144, End: 8192})
+
+	first.Wait()
+	secondDone, thirdDone := wait(second), wait(third)
+	if !blocked(secondDone) {
+		t.Fatal("Hold overlapping an earlier one doesn't wait for it")
+	}
+	// the third overlaps the second only, which is after the first
+	if !blocked(thirdDone) {
+		t.Fatal("Hold doesn't wait for an earlier one waiting itself")
+	}
+
+	first.Release()
+	if blocked(secondDone) {
+		t.Fatal("Hold still waits once the earlier one is released")
+	}
+	if !blocked(thirdDone) {
+		t.Fatal("Hold doesn't wait for the earlier one overlapping it")
+	}
+	second.Release()
+	if blocked(thirdDone) {
+		t.Fatal("Hold still waits once the earlier ones are released")
+	}
+	third.Release()
+}
+
+func TestRangeLockParallel(t *testing.T) {
+	l := NewRangeLock()
+	first := l.Hold(Range{Start: 0, End: 4096})
+	// adjacent, the end is excluded
+	second := l.Hold(Range{Start: 4096, End: 8192})
+	if blocked(wait(second)) {
+		t.Fatal("Hold adjacent to an earlier one waits for it")
+	}
+
+	// a copy holds its source as well, which overlaps the first
+	cp := l.Hold(Range{Start: 65536, End: 69632}, Range{Start: 0, End: 1024})
+	cpDone := wait(cp)
+	if !blocked(cpDone) {
+		t.Fatal("Hold of several ranges doesn't wait for those overlapping one")
+	}
+	other := l.Hold(Range{Start: 8192, End: 65536})
+	if blocked(wait(other)) {
+		t.Fatal("Hold waits for earlier ones not overlapping it")
+	}
+
+	first.Release()
+	<-cpDone
+	for _, h := range []*RangeHold{second, cp, other} {
+		h.Release()
+	}
+	if len(l.holds) != 0 {
+		t.Fatalf("%v holds left once all are released", len(l.holds))
+	}
+}
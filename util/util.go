@@ -5,6 +5,10 @@ import (
 	"os"
 )
 
+func IsBlockDevice(mode os.FileMode) bool {
+	return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+}
+
 func FindOrCreateDisk(path string, size int64) error {
 	stat, err := os.Stat(path)
 	if os.IsNotExist(err) {
@@ -22,10 +26,16 @@ func FindOrCreateDisk(path string, size int64) error {
 			return err
 		}
 
+	} else if err != nil {
+		return err
 	}
 	if stat.IsDir() {
 		return fmt.Errorf("Cannot find disk file %v, it's a directory", path)
 	}
+	// a whole disk or a logical volume may store the data too
+	if !stat.Mode().IsRegular() && !IsBlockDevice(stat.Mode()) {
+		return fmt.Errorf("Cannot use disk %v, it's neither a regular file nor a block device", path)
+	}
 	/*
 		if stat.Size() != size {
 			return fmt.Errorf("Disk file %v size %v is not the same as %v",